@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"os"
 	"path/filepath"
@@ -8,7 +9,9 @@ import (
 
 	"github.com/fsnotify/fsnotify"
 	log "github.com/sirupsen/logrus"
+	"github.com/sylr/prometheus-azure-exporter/pkg/azure"
 	"github.com/sylr/prometheus-azure-exporter/pkg/config"
+	"github.com/sylr/prometheus-azure-exporter/pkg/cron"
 	"github.com/sylr/prometheus-azure-exporter/pkg/metrics"
 	"sylr.dev/libqd/cache"
 )
@@ -67,36 +70,120 @@ func applyConfig(conf *config.PrometheusAzureExporterConfig) error {
 		cache.SetNoop(true)
 	}
 
-	// Update metrics functions interval
-	needCancel := false
+	// Endpoints
+	azure.SetEndpoints(azure.Endpoints{
+		ResourceManager: config.CurrentConfig.Endpoints.ResourceManager,
+		ActiveDirectory: config.CurrentConfig.Endpoints.ActiveDirectory,
+		Graph:           config.CurrentConfig.Endpoints.Graph,
+		Batch:           config.CurrentConfig.Endpoints.Batch,
+		BatchAccount:    config.CurrentConfig.Endpoints.BatchAccount,
+		Blob:            config.CurrentConfig.Endpoints.Blob,
+		Storage:         config.CurrentConfig.Endpoints.Storage,
+	})
+
+	// Rate limits
+	azure.SetRateLimits(azure.RateLimits{
+		RequestsPerSecond: config.CurrentConfig.RateLimitRequestsPerSecond,
+		Burst:             config.CurrentConfig.RateLimitBurst,
+		Reserve:           config.CurrentConfig.RateLimitReserve,
+	})
+
+	// Maximum number of concurrent requests
+	azure.SetMaxConcurrentRequests(config.CurrentConfig.MaxConcurrentRequests)
+
+	// Maximum number of items of list calls
+	azure.SetMaxListItems(int(config.CurrentConfig.MaxListItems))
+
+	// Recording or replaying of Azure requests
+	if err := azure.SetRecordReplay(config.CurrentConfig.RecordDir, config.CurrentConfig.ReplayDir); err != nil {
+		log.WithField("_id", "00000000").Errorf("Unable to set up recording or replaying of Azure requests: %s", err)
+		return err
+	}
+
+	// Credential profiles
+	profiles := make([]*azure.Profile, 0, len(config.CurrentConfig.CredentialProfiles))
+	for _, p := range config.CurrentConfig.CredentialProfiles {
+		profiles = append(profiles, &azure.Profile{
+			Name:                p.Name,
+			TenantID:            p.TenantID,
+			ClientID:            p.ClientID,
+			ClientSecret:        p.ClientSecret,
+			CertificatePath:     p.CertificatePath,
+			CertificatePassword: p.CertificatePassword,
+			Username:            p.Username,
+			Password:            p.Password,
+			FederatedTokenFile:  p.FederatedTokenFile,
+			Method:              p.Method,
+		})
+	}
+	azure.SetProfiles(profiles)
+
+	// Update metrics functions schedule, overlap policy and run options
+	scrape := config.CollectionModeScrape.MatchString(config.CurrentConfig.CollectionMode)
+
 	for _, v := range config.CurrentConfig.UpdateMetricsFunctions {
-		interval := metrics.GetUpdateMetricsFunctionInterval(v.Name)
-
-		if v.Interval == time.Duration(0) {
-			// New interval nil or unset.
-			metrics.UnregisterUpdateMetricsFunctions(v.Name)
-			needCancel = true
-		} else if interval != nil && *interval != v.Interval {
-			// Current interval set and different from new interval
-			f := metrics.UnregisterUpdateMetricsFunctions(v.Name)
-			metrics.RegisterUpdateMetricsFunctionWithInterval(v.Name, f, v.Interval)
-			needCancel = true
-		} else if interval == nil && v.Interval != time.Duration(0) {
-			// Current interval nil and new interval set
-			f := metrics.GetUpdateMetricsFunction(v.Name)
-			metrics.RegisterUpdateMetricsFunctionWithInterval(v.Name, f, v.Interval)
-			needCancel = true
+		if scrape {
+			// Functions are not scheduled in scrape collection mode.
+		} else if len(v.Cron) > 0 {
+			schedule, err := cron.Parse(v.Cron)
+
+			if err != nil {
+				return err
+			}
+
+			if err := metrics.RescheduleUpdateMetricsFunctionWithCron(v.Name, schedule); err != nil {
+				log.WithField("_id", "00000000").Warnf("Unable to set update metrics function cron schedule: %s", err)
+				continue
+			}
+		} else if err := metrics.RescheduleUpdateMetricsFunction(v.Name, v.Interval); err != nil {
+			log.WithField("_id", "00000000").Warnf("Unable to set update metrics function interval: %s", err)
+			continue
+		}
+
+		policy, err := metrics.ParseOverlapPolicy(v.Overlap)
+
+		if err != nil {
+			return err
 		}
+
+		metrics.SetUpdateMetricsFunctionOverlapPolicy(v.Name, policy)
+		metrics.SetUpdateMetricsFunctionOptions(v.Name, metrics.FunctionOptions{
+			Timeout: v.Timeout,
+			Jitter:  v.Jitter,
+			Backoff: v.Backoff,
+		})
 	}
 
-	if needCancel {
-		metrics.CancelUpdateMetricsFunctions()
+	// Scrape collection mode, the interval of functions is their minimum
+	// refresh age.
+	if scrape {
+		minAges := make(map[string]time.Duration)
+
+		for _, v := range config.CurrentConfig.UpdateMetricsFunctions {
+			minAges[v.Name] = v.Interval
+		}
+
+		for _, f := range metrics.GetDefaultScheduler().Functions() {
+			minAge := minAges[f.Name]
+
+			if minAge == 0 {
+				minAge = config.CurrentConfig.ScrapeMinRefreshAge
+			}
+
+			if err := metrics.SetUpdateMetricsFunctionOnDemand(f.Name, minAge); err != nil {
+				return err
+			}
+		}
+
+		metrics.SetUpdateMetricsRefreshWait(config.CurrentConfig.ScrapeRefreshWait)
 	}
 
 	return nil
 }
 
-func watchConfigFile() {
+// watchConfigFile reloads the configuration when the config file changes
+// until ctx is done.
+func watchConfigFile(ctx context.Context) {
 	logger := log.WithFields(log.Fields{
 		"_id": "00000000",
 	})
@@ -127,6 +214,9 @@ func watchConfigFile() {
 
 	for {
 		select {
+		case <-ctx.Done():
+			logger.Info("Closing config file watcher")
+			return
 		case event, ok := <-watcher.Events:
 			if !ok {
 				logger.Error("fsnotify: error")
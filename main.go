@@ -6,11 +6,16 @@ import (
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
+	"github.com/sylr/prometheus-azure-exporter/pkg/api"
+	"github.com/sylr/prometheus-azure-exporter/pkg/azure"
 	"github.com/sylr/prometheus-azure-exporter/pkg/config"
 	"github.com/sylr/prometheus-azure-exporter/pkg/metrics"
 	"github.com/sylr/prometheus-azure-exporter/pkg/tools"
@@ -69,7 +74,12 @@ func main() {
 	if err != nil {
 		os.Exit(1)
 	}
-	go watchConfigFile()
+
+	// Root context canceled on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go watchConfigFile(ctx)
 
 	// Log options
 	log.Debugf("Options: %+v", config.CurrentConfig)
@@ -82,16 +92,70 @@ func main() {
 	metrics.SetDefaultUpdateMetricsInterval(config.CurrentConfig.UpdateInterval)
 
 	// Update metrics process
-	ctx := context.Background()
-	go metrics.UpdateMetrics(ctx)
+	updateMetricsDone := make(chan struct{})
+	go func() {
+		metrics.UpdateMetrics(ctx)
+		close(updateMetricsDone)
+	}()
+
+	// Proactive refresh of Azure tokens
+	go azure.RefreshTokens(ctx, time.Minute)
 
 	// Prometheus http endpoint
 	listeningAddress := fmt.Sprintf("%s:%d", config.CurrentConfig.ListeningAddress, config.CurrentConfig.ListeningPort)
 	http.Handle("/metrics", promhttp.Handler())
-	err = http.ListenAndServe(listeningAddress, nil)
 
-	if err != nil {
+	// Admin API
+	if config.CurrentConfig.AdminAPI {
+		http.Handle(api.Prefix, api.NewHandler(metrics.GetDefaultScheduler()))
+	}
+
+	server := &http.Server{Addr: listeningAddress}
+	serverErr := make(chan error, 1)
+
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err = <-serverErr:
 		log.Fatal(err)
-		os.Exit(1)
+	case <-ctx.Done():
+		// A second signal kills the process.
+		stop()
+	}
+
+	shutdown(server, updateMetricsDone)
+}
+
+// shutdown waits for the update metrics functions, which have been canceled,
+// to return and stops the http server within the grace period.
+func shutdown(server *http.Server, updateMetricsDone chan struct{}) {
+	logger := log.WithFields(log.Fields{
+		"_id": "00000000",
+	})
+
+	grace := config.CurrentConfig.ShutdownGracePeriod
+	logger.Infof("Shutting down, grace period: %s", grace)
+
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+
+	<-updateMetricsDone
+	logger.Infof("Update metrics processes stopped, waiting for %d running update metrics functions", metrics.CountRunningUpdateMetricsFunctions())
+
+	if err := metrics.WaitUpdateMetricsFunctions(ctx); err != nil {
+		logger.Warnf("Gave up waiting for %d running update metrics functions: %s", metrics.CountRunningUpdateMetricsFunctions(), err)
+	} else {
+		logger.Info("Update metrics functions stopped")
 	}
+
+	logger.Info("Shutting down http server")
+
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Warnf("Unable to shut down http server gracefully: %s", err)
+		server.Close()
+	}
+
+	logger.Info("Shutdown complete")
 }
@@ -0,0 +1,212 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sylr/prometheus-azure-exporter/pkg/metrics"
+)
+
+const (
+	// Prefix is the path the admin API is served under.
+	Prefix = "/api/v1/"
+	// MinInterval is the smallest non-zero interval functions can be
+	// rescheduled to, so that they cannot hammer Azure.
+	MinInterval = time.Second
+)
+
+// function is the JSON representation of metrics.FunctionStatus.
+type function struct {
+	Name          string     `json:"name"`
+	Interval      string     `json:"interval,omitempty"`
+	Cron          string     `json:"cron,omitempty"`
+	MinRefreshAge string     `json:"min_refresh_age,omitempty"`
+	Overlap       string     `json:"overlap"`
+	InFlight      int        `json:"in_flight"`
+	LastRun       *time.Time `json:"last_run,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+	NextRun       *time.Time `json:"next_run,omitempty"`
+}
+
+// intervalRequest is the body of POST /api/v1/functions/{name}/interval.
+type intervalRequest struct {
+	Interval string `json:"interval"`
+}
+
+// runResponse is the body of the response of POST
+// /api/v1/functions/{name}/run.
+type runResponse struct {
+	Status metrics.RunStatus `json:"status"`
+}
+
+// errorResponse is the body of error responses.
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// handler serves the admin API of a scheduler.
+type handler struct {
+	scheduler *metrics.Scheduler
+}
+
+// NewHandler returns the handler of the admin API of scheduler, to be
+// mounted on Prefix.
+func NewHandler(scheduler *metrics.Scheduler) http.Handler {
+	return &handler{scheduler: scheduler}
+}
+
+// ServeHTTP implements http.Handler.
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, Prefix), "/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "functions":
+		h.allow(w, r, http.MethodGet, h.listFunctions)
+	case len(parts) == 3 && parts[0] == "functions" && parts[2] == "run":
+		h.allow(w, r, http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+			h.runFunction(w, r, parts[1])
+		})
+	case len(parts) == 3 && parts[0] == "functions" && parts[2] == "interval":
+		h.allow(w, r, http.MethodPost, func(w http.ResponseWriter, r *http.Request) {
+			h.setFunctionInterval(w, r, parts[1])
+		})
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("no such endpoint: %s", r.URL.Path))
+	}
+}
+
+// allow calls f if the request method is method.
+func (h *handler) allow(w http.ResponseWriter, r *http.Request, method string, f http.HandlerFunc) {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	f(w, r)
+}
+
+// listFunctions serves GET /api/v1/functions.
+func (h *handler) listFunctions(w http.ResponseWriter, r *http.Request) {
+	statuses := h.scheduler.Functions()
+	functions := make([]function, 0, len(statuses))
+
+	for _, status := range statuses {
+		f := function{
+			Name:          status.Name,
+			Overlap:       string(status.Overlap),
+			InFlight:      status.InFlight,
+			LastRun:       timeOrNil(status.LastRun),
+			LastErrorTime: timeOrNil(status.LastErrorTime),
+			NextRun:       timeOrNil(status.NextRun),
+		}
+
+		if status.Interval > 0 {
+			f.Interval = status.Interval.String()
+		}
+
+		if status.Cron != nil {
+			f.Cron = status.Cron.String()
+		}
+
+		if status.MinRefreshAge > 0 {
+			f.MinRefreshAge = status.MinRefreshAge.String()
+		}
+
+		if status.LastError != nil {
+			f.LastError = status.LastError.Error()
+		}
+
+		functions = append(functions, f)
+	}
+
+	writeJSON(w, http.StatusOK, functions)
+}
+
+// runFunction serves POST /api/v1/functions/{name}/run.
+func (h *handler) runFunction(w http.ResponseWriter, r *http.Request, name string) {
+	if h.scheduler.Function(name) == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown update metrics function `%s`", name))
+		return
+	}
+
+	status, err := h.scheduler.Trigger(name)
+
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+
+	code := http.StatusAccepted
+
+	if status == metrics.RunSkipped {
+		code = http.StatusConflict
+	}
+
+	writeJSON(w, code, runResponse{Status: status})
+}
+
+// setFunctionInterval serves POST /api/v1/functions/{name}/interval.
+func (h *handler) setFunctionInterval(w http.ResponseWriter, r *http.Request, name string) {
+	if h.scheduler.Function(name) == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown update metrics function `%s`", name))
+		return
+	}
+
+	req := intervalRequest{}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decoding request: %v", err))
+		return
+	}
+
+	interval, err := time.ParseDuration(req.Interval)
+
+	if err != nil || interval < 0 {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("`%s` is not a valid interval", req.Interval))
+		return
+	}
+
+	if interval > 0 && interval < MinInterval {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("interval `%s` is below the minimum of %v", req.Interval, MinInterval))
+		return
+	}
+
+	if err := h.scheduler.Reschedule(name, interval); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	log.WithField("_id", "00000000").Infof("Update metrics function `%s` rescheduled every %v through the admin API", name, interval)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// timeOrNil returns nil for the zero time so that it is omitted.
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	return &t
+}
+
+// writeJSON writes v as the JSON body of the response.
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithField("_id", "00000000").Errorf("Unable to write admin API response: %s", err)
+	}
+}
+
+// writeError writes err as the JSON body of the response.
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, errorResponse{Error: err.Error()})
+}
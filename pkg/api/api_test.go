@@ -0,0 +1,138 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sylr/prometheus-azure-exporter/pkg/metrics"
+)
+
+func TestAdminAPI(t *testing.T) {
+	scheduler := metrics.NewScheduler(metrics.NewRealClock(), nil)
+	runs := make(chan struct{}, 10)
+
+	scheduler.RegisterWithInterval("test", func(ctx context.Context) error {
+		runs <- struct{}{}
+		return errors.New("boom")
+	}, time.Hour)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go scheduler.Run(ctx)
+
+	server := httptest.NewServer(NewHandler(scheduler))
+	defer server.Close()
+
+	// Run
+	deadline := time.Now().Add(5 * time.Second)
+
+	for {
+		resp, err := http.Post(server.URL+"/api/v1/functions/test/run", "application/json", nil)
+
+		if err != nil {
+			t.Fatalf("Expected no error but got %v", err)
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode == http.StatusAccepted {
+			break
+		}
+
+		// The interval process may not be running yet.
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %v but got %v", http.StatusAccepted, resp.StatusCode)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	select {
+	case <-runs:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the function to run")
+	}
+
+	// List
+	var functions []function
+
+	for time.Now().Before(deadline) {
+		resp, err := http.Get(server.URL + "/api/v1/functions")
+
+		if err != nil {
+			t.Fatalf("Expected no error but got %v", err)
+		}
+
+		functions = nil
+		json.NewDecoder(resp.Body).Decode(&functions)
+		resp.Body.Close()
+
+		if len(functions) == 1 && functions[0].LastError == "boom" {
+			break
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	if len(functions) != 1 || functions[0].Interval != "1h0m0s" || functions[0].LastRun == nil || functions[0].NextRun == nil {
+		t.Fatalf("Expected %v but got %+v", "test function every 1h0m0s which failed", functions)
+	}
+
+	// Interval
+	resp, err := http.Post(server.URL+"/api/v1/functions/test/interval", "application/json", strings.NewReader(`{"interval":"2h"}`))
+
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected %v but got %v", http.StatusNoContent, resp.StatusCode)
+	}
+
+	if interval := scheduler.Interval("test"); interval == nil || *interval != 2*time.Hour {
+		t.Fatalf("Expected %v but got %v", 2*time.Hour, interval)
+	}
+
+	// Errors
+	tests := []struct {
+		method   string
+		path     string
+		body     string
+		expected int
+	}{
+		{http.MethodPost, "/api/v1/functions", "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/api/v1/functions/unknown/run", "", http.StatusNotFound},
+		{http.MethodPost, "/api/v1/functions/test/interval", `{"interval":"soon"}`, http.StatusBadRequest},
+		{http.MethodPost, "/api/v1/functions/test/interval", `{"interval":"-1s"}`, http.StatusBadRequest},
+		{http.MethodPost, "/api/v1/functions/test/interval", `{"interval":"1ms"}`, http.StatusBadRequest},
+		{http.MethodGet, "/api/v1/unknown", "", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		req, _ := http.NewRequest(test.method, server.URL+test.path, strings.NewReader(test.body))
+		resp, err := http.DefaultClient.Do(req)
+
+		if err != nil {
+			t.Fatalf("Expected no error but got %v", err)
+		}
+
+		resp.Body.Close()
+
+		if resp.StatusCode != test.expected {
+			t.Fatalf("Expected %v but got %v for %s %s", test.expected, resp.StatusCode, test.method, test.path)
+		}
+	}
+
+	// Rejected intervals are not applied.
+	if interval := scheduler.Interval("test"); interval == nil || *interval != 2*time.Hour {
+		t.Fatalf("Expected %v but got %v", 2*time.Hour, interval)
+	}
+}
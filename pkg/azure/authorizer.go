@@ -1,127 +1,288 @@
 package azure
 
 import (
-	"os"
+	"context"
+	"sync"
+	"time"
 
 	"github.com/Azure/go-autorest/autorest"
-	"github.com/Azure/go-autorest/autorest/azure"
-	"github.com/Azure/go-autorest/autorest/azure/auth"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Tokens expiring in less than tokenProactiveRefreshWithin are refreshed
+	// by RefreshTokens(). It is greater than tokenRefreshWithin so that a
+	// failing refresh is noticed before requests start to fail.
+	tokenProactiveRefreshWithin = 15 * time.Minute
 )
 
 var (
-	authorizer                    autorest.Authorizer
-	graphAuthorizer               autorest.Authorizer
-	batchAuthorizer               autorest.Authorizer
-	batchAuthorizerWithResource   autorest.Authorizer
-	storageAuthorizer             autorest.Authorizer
-	storageAuthorizerWithResource autorest.Authorizer
+	// AzureExporterTokenExpiryTimestampSeconds Expiry time of the tokens held by the registry
+	AzureExporterTokenExpiryTimestampSeconds = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "azure_exporter",
+			Subsystem: "token",
+			Name:      "expiry_timestamp_seconds",
+			Help:      "Unix timestamp of the expiry of the current token for each profile and resource",
+		},
+		[]string{"profile", "resource"},
+	)
+
+	// AzureExporterTokenRefreshFailuresTotal Total number of failed token refreshes
+	AzureExporterTokenRefreshFailuresTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "azure_exporter",
+			Subsystem: "token",
+			Name:      "refresh_failures_total",
+			Help:      "Total number of failed token refreshes for each profile and resource",
+		},
+		[]string{"profile", "resource"},
+	)
 )
 
-// GetAuthorizer get graph authorizer
-func GetAuthorizer() (autorest.Authorizer, error) {
-	if authorizer != nil {
-		return authorizer, nil
-	}
+var (
+	tokens = newTokenRegistry()
+)
 
-	var err error
+func init() {
+	prometheus.MustRegister(AzureExporterTokenExpiryTimestampSeconds)
+	prometheus.MustRegister(AzureExporterTokenRefreshFailuresTotal)
+}
+
+// tokenKey indexes tokens in the registry.
+type tokenKey struct {
+	profile  string
+	resource string
+}
 
-	authorizer, err = auth.NewAuthorizerFromEnvironment()
+// registeredToken is a TokenProvider held by the registry. It reports the
+// expiry of the token it wraps each time it is refreshed.
+type registeredToken struct {
+	TokenProvider
+	key        tokenKey
+	authorizer autorest.Authorizer
+}
 
+// RefreshWithContext refreshes the token and reports its new expiry.
+func (t *registeredToken) RefreshWithContext(ctx context.Context) error {
+	return t.observe(t.TokenProvider.RefreshWithContext(ctx))
+}
+
+// RefreshExchangeWithContext refreshes the token for resource and reports its
+// new expiry.
+func (t *registeredToken) RefreshExchangeWithContext(ctx context.Context, resource string) error {
+	return t.observe(t.TokenProvider.RefreshExchangeWithContext(ctx, resource))
+}
+
+// EnsureFreshWithContext refreshes the token if needed and reports its expiry.
+func (t *registeredToken) EnsureFreshWithContext(ctx context.Context) error {
+	return t.observe(t.TokenProvider.EnsureFreshWithContext(ctx))
+}
+
+// observe updates the token metrics according to the result of a refresh.
+func (t *registeredToken) observe(err error) error {
 	if err != nil {
-		return nil, err
+		AzureExporterTokenRefreshFailuresTotal.WithLabelValues(t.key.profile, t.key.resource).Inc()
+		return err
+	}
+
+	if token := t.Token(); len(token.AccessToken) > 0 {
+		AzureExporterTokenExpiryTimestampSeconds.WithLabelValues(t.key.profile, t.key.resource).Set(float64(token.Expires().Unix()))
 	}
 
-	return authorizer, err
+	return nil
 }
 
-// GetGraphAuthorizer get graph authorizer
-func GetGraphAuthorizer() (autorest.Authorizer, error) {
-	if graphAuthorizer != nil {
-		return graphAuthorizer, nil
+// tokenRegistry holds one token and its authorizer per profile and resource.
+// It is safe for concurrent use.
+type tokenRegistry struct {
+	mutex  sync.Mutex
+	tokens map[tokenKey]*registeredToken
+}
+
+// newTokenRegistry returns an empty registry.
+func newTokenRegistry() *tokenRegistry {
+	return &tokenRegistry{
+		tokens: make(map[tokenKey]*registeredToken),
 	}
+}
 
-	var err error
+// get returns the token registered for profile and resource, building it if
+// it does not exist yet.
+func (r *tokenRegistry) get(profileName string, resource string) (*registeredToken, error) {
+	if len(profileName) == 0 {
+		profileName = DefaultProfile
+	}
+
+	key := tokenKey{profile: profileName, resource: resource}
 
-	envName := os.Getenv("AZURE_ENVIRONMENT")
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 
-	if len(envName) == 0 {
-		envName = azure.PublicCloud.Name
+	if token, ok := r.tokens[key]; ok {
+		return token, nil
 	}
 
-	env, _ := azure.EnvironmentFromName(envName)
-	graphAuthorizer, err = auth.NewAuthorizerFromEnvironmentWithResource(env.GraphEndpoint)
+	profile, err := GetProfile(profileName)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return graphAuthorizer, err
+	provider, _, err := NewTokenProvider(profile, resource)
+
+	if err != nil {
+		return nil, err
+	}
+
+	token := &registeredToken{
+		TokenProvider: provider,
+		key:           key,
+	}
+	token.authorizer = autorest.NewBearerAuthorizer(token)
+	r.tokens[key] = token
+
+	return token, nil
 }
 
-// GetBatchAuthorizer get batch authorizer
-func GetBatchAuthorizer() (autorest.Authorizer, error) {
-	if batchAuthorizer != nil {
-		return batchAuthorizer, nil
+// list returns all registered tokens.
+func (r *tokenRegistry) list() []*registeredToken {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	list := make([]*registeredToken, 0, len(r.tokens))
+
+	for _, token := range r.tokens {
+		list = append(list, token)
 	}
 
-	var err error
+	return list
+}
 
-	batchAuthorizer, err = auth.NewAuthorizerFromEnvironment()
+// reset drops all registered tokens.
+func (r *tokenRegistry) reset() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 
-	if err != nil {
-		return nil, err
+	for key := range r.tokens {
+		AzureExporterTokenExpiryTimestampSeconds.DeleteLabelValues(key.profile, key.resource)
 	}
 
-	return batchAuthorizer, err
+	r.tokens = make(map[tokenKey]*registeredToken)
 }
 
-// GetBatchAuthorizerWithResource get batch authorizer with resource
-func GetBatchAuthorizerWithResource(resource string) (autorest.Authorizer, error) {
-	if batchAuthorizerWithResource != nil {
-		return batchAuthorizerWithResource, nil
+// refresh refreshes all the tokens which expire in less than `within`.
+func (r *tokenRegistry) refresh(ctx context.Context, within time.Duration) {
+	for _, token := range r.list() {
+		// Tokens which have never been used are refreshed on first use.
+		if len(token.Token().AccessToken) == 0 || !token.Token().WillExpireIn(within) {
+			continue
+		}
+
+		if err := token.RefreshWithContext(ctx); err != nil {
+			log.WithFields(log.Fields{
+				"_id":      "00000000",
+				"profile":  token.key.profile,
+				"resource": token.key.resource,
+			}).Errorf("Unable to refresh token: %s", err)
+		}
 	}
+}
 
-	var err error
+// resetAuthorizers drops all registered tokens and authorizers.
+func resetAuthorizers() {
+	tokens.reset()
+}
+
+// RefreshTokens refreshes every interval the registered tokens which are close
+// to expiry so that requests never have to wait for a refresh and that a
+// failing refresh can be alerted on before metrics stop being updated.
+// This method loops until the context is canceled so it needs to be detached.
+func RefreshTokens(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			tokens.refresh(ctx, tokenProactiveRefreshWithin)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
 
-	batchAuthorizerWithResource, err = auth.NewAuthorizerFromEnvironmentWithResource(resource)
+// getRegisteredAuthorizer returns the authorizer registered for profile and
+// resource. An empty resource means the resource manager.
+func getRegisteredAuthorizer(profile string, resource string) (autorest.Authorizer, error) {
+	if len(resource) == 0 {
+		env, err := getEnvironment()
+
+		if err != nil {
+			return nil, err
+		}
+
+		resource = env.ResourceManagerResource()
+	}
+
+	token, err := tokens.get(profile, resource)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return batchAuthorizerWithResource, err
+	return token.authorizer, nil
 }
 
-// GetStorageAuthorizer get storage authorizer
-func GetStorageAuthorizer() (autorest.Authorizer, error) {
-	if storageAuthorizer != nil {
-		return storageAuthorizer, nil
-	}
-
-	var err error
+// GetAuthorizer get authorizer
+func GetAuthorizer(profile string) (autorest.Authorizer, error) {
+	return getRegisteredAuthorizer(profile, "")
+}
 
-	storageAuthorizer, err = auth.NewAuthorizerFromEnvironment()
+// GetGraphAuthorizer get graph authorizer
+func GetGraphAuthorizer(profile string) (autorest.Authorizer, error) {
+	env, err := getEnvironment()
 
 	if err != nil {
 		return nil, err
 	}
 
-	return storageAuthorizer, err
+	return getRegisteredAuthorizer(profile, env.GraphEndpoint)
 }
 
-// GetStorageAuthorizerWithResource get storage authorizer with resource
-func GetStorageAuthorizerWithResource(resource string) (autorest.Authorizer, error) {
-	if storageAuthorizerWithResource != nil {
-		return storageAuthorizerWithResource, nil
-	}
+// GetBatchAuthorizer get batch authorizer
+func GetBatchAuthorizer(profile string) (autorest.Authorizer, error) {
+	return getRegisteredAuthorizer(profile, "")
+}
+
+// GetBatchAuthorizerWithResource get batch authorizer with resource
+func GetBatchAuthorizerWithResource(profile string, resource string) (autorest.Authorizer, error) {
+	return getRegisteredAuthorizer(profile, resource)
+}
 
-	var err error
+// GetStorageAuthorizer get storage authorizer
+func GetStorageAuthorizer(profile string) (autorest.Authorizer, error) {
+	return getRegisteredAuthorizer(profile, "")
+}
+
+// GetStorageAuthorizerWithResource get storage authorizer with resource
+func GetStorageAuthorizerWithResource(profile string, resource string) (autorest.Authorizer, error) {
+	return getRegisteredAuthorizer(profile, resource)
+}
 
-	storageAuthorizerWithResource, err = auth.NewAuthorizerFromEnvironmentWithResource(resource)
+// GetTokenWithResource returns a fresh token for resource acquired with the
+// credentials of the given profile.
+func GetTokenWithResource(ctx context.Context, profile string, resource string) (TokenProvider, error) {
+	token, err := tokens.get(profile, resource)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return storageAuthorizerWithResource, err
+	if err := token.EnsureFreshWithContext(ctx); err != nil {
+		return nil, err
+	}
+
+	return token, nil
 }
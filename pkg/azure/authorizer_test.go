@@ -0,0 +1,68 @@
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+)
+
+// fakeToken is a TokenProvider whose refreshes are counted.
+type fakeToken struct {
+	token     adal.Token
+	refreshes int
+	validity  time.Duration
+}
+
+func (t *fakeToken) OAuthToken() string { return t.token.AccessToken }
+func (t *fakeToken) Token() adal.Token  { return t.token }
+func (t *fakeToken) RefreshWithContext(ctx context.Context) error {
+	t.refreshes++
+	t.token = newFakeADALToken(t.validity)
+	return nil
+}
+func (t *fakeToken) RefreshExchangeWithContext(ctx context.Context, resource string) error {
+	return t.RefreshWithContext(ctx)
+}
+func (t *fakeToken) EnsureFreshWithContext(ctx context.Context) error {
+	if t.token.WillExpireIn(tokenRefreshWithin) {
+		return t.RefreshWithContext(ctx)
+	}
+	return nil
+}
+
+func newFakeADALToken(validity time.Duration) adal.Token {
+	return adal.Token{
+		AccessToken: "token",
+		ExpiresOn:   json.Number(strconv.FormatInt(time.Now().Add(validity).Unix(), 10)),
+	}
+}
+
+func TestTokenRegistryRefresh(t *testing.T) {
+	registry := newTokenRegistry()
+
+	expiring := &fakeToken{token: newFakeADALToken(10 * time.Minute), validity: time.Hour}
+	valid := &fakeToken{token: newFakeADALToken(time.Hour), validity: time.Hour}
+	unused := &fakeToken{validity: time.Hour}
+
+	registry.tokens[tokenKey{"default", "expiring"}] = &registeredToken{TokenProvider: expiring, key: tokenKey{"default", "expiring"}}
+	registry.tokens[tokenKey{"default", "valid"}] = &registeredToken{TokenProvider: valid, key: tokenKey{"default", "valid"}}
+	registry.tokens[tokenKey{"default", "unused"}] = &registeredToken{TokenProvider: unused, key: tokenKey{"default", "unused"}}
+
+	registry.refresh(context.Background(), tokenProactiveRefreshWithin)
+
+	if expiring.refreshes != 1 {
+		t.Fatalf("Expected expiring token to be refreshed once but got %d", expiring.refreshes)
+	}
+
+	if valid.refreshes != 0 {
+		t.Fatalf("Expected valid token not to be refreshed but got %d", valid.refreshes)
+	}
+
+	if unused.refreshes != 0 {
+		t.Fatalf("Expected unused token not to be refreshed but got %d", unused.refreshes)
+	}
+}
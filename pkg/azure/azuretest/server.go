@@ -0,0 +1,178 @@
+// Package azuretest provides a fake Azure backend serving canned responses
+// read from fixture files so that the exporter can be run without reaching
+// Azure.
+package azuretest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sylr/prometheus-azure-exporter/pkg/azure"
+)
+
+const (
+	// ServerPlaceholder is replaced by the URL of the server in fixtures,
+	// e.g. in the `nextLink` of paginated responses.
+	ServerPlaceholder = "{{server}}"
+)
+
+var (
+	// Extensions of fixture files and the content type they are served with.
+	fixtureExtensions = []struct {
+		extension   string
+		contentType string
+	}{
+		{".json", "application/json; charset=utf-8"},
+		{".xml", "application/xml"},
+	}
+)
+
+// Server is a fake Azure backend. It serves a token to any token request of
+// any tenant and answers other requests with the content of the file found in
+// its directory at the lower cased path of the request followed by `.json`
+// or `.xml`. Files named `<path>.<status code>.json` are served with the
+// given status code, e.g. to reproduce Azure errors. Query strings are
+// ignored. Requests with no matching file get a 404 Azure error.
+//
+// The resource manager, graph, Batch data plane and Blob service endpoints of
+// the server are respectively rooted at `/`, `/graph/`, `/batch/<account
+// endpoint>/` and `/blob/<storage account>/`.
+//
+// The server uses TLS because the Blob service client refuses to send tokens
+// over plain HTTP, so the transport of Client() needs to be used to reach it.
+type Server struct {
+	*httptest.Server
+	dir    string
+	mutex  sync.Mutex
+	misses []string
+}
+
+// NewServer starts a server serving the fixtures found in dir.
+func NewServer(dir string) *Server {
+	s := &Server{
+		dir: dir,
+	}
+
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.handle))
+
+	return s
+}
+
+// Endpoints returns the endpoints to configure with azure.SetEndpoints() to
+// send all the requests of the exporter to the server.
+func (s *Server) Endpoints() azure.Endpoints {
+	return azure.Endpoints{
+		ResourceManager: s.URL + "/",
+		ActiveDirectory: s.URL + "/aad/",
+		Graph:           s.URL + "/graph/",
+		Batch:           s.URL + "/batch/",
+		BatchAccount:    s.URL + "/batch/%s",
+		Blob:            s.URL + "/blob/%s",
+		Storage:         s.URL + "/storage/",
+	}
+}
+
+// Misses returns the method and path of the requests for which no fixture
+// was found.
+func (s *Server) Misses() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	misses := make([]string, len(s.misses))
+	copy(misses, s.misses)
+
+	return misses
+}
+
+// handle serves a request.
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	name := path.Clean(strings.ToLower(r.URL.Path))
+
+	if strings.HasSuffix(name, "/oauth2/token") {
+		s.serveToken(w, r)
+		return
+	}
+
+	for _, fixture := range fixtureExtensions {
+		file := filepath.Join(s.dir, filepath.FromSlash(name))
+		status := http.StatusOK
+		data, err := ioutil.ReadFile(file + fixture.extension)
+
+		if err != nil {
+			if status, data, err = s.readStatusFixture(file, fixture.extension); err != nil {
+				continue
+			}
+		}
+
+		data = []byte(strings.ReplaceAll(string(data), ServerPlaceholder, s.URL))
+
+		w.Header().Set("Content-Type", fixture.contentType)
+		w.WriteHeader(status)
+		w.Write(data)
+
+		return
+	}
+
+	s.mutex.Lock()
+	s.misses = append(s.misses, r.Method+" "+r.URL.Path)
+	s.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprintf(w, `{"error":{"code":"NotFound","message":"No fixture for %s"}}`, name)
+}
+
+// readStatusFixture returns the status code and the content of the fixture
+// `<file>.<status code><extension>`.
+func (s *Server) readStatusFixture(file string, extension string) (int, []byte, error) {
+	matches, err := filepath.Glob(file + ".*" + extension)
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	for _, match := range matches {
+		status, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(match, file+"."), extension))
+
+		if err != nil {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(match)
+
+		if err != nil {
+			return 0, nil, err
+		}
+
+		return status, data, nil
+	}
+
+	return 0, nil, fmt.Errorf("no status fixture for %s", file)
+}
+
+// serveToken answers token requests with a token valid for one hour.
+func (s *Server) serveToken(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	expiresOn := time.Now().Add(time.Hour).Unix()
+	token := map[string]string{
+		"access_token": "fake-access-token",
+		"token_type":   "Bearer",
+		"expires_in":   "3600",
+		"expires_on":   strconv.FormatInt(expiresOn, 10),
+		"not_before":   strconv.FormatInt(expiresOn-3600, 10),
+		"resource":     r.PostForm.Get("resource"),
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(token)
+}
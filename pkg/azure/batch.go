@@ -7,8 +7,6 @@ import (
 
 	"github.com/Azure/azure-sdk-for-go/services/batch/2019-08-01.10.0/batch"
 	azurebatch "github.com/Azure/azure-sdk-for-go/services/batch/mgmt/2019-08-01/batch"
-	"github.com/Azure/azure-sdk-for-go/services/preview/subscription/mgmt/2018-03-01-preview/subscription"
-	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	"sylr.dev/libqd/cache"
 )
@@ -19,61 +17,8 @@ const (
 	cacheKeySubscriptionBatchAccountJobs  = `sub-%s-batch-account-%s-jobs`
 )
 
-var (
-	// AzureAPIBatchCallsTotal Total number of Azure Batch API calls
-	AzureAPIBatchCallsTotal = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Namespace: "azure_api",
-			Subsystem: "batch",
-			Name:      "calls_total",
-			Help:      "Total number of calls to the Azure API",
-		},
-		[]string{"subscription", "resource_group", "account"},
-	)
-
-	// AzureAPIBatchCallsFailedTotal Total number of failed Azure Batch API calls
-	AzureAPIBatchCallsFailedTotal = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Namespace: "azure_api",
-			Subsystem: "batch",
-			Name:      "calls_failed_total",
-			Help:      "Total number of failed calls to the Azure API",
-		},
-		[]string{"subscription", "resource_group", "account"},
-	)
-
-	// AzureAPIBatchCallsDurationSecondsBuckets Histograms of Azure Batch API calls durations in seconds
-	AzureAPIBatchCallsDurationSecondsBuckets = prometheus.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Namespace: "azure_api",
-			Subsystem: "batch",
-			Name:      "calls_duration_seconds",
-			Help:      "Histograms of successful Azure Batch API calls durations in seconds",
-			Buckets:   []float64{0.02, 0.03, 0.04, 0.05, 0.10, 0.20, 0.30, 0.40, 0.50, 0.75, 1.0, 2.0},
-		},
-		[]string{"subscription", "resource_group", "account"},
-	)
-)
-
-func init() {
-	prometheus.MustRegister(AzureAPIBatchCallsTotal)
-	prometheus.MustRegister(AzureAPIBatchCallsFailedTotal)
-	prometheus.MustRegister(AzureAPIBatchCallsDurationSecondsBuckets)
-}
-
-// ObserveAzureBatchAPICall ...
-func ObserveAzureBatchAPICall(duration float64, labels ...string) {
-	AzureAPIBatchCallsTotal.WithLabelValues(labels...).Inc()
-	AzureAPIBatchCallsDurationSecondsBuckets.WithLabelValues(labels...).Observe(duration)
-}
-
-// ObserveAzureBatchAPICallFailed ...
-func ObserveAzureBatchAPICallFailed(duration float64, labels ...string) {
-	AzureAPIBatchCallsFailedTotal.WithLabelValues(labels...).Inc()
-}
-
 // ListSubscriptionBatchAccounts List all subscription batch accounts
-func ListSubscriptionBatchAccounts(ctx context.Context, clients *AzureClients, subscription *subscription.Model) (*[]azurebatch.Account, error) {
+func ListSubscriptionBatchAccounts(ctx context.Context, clients *AzureClients, subscription *Subscription) (*[]azurebatch.Account, error) {
 	c := cache.GetCache(5*time.Minute, time.Minute)
 	cacheKey := fmt.Sprintf(cacheKeySubscriptionBatchAccounts, *subscription.SubscriptionID)
 
@@ -90,34 +35,39 @@ func ListSubscriptionBatchAccounts(ctx context.Context, clients *AzureClients, s
 		}
 	}
 
-	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	ctx, cancel := context.WithTimeout(withOperation(ctx, "ListSubscriptionBatchAccounts"), 20*time.Second)
 	defer cancel()
 
-	client, err := clients.GetBatchAccountClient(*subscription.SubscriptionID)
+	client, err := clients.GetBatchAccountClient(subscription.Profile, *subscription.SubscriptionID)
 
 	if err != nil {
 		return nil, err
 	}
 
-	t0 := time.Now()
 	accounts, err := client.List(ctx)
-	t1 := time.Since(t0).Seconds()
 
 	if err != nil {
-		ObserveAzureAPICallFailed(t1)
 		return nil, err
 	}
 
-	ObserveAzureAPICall(t1)
+	vals := make([]azurebatch.Account, 0)
+	err = walkPages(ctx, &accounts, func(max int) int {
+		vals = append(vals, accounts.Values()...)
+		count := len(vals)
+		vals = vals[:capItems(count, max)]
+		return count
+	})
 
-	vals := accounts.Values()
+	if err != nil {
+		return nil, err
+	}
 	c.SetDefault(cacheKey, &vals)
 
 	return &vals, nil
 }
 
 // ListBatchAccountPools List all batch account's pools
-func ListBatchAccountPools(ctx context.Context, clients *AzureClients, subscription *subscription.Model, account *azurebatch.Account) ([]azurebatch.Pool, error) {
+func ListBatchAccountPools(ctx context.Context, clients *AzureClients, subscription *Subscription, account *azurebatch.Account) ([]azurebatch.Pool, error) {
 	c := cache.GetCache(5*time.Minute, time.Minute)
 
 	accountDetails, _ := ParseResourceID(*account.ID)
@@ -137,38 +87,39 @@ func ListBatchAccountPools(ctx context.Context, clients *AzureClients, subscript
 		}
 	}
 
-	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	ctx, cancel := context.WithTimeout(withOperation(ctx, "ListBatchAccountPools"), 20*time.Second)
 	defer cancel()
 
-	client, err := clients.GetBatchPoolClient(accountDetails.SubscriptionID)
+	client, err := clients.GetBatchPoolClient(subscription.Profile, accountDetails.SubscriptionID)
 
 	if err != nil {
 		return nil, err
 	}
 
-	t0 := time.Now()
 	pools, err := client.ListByBatchAccount(ctx, accountDetails.ResourceGroup, *account.Name, nil, "", "")
-	t1 := time.Since(t0).Seconds()
 
 	if err != nil {
-		if ctx.Err() != context.Canceled {
-			ObserveAzureAPICallFailed(t1)
-			ObserveAzureBatchAPICallFailed(t1, *subscription.DisplayName, accountDetails.ResourceGroup, *account.Name)
-		}
 		return nil, err
 	}
 
-	ObserveAzureAPICall(t1)
-	ObserveAzureBatchAPICall(t1, *subscription.DisplayName, accountDetails.ResourceGroup, *account.Name)
+	vals := make([]azurebatch.Pool, 0)
+	err = walkPages(ctx, &pools, func(max int) int {
+		vals = append(vals, pools.Values()...)
+		count := len(vals)
+		vals = vals[:capItems(count, max)]
+		return count
+	})
 
-	vals := pools.Values()
+	if err != nil {
+		return nil, err
+	}
 	c.SetDefault(cacheKey, vals)
 
 	return vals, nil
 }
 
 // ListBatchAccountJobs list batch account jobs
-func ListBatchAccountJobs(ctx context.Context, clients *AzureClients, subscription *subscription.Model, account *azurebatch.Account) ([]batch.CloudJob, error) {
+func ListBatchAccountJobs(ctx context.Context, clients *AzureClients, subscription *Subscription, account *azurebatch.Account) ([]batch.CloudJob, error) {
 	c := cache.GetCache(5*time.Minute, time.Minute)
 
 	accountDetails, _ := ParseResourceID(*account.ID)
@@ -188,43 +139,36 @@ func ListBatchAccountJobs(ctx context.Context, clients *AzureClients, subscripti
 		}
 	}
 
-	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	ctx, cancel := context.WithTimeout(withOperation(ctx, "ListBatchAccountJobs"), 20*time.Second)
 	defer cancel()
 
-	client, err := clients.GetBatchJobClientWithResource(*account.AccountEndpoint, "https://batch.core.windows.net/")
+	env, err := getEnvironment()
+
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := clients.GetBatchJobClientWithResource(subscription.Profile, *account.AccountEndpoint, env.BatchResource)
 	if err != nil {
 		return nil, err
 	}
 
-	t0 := time.Now()
 	cloudJobs, err := client.List(ctx, "", "", "", nil, nil, nil, nil, nil)
-	t1 := time.Since(t0).Seconds()
 
 	if err != nil {
-		if ctx.Err() != context.Canceled {
-			ObserveAzureAPICallFailed(t1)
-			ObserveAzureBatchAPICallFailed(t1, *subscription.DisplayName, accountDetails.ResourceGroup, *account.Name)
-		}
 		return nil, err
 	}
 
-	ObserveAzureAPICall(t1)
-	ObserveAzureBatchAPICall(t1, *subscription.DisplayName, accountDetails.ResourceGroup, *account.Name)
-
 	jobs := make([]batch.CloudJob, 0)
-
-	for {
+	err = walkPages(ctx, &cloudJobs, func(max int) int {
 		jobs = append(jobs, cloudJobs.Values()...)
+		count := len(jobs)
+		jobs = jobs[:capItems(count, max)]
+		return count
+	})
 
-		if cloudJobs.NotDone() {
-			err := cloudJobs.Next()
-
-			if err != nil {
-				return nil, err
-			}
-		} else {
-			break
-		}
+	if err != nil {
+		return nil, err
 	}
 
 	c.SetDefault(cacheKey, jobs)
@@ -233,77 +177,64 @@ func ListBatchAccountJobs(ctx context.Context, clients *AzureClients, subscripti
 }
 
 // GetBatchJobTaskCounts get job tasks metrics
-func GetBatchJobTaskCounts(ctx context.Context, clients *AzureClients, subscription *subscription.Model, account *azurebatch.Account, job *batch.CloudJob) (*batch.TaskCounts, error) {
-	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+func GetBatchJobTaskCounts(ctx context.Context, clients *AzureClients, subscription *Subscription, account *azurebatch.Account, job *batch.CloudJob) (*batch.TaskCounts, error) {
+	ctx, cancel := context.WithTimeout(withOperation(ctx, "GetBatchJobTaskCounts"), 20*time.Second)
 	defer cancel()
 
-	accountDetails, _ := ParseResourceID(*account.ID)
-	client, err := clients.GetBatchJobClientWithResource(*account.AccountEndpoint, "https://batch.core.windows.net/")
+	env, err := getEnvironment()
 
 	if err != nil {
 		return nil, err
 	}
 
-	t0 := time.Now()
-	taskCounts, err := client.GetTaskCounts(ctx, *job.ID, nil, nil, nil, nil)
-	t1 := time.Since(t0).Seconds()
+	client, err := clients.GetBatchJobClientWithResource(subscription.Profile, *account.AccountEndpoint, env.BatchResource)
 
 	if err != nil {
-		if ctx.Err() != context.Canceled {
-			ObserveAzureAPICallFailed(t1)
-			ObserveAzureBatchAPICallFailed(t1, *subscription.DisplayName, accountDetails.ResourceGroup, *account.Name)
-		}
 		return nil, err
 	}
 
-	ObserveAzureAPICall(t1)
-	ObserveAzureBatchAPICall(t1, *subscription.DisplayName, accountDetails.ResourceGroup, *account.Name)
+	taskCounts, err := client.GetTaskCounts(ctx, *job.ID, nil, nil, nil, nil)
+
+	if err != nil {
+		return nil, err
+	}
 
 	return &taskCounts, nil
 }
 
 // ListBatchComputeNodes get job tasks metrics
-func ListBatchComputeNodes(ctx context.Context, clients *AzureClients, subscription *subscription.Model, account *azurebatch.Account, pool *azurebatch.Pool) (*[]batch.ComputeNode, error) {
-	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+func ListBatchComputeNodes(ctx context.Context, clients *AzureClients, subscription *Subscription, account *azurebatch.Account, pool *azurebatch.Pool) (*[]batch.ComputeNode, error) {
+	ctx, cancel := context.WithTimeout(withOperation(ctx, "ListBatchComputeNodes"), 20*time.Second)
 	defer cancel()
 
-	accountDetails, _ := ParseResourceID(*account.ID)
-	client, err := clients.GetBatchComputeNodeClientWithResource(*account.AccountEndpoint, "https://batch.core.windows.net/")
-	//client, err := clients.GetBatchComputeNodeClient(*account.AccountEndpoint)
+	env, err := getEnvironment()
 
 	if err != nil {
 		return nil, err
 	}
 
-	t0 := time.Now()
-	computeNodes, err := client.List(ctx, *pool.Name, "", "", nil, nil, nil, nil, nil)
-	t1 := time.Since(t0).Seconds()
+	client, err := clients.GetBatchComputeNodeClientWithResource(subscription.Profile, *account.AccountEndpoint, env.BatchResource)
 
 	if err != nil {
-		if ctx.Err() != context.Canceled {
-			ObserveAzureAPICallFailed(t1)
-			ObserveAzureBatchAPICallFailed(t1, *subscription.DisplayName, accountDetails.ResourceGroup, *account.Name)
-		}
 		return nil, err
 	}
 
-	ObserveAzureAPICall(t1)
-	ObserveAzureBatchAPICall(t1, *subscription.DisplayName, accountDetails.ResourceGroup, *account.Name)
+	computeNodes, err := client.List(ctx, *pool.Name, "", "", nil, nil, nil, nil, nil)
 
-	nodes := make([]batch.ComputeNode, 0)
+	if err != nil {
+		return nil, err
+	}
 
-	for {
+	nodes := make([]batch.ComputeNode, 0)
+	err = walkPages(ctx, &computeNodes, func(max int) int {
 		nodes = append(nodes, computeNodes.Values()...)
+		count := len(nodes)
+		nodes = nodes[:capItems(count, max)]
+		return count
+	})
 
-		if computeNodes.NotDone() {
-			err := computeNodes.Next()
-
-			if err != nil {
-				return nil, err
-			}
-		} else {
-			break
-		}
+	if err != nil {
+		return nil, err
 	}
 
 	return &nodes, nil
@@ -0,0 +1,320 @@
+package azure
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Value replacing secrets in recordings.
+	redacted = "REDACTED"
+)
+
+var (
+	// Headers carrying credentials which are never written to disk.
+	redactedHeaders = []string{
+		"Authorization",
+		"Proxy-Authorization",
+		"Cookie",
+		"Set-Cookie",
+		"X-Ms-Authorization-Auxiliary",
+	}
+
+	// Fields of token responses which are never written to disk.
+	redactedTokenFields = []string{
+		"access_token",
+		"refresh_token",
+		"id_token",
+	}
+
+	// Characters replaced in the readable part of the recording file names.
+	cassetteNameSanitationRegexp = regexp.MustCompile(`[^a-zA-Z0-9.-]+`)
+
+	// Current record and replay directories.
+	cassetteMutex     = sync.Mutex{}
+	cassetteRecordDir = ""
+	cassetteReplayDir = ""
+)
+
+// cassette is a request and its response as written to disk.
+type cassette struct {
+	Request  cassetteRequest  `json:"request"`
+	Response cassetteResponse `json:"response"`
+}
+
+// cassetteRequest is a recorded request.
+type cassetteRequest struct {
+	Method string      `json:"method"`
+	URL    string      `json:"url"`
+	Header http.Header `json:"header"`
+	Body   string      `json:"body,omitempty"`
+}
+
+// cassetteResponse is a recorded response.
+type cassetteResponse struct {
+	StatusCode int         `json:"status_code"`
+	Header     http.Header `json:"header"`
+	Body       string      `json:"body,omitempty"`
+}
+
+// SetRecordReplay makes the shared HTTP client write every request and its
+// response in recordDir, or answer requests with the recordings found in
+// replayDir without reaching Azure. Requests are sent to Azure without being
+// recorded when both are empty.
+func SetRecordReplay(recordDir string, replayDir string) error {
+	if len(recordDir) > 0 && len(replayDir) > 0 {
+		return errors.New("requests can not be recorded and replayed at the same time")
+	}
+
+	cassetteMutex.Lock()
+	defer cassetteMutex.Unlock()
+
+	if recordDir == cassetteRecordDir && replayDir == cassetteReplayDir {
+		return nil
+	}
+
+	logger := log.WithFields(log.Fields{
+		"_id": "00000000",
+	})
+
+	switch {
+	case len(recordDir) > 0:
+		if err := os.MkdirAll(recordDir, 0700); err != nil {
+			return err
+		}
+
+		logger.Warnf("Recording Azure requests and responses in %s", recordDir)
+		SetTransport(&recordingTransport{dir: recordDir, next: defaultTransport})
+	case len(replayDir) > 0:
+		logger.Warnf("Replaying Azure responses recorded in %s", replayDir)
+		SetTransport(&replayingTransport{dir: replayDir})
+	default:
+		SetTransport(defaultTransport)
+	}
+
+	cassetteRecordDir = recordDir
+	cassetteReplayDir = replayDir
+
+	return nil
+}
+
+// cassetteFileName returns the name of the file holding the recording of
+// the request. Requests with the same method and URL share the same file.
+func cassetteFileName(req *http.Request) string {
+	key := req.Method + " " + req.URL.String()
+	sum := sha256.Sum256([]byte(key))
+	name := cassetteNameSanitationRegexp.ReplaceAllString(req.URL.Host+req.URL.Path, "_")
+
+	if len(name) > 100 {
+		name = name[len(name)-100:]
+	}
+
+	return fmt.Sprintf("%s-%s-%x.json", strings.ToLower(req.Method), strings.Trim(name, "_"), sum[:8])
+}
+
+// isTokenRequest tells if the request is sent to an OAuth token endpoint.
+func isTokenRequest(req *http.Request) bool {
+	return strings.HasSuffix(req.URL.Path, "/oauth2/token") ||
+		strings.HasSuffix(req.URL.Path, "/oauth2/v2.0/token") ||
+		strings.HasSuffix(req.URL.Path, "/metadata/identity/oauth2/token")
+}
+
+// redactHeader returns a copy of header without credentials.
+func redactHeader(header http.Header) http.Header {
+	header = header.Clone()
+
+	for _, name := range redactedHeaders {
+		if len(header.Values(name)) > 0 {
+			header.Set(name, redacted)
+		}
+	}
+
+	return header
+}
+
+// redactTokenResponse returns body without the tokens it holds.
+func redactTokenResponse(body []byte) string {
+	fields := make(map[string]interface{})
+
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return redacted
+	}
+
+	for _, field := range redactedTokenFields {
+		if _, ok := fields[field]; ok {
+			fields[field] = redacted
+		}
+	}
+
+	data, err := json.Marshal(fields)
+
+	if err != nil {
+		return redacted
+	}
+
+	return string(data)
+}
+
+// ----------------------------------------------------------------------------
+
+// recordingTransport writes requests and responses to disk.
+type recordingTransport struct {
+	dir  string
+	next http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var requestBody []byte
+
+	if req.Body != nil && req.GetBody != nil {
+		body, err := req.GetBody()
+
+		if err != nil {
+			return nil, err
+		}
+
+		requestBody, err = ioutil.ReadAll(body)
+		body.Close()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := t.next.RoundTrip(req)
+
+	if err != nil {
+		return nil, err
+	}
+
+	responseBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body = ioutil.NopCloser(bytes.NewReader(responseBody))
+
+	record := cassette{
+		Request: cassetteRequest{
+			Method: req.Method,
+			URL:    req.URL.String(),
+			Header: redactHeader(req.Header),
+			Body:   string(requestBody),
+		},
+		Response: cassetteResponse{
+			StatusCode: resp.StatusCode,
+			Header:     redactHeader(resp.Header),
+			Body:       string(responseBody),
+		},
+	}
+
+	// Token requests carry client secrets and their responses the tokens.
+	if isTokenRequest(req) {
+		if len(record.Request.Body) > 0 {
+			record.Request.Body = redacted
+		}
+
+		record.Response.Body = redactTokenResponse(responseBody)
+	}
+
+	if err := t.write(cassetteFileName(req), &record); err != nil {
+		log.WithFields(log.Fields{
+			"_id": "00000000",
+			"url": req.URL.String(),
+		}).Errorf("Unable to record request: %s", err)
+	}
+
+	return resp, nil
+}
+
+// write atomically writes the recording in the file `name`.
+func (t *recordingTransport) write(name string, record *cassette) error {
+	data, err := json.MarshalIndent(record, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(t.dir, ".cassette-")
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+
+	return os.Rename(file.Name(), filepath.Join(t.dir, name))
+}
+
+// ----------------------------------------------------------------------------
+
+// replayingTransport answers requests with the responses recorded by a
+// recordingTransport. It never sends anything on the network.
+type replayingTransport struct {
+	dir string
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *replayingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(t.dir, cassetteFileName(req)))
+
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no recording of %s %s", req.Method, req.URL.String())
+	} else if err != nil {
+		return nil, err
+	}
+
+	record := cassette{}
+
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("reading recording of %s %s: %v", req.Method, req.URL.String(), err)
+	}
+
+	header := record.Response.Header
+	if header == nil {
+		header = make(http.Header)
+	}
+
+	header.Set("Content-Length", strconv.Itoa(len(record.Response.Body)))
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", record.Response.StatusCode, http.StatusText(record.Response.StatusCode)),
+		StatusCode:    record.Response.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(record.Response.Body)),
+		ContentLength: int64(len(record.Response.Body)),
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,93 @@
+package azure
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecordReplay(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/oauth2/token") {
+			w.Write([]byte(`{"access_token":"secret-token","token_type":"Bearer"}`))
+			return
+		}
+
+		w.Header().Set("Set-Cookie", "session=secret-cookie")
+		w.Write([]byte(`{"value":[]}`))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	recorder := &recordingTransport{dir: dir, next: http.DefaultTransport}
+
+	// Record
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/subscriptions?api-version=1", nil)
+	req.Header.Set("Authorization", "Bearer secret-token")
+	resp, err := recorder.RoundTrip(req)
+
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != `{"value":[]}` {
+		t.Fatalf("Expected %v but got %v", `{"value":[]}`, string(body))
+	}
+
+	form := url.Values{"client_secret": {"secret-password"}}
+	req, _ = http.NewRequest(http.MethodPost, server.URL+"/tenant/oauth2/token", strings.NewReader(form.Encode()))
+	resp, err = recorder.RoundTrip(req)
+
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+
+	resp.Body.Close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+
+	if len(files) != 2 {
+		t.Fatalf("Expected %v but got %v", 2, len(files))
+	}
+
+	for _, file := range files {
+		data, _ := ioutil.ReadFile(file)
+
+		for _, secret := range []string{"secret-token", "secret-cookie", "secret-password"} {
+			if strings.Contains(string(data), secret) {
+				t.Fatalf("Expected %s to be redacted in %s", secret, string(data))
+			}
+		}
+	}
+
+	// Replay
+	server.Close()
+	replayer := &replayingTransport{dir: dir}
+
+	req, _ = http.NewRequest(http.MethodGet, server.URL+"/subscriptions?api-version=1", nil)
+	resp, err = replayer.RoundTrip(req)
+
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+
+	body, _ = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(body) != `{"value":[]}` {
+		t.Fatalf("Expected %v but got %v %v", `200 {"value":[]}`, resp.StatusCode, string(body))
+	}
+
+	req, _ = http.NewRequest(http.MethodGet, server.URL+"/subscriptions?api-version=2", nil)
+
+	if _, err := replayer.RoundTrip(req); err == nil {
+		t.Fatalf("Expected an error for a request which has not been recorded")
+	}
+}
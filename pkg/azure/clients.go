@@ -2,7 +2,6 @@ package azure
 
 import (
 	"net/http"
-	"os"
 	"sync"
 	"time"
 
@@ -11,11 +10,19 @@ import (
 	graph "github.com/Azure/azure-sdk-for-go/services/graphrbac/1.6/graphrbac"
 	"github.com/Azure/azure-sdk-for-go/services/preview/subscription/mgmt/2018-03-01-preview/subscription"
 	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2018-05-01/resources"
+	resourcetags "github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2020-06-01/resources"
 	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2019-06-01/storage"
 	"github.com/Azure/go-autorest/autorest"
 	log "github.com/sirupsen/logrus"
 )
 
+var (
+	// Mutex used to lock read/writes of sharedClients.
+	sharedClientsMutex = sync.Mutex{}
+	// This var holds the process wide clients, see GetAzureClients().
+	sharedClients *AzureClients
+)
+
 // AzureClients Collection of Azure clients
 type AzureClients struct {
 	mutex                       sync.RWMutex
@@ -30,6 +37,7 @@ type AzureClients struct {
 	storageAccountUsagesClients map[string]*storage.UsagesClient
 	blobContainersClients       map[string]*storage.BlobContainersClient
 	groupClients                map[string]*resources.GroupsClient
+	tagsClients                 map[string]*resourcetags.TagsClient
 }
 
 // NewAzureClients makes new AzureClients object
@@ -47,271 +55,535 @@ func NewAzureClients() *AzureClients {
 		storageAccountUsagesClients: make(map[string]*storage.UsagesClient),
 		blobContainersClients:       make(map[string]*storage.BlobContainersClient),
 		groupClients:                make(map[string]*resources.GroupsClient),
+		tagsClients:                 make(map[string]*resourcetags.TagsClient),
 	}
 
 	return azc
 }
 
+// GetAzureClients returns the process wide AzureClients. Clients are built on
+// first use and kept until credential profiles or endpoints change.
+func GetAzureClients() *AzureClients {
+	sharedClientsMutex.Lock()
+	defer sharedClientsMutex.Unlock()
+
+	if sharedClients == nil {
+		sharedClients = NewAzureClients()
+	}
+
+	return sharedClients
+}
+
+// resetClients drops the process wide AzureClients. Callers holding the
+// previous AzureClients keep using it until they are done.
+func resetClients() {
+	sharedClientsMutex.Lock()
+	sharedClients = nil
+	sharedClientsMutex.Unlock()
+
+	azureClientsGauge.Reset()
+}
+
 // GetSubscriptionClient return subscription client
-func (azc *AzureClients) GetSubscriptionClient(subscriptionID string) (*subscription.SubscriptionsClient, error) {
-	if _, ok := azc.subscriptionsClients[subscriptionID]; ok {
-		return azc.subscriptionsClients[subscriptionID], nil
+func (azc *AzureClients) GetSubscriptionClient(profile string, subscriptionID string) (*subscription.SubscriptionsClient, error) {
+	key := clientKey(profile, subscriptionID)
+
+	azc.mutex.RLock()
+	cached, ok := azc.subscriptionsClients[key]
+	azc.mutex.RUnlock()
+
+	if ok {
+		return cached, nil
 	}
 
 	azc.mutex.Lock()
 	defer azc.mutex.Unlock()
 
-	auth, err := GetBatchAuthorizer()
+	// Another goroutine may have built the client while we were waiting for the lock.
+	if cached, ok := azc.subscriptionsClients[key]; ok {
+		return cached, nil
+	}
+
+	auth, err := GetBatchAuthorizer(profile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := getEnvironment()
 
 	if err != nil {
 		return nil, err
 	}
 
-	client := subscription.NewSubscriptionsClient()
+	client := subscription.NewSubscriptionsClientWithBaseURI(env.ResourceManagerEndpoint)
 	client.RetryAttempts = 3
 	client.RetryDuration = 3 * time.Second
-	azc.subscriptionsClients[subscriptionID] = &client
-	azc.subscriptionsClients[subscriptionID].Authorizer = auth
-	azc.subscriptionsClients[subscriptionID].ResponseInspector = respondInspect(subscriptionID)
+	client.Authorizer = auth
+	client.Sender = newResourceManagerSender(serviceSubscriptions, profile, subscriptionID)
+	client.ResponseInspector = respondInspect(profile, subscriptionID)
+	azc.subscriptionsClients[key] = &client
+	observeClientCreated("subscription")
 
-	return azc.subscriptionsClients[subscriptionID], nil
+	return &client, nil
 }
 
 // GetGroupClient return group client
-func (azc *AzureClients) GetGroupClient(subscriptionID string) (*resources.GroupsClient, error) {
-	if _, ok := azc.groupClients[subscriptionID]; ok {
-		return azc.groupClients[subscriptionID], nil
+func (azc *AzureClients) GetGroupClient(profile string, subscriptionID string) (*resources.GroupsClient, error) {
+	key := clientKey(profile, subscriptionID)
+
+	azc.mutex.RLock()
+	cached, ok := azc.groupClients[key]
+	azc.mutex.RUnlock()
+
+	if ok {
+		return cached, nil
 	}
 
 	azc.mutex.Lock()
 	defer azc.mutex.Unlock()
 
-	auth, err := GetAuthorizer()
+	// Another goroutine may have built the client while we were waiting for the lock.
+	if cached, ok := azc.groupClients[key]; ok {
+		return cached, nil
+	}
+
+	auth, err := GetAuthorizer(profile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := getEnvironment()
 
 	if err != nil {
 		return nil, err
 	}
 
-	client := resources.NewGroupsClient(subscriptionID)
+	client := resources.NewGroupsClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
 	client.RetryAttempts = 3
 	client.RetryDuration = 3 * time.Second
-	azc.groupClients[subscriptionID] = &client
-	azc.groupClients[subscriptionID].Authorizer = auth
-	azc.groupClients[subscriptionID].ResponseInspector = respondInspect(subscriptionID)
+	client.Authorizer = auth
+	client.Sender = newResourceManagerSender(serviceResources, profile, subscriptionID)
+	client.ResponseInspector = respondInspect(profile, subscriptionID)
+	azc.groupClients[key] = &client
+	observeClientCreated("group")
 
-	return azc.groupClients[subscriptionID], nil
+	return &client, nil
+}
+
+// GetTagsClient return tags client
+func (azc *AzureClients) GetTagsClient(profile string, subscriptionID string) (*resourcetags.TagsClient, error) {
+	key := clientKey(profile, subscriptionID)
+
+	azc.mutex.RLock()
+	cached, ok := azc.tagsClients[key]
+	azc.mutex.RUnlock()
+
+	if ok {
+		return cached, nil
+	}
+
+	azc.mutex.Lock()
+	defer azc.mutex.Unlock()
+
+	// Another goroutine may have built the client while we were waiting for the lock.
+	if cached, ok := azc.tagsClients[key]; ok {
+		return cached, nil
+	}
+
+	auth, err := GetAuthorizer(profile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := getEnvironment()
+
+	if err != nil {
+		return nil, err
+	}
+
+	client := resourcetags.NewTagsClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
+	client.RetryAttempts = 3
+	client.RetryDuration = 3 * time.Second
+	client.Authorizer = auth
+	client.Sender = newResourceManagerSender(serviceResources, profile, subscriptionID)
+	client.ResponseInspector = respondInspect(profile, subscriptionID)
+	azc.tagsClients[key] = &client
+	observeClientCreated("tags")
+
+	return &client, nil
 }
 
 // GetBatchAccountClient return batch account client for specific subscription
-func (azc *AzureClients) GetBatchAccountClient(subscriptionID string) (*azurebatch.AccountClient, error) {
-	if _, ok := azc.batchAccountClients[subscriptionID]; ok {
-		return azc.batchAccountClients[subscriptionID], nil
+func (azc *AzureClients) GetBatchAccountClient(profile string, subscriptionID string) (*azurebatch.AccountClient, error) {
+	key := clientKey(profile, subscriptionID)
+
+	azc.mutex.RLock()
+	cached, ok := azc.batchAccountClients[key]
+	azc.mutex.RUnlock()
+
+	if ok {
+		return cached, nil
 	}
 
 	azc.mutex.Lock()
 	defer azc.mutex.Unlock()
 
-	auth, err := GetBatchAuthorizer()
+	// Another goroutine may have built the client while we were waiting for the lock.
+	if cached, ok := azc.batchAccountClients[key]; ok {
+		return cached, nil
+	}
+
+	auth, err := GetBatchAuthorizer(profile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := getEnvironment()
 
 	if err != nil {
 		return nil, err
 	}
 
-	client := azurebatch.NewAccountClient(subscriptionID)
+	client := azurebatch.NewAccountClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
 	client.RetryAttempts = 3
 	client.RetryDuration = 3 * time.Second
-	azc.batchAccountClients[subscriptionID] = &client
-	azc.batchAccountClients[subscriptionID].Authorizer = auth
-	azc.batchAccountClients[subscriptionID].ResponseInspector = respondInspect(subscriptionID)
+	client.Authorizer = auth
+	client.Sender = newResourceManagerSender(serviceBatchManagement, profile, subscriptionID)
+	client.ResponseInspector = respondInspect(profile, subscriptionID)
+	azc.batchAccountClients[key] = &client
+	observeClientCreated("batch_account")
 
-	return azc.batchAccountClients[subscriptionID], nil
+	return &client, nil
 }
 
 // GetBatchPoolClient get batch pool client
-func (azc *AzureClients) GetBatchPoolClient(subscriptionID string) (*azurebatch.PoolClient, error) {
-	if _, ok := azc.batchPoolClients[subscriptionID]; ok {
-		return azc.batchPoolClients[subscriptionID], nil
+func (azc *AzureClients) GetBatchPoolClient(profile string, subscriptionID string) (*azurebatch.PoolClient, error) {
+	key := clientKey(profile, subscriptionID)
+
+	azc.mutex.RLock()
+	cached, ok := azc.batchPoolClients[key]
+	azc.mutex.RUnlock()
+
+	if ok {
+		return cached, nil
 	}
 
 	azc.mutex.Lock()
 	defer azc.mutex.Unlock()
 
-	auth, err := GetBatchAuthorizer()
+	// Another goroutine may have built the client while we were waiting for the lock.
+	if cached, ok := azc.batchPoolClients[key]; ok {
+		return cached, nil
+	}
+
+	auth, err := GetBatchAuthorizer(profile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := getEnvironment()
 
 	if err != nil {
 		return nil, err
 	}
 
-	client := azurebatch.NewPoolClient(subscriptionID)
+	client := azurebatch.NewPoolClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
 	client.RetryAttempts = 3
 	client.RetryDuration = 3 * time.Second
-	azc.batchPoolClients[subscriptionID] = &client
-	azc.batchPoolClients[subscriptionID].Authorizer = auth
-	azc.batchPoolClients[subscriptionID].ResponseInspector = respondInspect(subscriptionID)
+	client.Authorizer = auth
+	client.Sender = newResourceManagerSender(serviceBatchManagement, profile, subscriptionID)
+	client.ResponseInspector = respondInspect(profile, subscriptionID)
+	azc.batchPoolClients[key] = &client
+	observeClientCreated("batch_pool")
 
-	return azc.batchPoolClients[subscriptionID], nil
+	return &client, nil
 }
 
 // GetBatchJobClient get batch job client
-func (azc *AzureClients) GetBatchJobClient(accountEndpoint string) (*batch.JobClient, error) {
-	if _, ok := azc.batchJobClients[accountEndpoint]; ok {
-		return azc.batchJobClients[accountEndpoint], nil
+func (azc *AzureClients) GetBatchJobClient(profile string, accountEndpoint string) (*batch.JobClient, error) {
+	key := clientKey(profile, accountEndpoint)
+
+	azc.mutex.RLock()
+	cached, ok := azc.batchJobClients[key]
+	azc.mutex.RUnlock()
+
+	if ok {
+		return cached, nil
 	}
 
 	azc.mutex.Lock()
 	defer azc.mutex.Unlock()
 
-	auth, err := GetBatchAuthorizer()
+	// Another goroutine may have built the client while we were waiting for the lock.
+	if cached, ok := azc.batchJobClients[key]; ok {
+		return cached, nil
+	}
+
+	auth, err := GetBatchAuthorizer(profile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := getEnvironment()
 
 	if err != nil {
 		return nil, err
 	}
 
-	client := batch.NewJobClient("https://" + accountEndpoint)
+	client := batch.NewJobClient(env.GetBatchAccountURL(accountEndpoint))
 	client.RetryAttempts = 3
 	client.RetryDuration = 3 * time.Second
-	azc.batchJobClients[accountEndpoint] = &client
-	azc.batchJobClients[accountEndpoint].Authorizer = auth
-	// azc.batchJobClients[accountEndpoint].ResponseInspector = respondInspectDebug()
+	client.Authorizer = auth
+	client.Sender = newSender(serviceBatch)
+	azc.batchJobClients[key] = &client
+	observeClientCreated("batch_job")
 
-	return azc.batchJobClients[accountEndpoint], nil
+	return &client, nil
 }
 
 // GetBatchJobClientWithResource get job client with resource
-func (azc *AzureClients) GetBatchJobClientWithResource(accountEndpoint string, resource string) (*batch.JobClient, error) {
-	if _, ok := azc.batchJobClients[accountEndpoint+resource]; ok {
-		return azc.batchJobClients[accountEndpoint+resource], nil
+func (azc *AzureClients) GetBatchJobClientWithResource(profile string, accountEndpoint string, resource string) (*batch.JobClient, error) {
+	key := clientKey(profile, accountEndpoint+resource)
+
+	azc.mutex.RLock()
+	cached, ok := azc.batchJobClients[key]
+	azc.mutex.RUnlock()
+
+	if ok {
+		return cached, nil
 	}
 
 	azc.mutex.Lock()
 	defer azc.mutex.Unlock()
 
-	auth, err := GetBatchAuthorizerWithResource(resource)
+	// Another goroutine may have built the client while we were waiting for the lock.
+	if cached, ok := azc.batchJobClients[key]; ok {
+		return cached, nil
+	}
+
+	auth, err := GetBatchAuthorizerWithResource(profile, resource)
+
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := getEnvironment()
 
 	if err != nil {
 		return nil, err
 	}
 
-	client := batch.NewJobClient("https://" + accountEndpoint)
+	client := batch.NewJobClient(env.GetBatchAccountURL(accountEndpoint))
 	client.RetryAttempts = 3
 	client.RetryDuration = 3 * time.Second
-	azc.batchJobClients[accountEndpoint+resource] = &client
-	azc.batchJobClients[accountEndpoint+resource].Authorizer = auth
-	// azc.batchJobClients[accountEndpoint+resource].ResponseInspector = respondInspectDebug()
+	client.Authorizer = auth
+	client.Sender = newSender(serviceBatch)
+	azc.batchJobClients[key] = &client
+	observeClientCreated("batch_job")
 
-	return azc.batchJobClients[accountEndpoint+resource], nil
+	return &client, nil
 }
 
 // GetBatchComputeNodeClient get compute node client
-func (azc *AzureClients) GetBatchComputeNodeClient(accountEndpoint string) (*batch.ComputeNodeClient, error) {
-	if _, ok := azc.batchComputeNodeClient[accountEndpoint]; ok {
-		return azc.batchComputeNodeClient[accountEndpoint], nil
+func (azc *AzureClients) GetBatchComputeNodeClient(profile string, accountEndpoint string) (*batch.ComputeNodeClient, error) {
+	key := clientKey(profile, accountEndpoint)
+
+	azc.mutex.RLock()
+	cached, ok := azc.batchComputeNodeClient[key]
+	azc.mutex.RUnlock()
+
+	if ok {
+		return cached, nil
 	}
 
 	azc.mutex.Lock()
 	defer azc.mutex.Unlock()
 
-	auth, err := GetBatchAuthorizer()
+	// Another goroutine may have built the client while we were waiting for the lock.
+	if cached, ok := azc.batchComputeNodeClient[key]; ok {
+		return cached, nil
+	}
+
+	auth, err := GetBatchAuthorizer(profile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := getEnvironment()
 
 	if err != nil {
 		return nil, err
 	}
 
-	client := batch.NewComputeNodeClient("https://" + accountEndpoint)
+	client := batch.NewComputeNodeClient(env.GetBatchAccountURL(accountEndpoint))
 	client.RetryAttempts = 3
 	client.RetryDuration = 3 * time.Second
-	azc.batchComputeNodeClient[accountEndpoint] = &client
-	azc.batchComputeNodeClient[accountEndpoint].Authorizer = auth
-	// azc.batchJobClients[accountEndpoint].ResponseInspector = respondInspectDebug()
+	client.Authorizer = auth
+	client.Sender = newSender(serviceBatch)
+	azc.batchComputeNodeClient[key] = &client
+	observeClientCreated("batch_compute_node")
 
-	return azc.batchComputeNodeClient[accountEndpoint], nil
+	return &client, nil
 }
 
 // GetBatchComputeNodeClientWithResource get compute node client with resource
-func (azc *AzureClients) GetBatchComputeNodeClientWithResource(accountEndpoint string, resource string) (*batch.ComputeNodeClient, error) {
-	if _, ok := azc.batchComputeNodeClient[accountEndpoint+resource]; ok {
-		return azc.batchComputeNodeClient[accountEndpoint+resource], nil
+func (azc *AzureClients) GetBatchComputeNodeClientWithResource(profile string, accountEndpoint string, resource string) (*batch.ComputeNodeClient, error) {
+	key := clientKey(profile, accountEndpoint+resource)
+
+	azc.mutex.RLock()
+	cached, ok := azc.batchComputeNodeClient[key]
+	azc.mutex.RUnlock()
+
+	if ok {
+		return cached, nil
 	}
 
 	azc.mutex.Lock()
 	defer azc.mutex.Unlock()
 
-	auth, err := GetBatchAuthorizerWithResource(resource)
+	// Another goroutine may have built the client while we were waiting for the lock.
+	if cached, ok := azc.batchComputeNodeClient[key]; ok {
+		return cached, nil
+	}
+
+	auth, err := GetBatchAuthorizerWithResource(profile, resource)
 
 	if err != nil {
 		return nil, err
 	}
 
-	client := batch.NewComputeNodeClient("https://" + accountEndpoint)
+	env, err := getEnvironment()
+
+	if err != nil {
+		return nil, err
+	}
+
+	client := batch.NewComputeNodeClient(env.GetBatchAccountURL(accountEndpoint))
 	client.RetryAttempts = 3
 	client.RetryDuration = 3 * time.Second
-	azc.batchComputeNodeClient[accountEndpoint+resource] = &client
-	azc.batchComputeNodeClient[accountEndpoint+resource].Authorizer = auth
-	// azc.batchJobClients[accountEndpoint+resource].ResponseInspector = respondInspectDebug()
+	client.Authorizer = auth
+	client.Sender = newSender(serviceBatch)
+	azc.batchComputeNodeClient[key] = &client
+	observeClientCreated("batch_compute_node")
 
-	return azc.batchComputeNodeClient[accountEndpoint+resource], nil
+	return &client, nil
 }
 
 // GetApplicationsClient get applications client
-func (azc *AzureClients) GetApplicationsClient(tenantID string) (*graph.ApplicationsClient, error) {
-	if _, ok := azc.applicationsClients[tenantID]; ok {
-		return azc.applicationsClients[tenantID], nil
+func (azc *AzureClients) GetApplicationsClient(profile string, tenantID string) (*graph.ApplicationsClient, error) {
+	key := clientKey(profile, tenantID)
+
+	azc.mutex.RLock()
+	cached, ok := azc.applicationsClients[key]
+	azc.mutex.RUnlock()
+
+	if ok {
+		return cached, nil
 	}
 
 	azc.mutex.Lock()
 	defer azc.mutex.Unlock()
 
-	auth, err := GetGraphAuthorizer()
+	// Another goroutine may have built the client while we were waiting for the lock.
+	if cached, ok := azc.applicationsClients[key]; ok {
+		return cached, nil
+	}
+
+	auth, err := GetGraphAuthorizer(profile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := getEnvironment()
 
 	if err != nil {
 		return nil, err
 	}
 
-	client := graph.NewApplicationsClient(tenantID)
+	client := graph.NewApplicationsClientWithBaseURI(env.GraphEndpoint, tenantID)
 	client.RetryAttempts = 3
 	client.RetryDuration = 3 * time.Second
-	azc.applicationsClients[tenantID] = &client
-	azc.applicationsClients[tenantID].Authorizer = auth
-	// azc.applicationsClients[tenantID].ResponseInspector = respondInspectDebug()
+	client.Authorizer = auth
+	client.Sender = newSender(serviceGraph)
+	azc.applicationsClients[key] = &client
+	observeClientCreated("applications")
 
-	return azc.applicationsClients[tenantID], nil
+	return &client, nil
 }
 
 // GetStorageAccountsClient get storage account client
-func (azc *AzureClients) GetStorageAccountsClient(subscriptionID string) (*storage.AccountsClient, error) {
-	if _, ok := azc.storageAccountsClients[subscriptionID]; ok {
-		return azc.storageAccountsClients[subscriptionID], nil
+func (azc *AzureClients) GetStorageAccountsClient(profile string, subscriptionID string) (*storage.AccountsClient, error) {
+	key := clientKey(profile, subscriptionID)
+
+	azc.mutex.RLock()
+	cached, ok := azc.storageAccountsClients[key]
+	azc.mutex.RUnlock()
+
+	if ok {
+		return cached, nil
 	}
 
 	azc.mutex.Lock()
 	defer azc.mutex.Unlock()
 
-	auth, err := GetStorageAuthorizer()
+	// Another goroutine may have built the client while we were waiting for the lock.
+	if cached, ok := azc.storageAccountsClients[key]; ok {
+		return cached, nil
+	}
+
+	auth, err := GetStorageAuthorizer(profile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := getEnvironment()
 
 	if err != nil {
 		return nil, err
 	}
 
-	client := storage.NewAccountsClient(subscriptionID)
+	client := storage.NewAccountsClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
 	client.RetryAttempts = 3
 	client.RetryDuration = 3 * time.Second
-	azc.storageAccountsClients[subscriptionID] = &client
-	azc.storageAccountsClients[subscriptionID].Authorizer = auth
-	azc.storageAccountsClients[subscriptionID].ResponseInspector = respondInspect(subscriptionID)
+	client.Authorizer = auth
+	client.Sender = newResourceManagerSender(serviceStorage, profile, subscriptionID)
+	client.ResponseInspector = respondInspect(profile, subscriptionID)
+	azc.storageAccountsClients[key] = &client
+	observeClientCreated("storage_accounts")
 
-	return azc.storageAccountsClients[subscriptionID], nil
+	return &client, nil
 }
 
 // GetStorageAccountsClientWithResource get storage account client
-func (azc *AzureClients) GetStorageAccountsClientWithResource(subscriptionID string, accountEndpoint string, resource string) (*storage.AccountsClient, error) {
-	if _, ok := azc.storageAccountsClients[accountEndpoint+resource]; ok {
-		return azc.storageAccountsClients[accountEndpoint+resource], nil
+func (azc *AzureClients) GetStorageAccountsClientWithResource(profile string, subscriptionID string, accountEndpoint string, resource string) (*storage.AccountsClient, error) {
+	key := clientKey(profile, accountEndpoint+resource)
+
+	azc.mutex.RLock()
+	cached, ok := azc.storageAccountsClients[key]
+	azc.mutex.RUnlock()
+
+	if ok {
+		return cached, nil
 	}
 
 	azc.mutex.Lock()
 	defer azc.mutex.Unlock()
 
-	auth, err := GetStorageAuthorizerWithResource(resource)
+	// Another goroutine may have built the client while we were waiting for the lock.
+	if cached, ok := azc.storageAccountsClients[key]; ok {
+		return cached, nil
+	}
+
+	auth, err := GetStorageAuthorizerWithResource(profile, resource)
 
 	if err != nil {
 		return nil, err
@@ -320,73 +592,124 @@ func (azc *AzureClients) GetStorageAccountsClientWithResource(subscriptionID str
 	client := storage.NewAccountsClientWithBaseURI(accountEndpoint, subscriptionID)
 	client.RetryAttempts = 3
 	client.RetryDuration = 3 * time.Second
-	azc.storageAccountsClients[accountEndpoint+resource] = &client
-	azc.storageAccountsClients[accountEndpoint+resource].Authorizer = auth
-	azc.storageAccountsClients[accountEndpoint+resource].ResponseInspector = respondInspect(subscriptionID)
+	client.Authorizer = auth
+	client.Sender = newResourceManagerSender(serviceStorage, profile, subscriptionID)
+	client.ResponseInspector = respondInspect(profile, subscriptionID)
+	azc.storageAccountsClients[key] = &client
+	observeClientCreated("storage_accounts")
 
-	return azc.storageAccountsClients[accountEndpoint+resource], nil
+	return &client, nil
 }
 
 // GetStorageAccountUsagesClient get storage account client
-func (azc *AzureClients) GetStorageAccountUsagesClient(subscriptionID string) (*storage.UsagesClient, error) {
-	if _, ok := azc.storageAccountUsagesClients[subscriptionID]; ok {
-		return azc.storageAccountUsagesClients[subscriptionID], nil
+func (azc *AzureClients) GetStorageAccountUsagesClient(profile string, subscriptionID string) (*storage.UsagesClient, error) {
+	key := clientKey(profile, subscriptionID)
+
+	azc.mutex.RLock()
+	cached, ok := azc.storageAccountUsagesClients[key]
+	azc.mutex.RUnlock()
+
+	if ok {
+		return cached, nil
 	}
 
 	azc.mutex.Lock()
 	defer azc.mutex.Unlock()
 
-	auth, err := GetStorageAuthorizer()
+	// Another goroutine may have built the client while we were waiting for the lock.
+	if cached, ok := azc.storageAccountUsagesClients[key]; ok {
+		return cached, nil
+	}
+
+	auth, err := GetStorageAuthorizer(profile)
+
+	if err != nil {
+		return nil, err
+	}
+
+	env, err := getEnvironment()
 
 	if err != nil {
 		return nil, err
 	}
 
-	client := storage.NewUsagesClient(subscriptionID)
+	client := storage.NewUsagesClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
 	client.RetryAttempts = 3
 	client.RetryDuration = 3 * time.Second
-	azc.storageAccountUsagesClients[subscriptionID] = &client
-	azc.storageAccountUsagesClients[subscriptionID].Authorizer = auth
-	azc.storageAccountUsagesClients[subscriptionID].ResponseInspector = respondInspect(subscriptionID)
+	client.Authorizer = auth
+	client.Sender = newResourceManagerSender(serviceStorage, profile, subscriptionID)
+	client.ResponseInspector = respondInspect(profile, subscriptionID)
+	azc.storageAccountUsagesClients[key] = &client
+	observeClientCreated("storage_account_usages")
 
-	return azc.storageAccountUsagesClients[subscriptionID], nil
+	return &client, nil
 }
 
 // GetBlobContainersClient get storage account client
-func (azc *AzureClients) GetBlobContainersClient(subscriptionID string) (*storage.BlobContainersClient, error) {
-	if _, ok := azc.blobContainersClients[subscriptionID]; ok {
-		return azc.blobContainersClients[subscriptionID], nil
+func (azc *AzureClients) GetBlobContainersClient(profile string, subscriptionID string) (*storage.BlobContainersClient, error) {
+	key := clientKey(profile, subscriptionID)
+
+	azc.mutex.RLock()
+	cached, ok := azc.blobContainersClients[key]
+	azc.mutex.RUnlock()
+
+	if ok {
+		return cached, nil
 	}
 
 	azc.mutex.Lock()
 	defer azc.mutex.Unlock()
 
-	auth, err := GetStorageAuthorizer()
+	// Another goroutine may have built the client while we were waiting for the lock.
+	if cached, ok := azc.blobContainersClients[key]; ok {
+		return cached, nil
+	}
+
+	auth, err := GetStorageAuthorizer(profile)
 
 	if err != nil {
 		return nil, err
 	}
 
-	client := storage.NewBlobContainersClient(subscriptionID)
+	env, err := getEnvironment()
+
+	if err != nil {
+		return nil, err
+	}
+
+	client := storage.NewBlobContainersClientWithBaseURI(env.ResourceManagerEndpoint, subscriptionID)
 	client.RetryAttempts = 3
 	client.RetryDuration = 3 * time.Second
-	azc.blobContainersClients[subscriptionID] = &client
-	azc.blobContainersClients[subscriptionID].Authorizer = auth
-	azc.blobContainersClients[subscriptionID].ResponseInspector = respondInspect(subscriptionID)
+	client.Authorizer = auth
+	client.Sender = newResourceManagerSender(serviceStorage, profile, subscriptionID)
+	client.ResponseInspector = respondInspect(profile, subscriptionID)
+	azc.blobContainersClients[key] = &client
+	observeClientCreated("blob_containers")
 
-	return azc.blobContainersClients[subscriptionID], nil
+	return &client, nil
 }
 
 // GetBlobContainersClientWithResource get storage account client
-func (azc *AzureClients) GetBlobContainersClientWithResource(subscriptionID string, accountEndpoint string, resource string) (*storage.BlobContainersClient, error) {
-	if _, ok := azc.blobContainersClients[accountEndpoint+resource]; ok {
-		return azc.blobContainersClients[accountEndpoint+resource], nil
+func (azc *AzureClients) GetBlobContainersClientWithResource(profile string, subscriptionID string, accountEndpoint string, resource string) (*storage.BlobContainersClient, error) {
+	key := clientKey(profile, accountEndpoint+resource)
+
+	azc.mutex.RLock()
+	cached, ok := azc.blobContainersClients[key]
+	azc.mutex.RUnlock()
+
+	if ok {
+		return cached, nil
 	}
 
 	azc.mutex.Lock()
 	defer azc.mutex.Unlock()
 
-	auth, err := GetStorageAuthorizerWithResource(resource)
+	// Another goroutine may have built the client while we were waiting for the lock.
+	if cached, ok := azc.blobContainersClients[key]; ok {
+		return cached, nil
+	}
+
+	auth, err := GetStorageAuthorizerWithResource(profile, resource)
 
 	if err != nil {
 		return nil, err
@@ -395,20 +718,50 @@ func (azc *AzureClients) GetBlobContainersClientWithResource(subscriptionID stri
 	client := storage.NewBlobContainersClientWithBaseURI(accountEndpoint, subscriptionID)
 	client.RetryAttempts = 3
 	client.RetryDuration = 3 * time.Second
-	azc.blobContainersClients[accountEndpoint+resource] = &client
-	azc.blobContainersClients[accountEndpoint+resource].Authorizer = auth
-	azc.blobContainersClients[accountEndpoint+resource].ResponseInspector = respondInspect(subscriptionID)
+	client.Authorizer = auth
+	client.Sender = newResourceManagerSender(serviceStorage, profile, subscriptionID)
+	client.ResponseInspector = respondInspect(profile, subscriptionID)
+	azc.blobContainersClients[key] = &client
+	observeClientCreated("blob_containers")
 
-	return azc.blobContainersClients[accountEndpoint+resource], nil
+	return &client, nil
 }
 
 // ----------------------------------------------------------------------------
 
-func respondInspect(subscription string) autorest.RespondDecorator {
+// clientKey returns the key used to index clients in AzureClients maps.
+func clientKey(profile string, key string) string {
+	if len(profile) == 0 {
+		profile = DefaultProfile
+	}
+
+	return profile + "/" + key
+}
+
+// profileTenant returns the tenant of the profile or an empty string if the
+// profile does not exist.
+func profileTenant(profile string) string {
+	if p, err := GetProfile(profile); err == nil {
+		return p.TenantID
+	}
+
+	return ""
+}
+
+// newResourceManagerSender returns the sender of resource manager clients.
+// Requests are paced by the rate limiters of the subscription and of the
+// tenant of the profile.
+func newResourceManagerSender(service string, profile string, subscription string) autorest.Sender {
+	return autorest.DecorateSender(newSender(service), limitRequests(profileTenant(profile), subscription))
+}
+
+func respondInspect(profile string, subscription string) autorest.RespondDecorator {
+	tenant := profileTenant(profile)
+
 	return func(r autorest.Responder) autorest.Responder {
 		return autorest.ResponderFunc(func(resp *http.Response) error {
-			SetReadRateLimitRemaining(os.Getenv("AZURE_TENANT_ID"), subscription, resp)
-			SetWriteRateLimitRemaining(os.Getenv("AZURE_TENANT_ID"), subscription, resp)
+			SetReadRateLimitRemaining(tenant, subscription, resp)
+			SetWriteRateLimitRemaining(tenant, subscription, resp)
 			return r.Respond(resp)
 		})
 	}
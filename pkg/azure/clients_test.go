@@ -0,0 +1,56 @@
+package azure
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestGetAzureClientsConcurrentLookups(t *testing.T) {
+	SetProfiles([]*Profile{
+		{
+			Name:         "test",
+			TenantID:     "00000000-0000-0000-0000-000000000000",
+			ClientID:     "00000000-0000-0000-0000-000000000000",
+			ClientSecret: "secret",
+		},
+	})
+	defer SetProfiles(nil)
+
+	clients := GetAzureClients()
+
+	if c := GetAzureClients(); c != clients {
+		t.Fatalf("Expected %p but got %p", clients, c)
+	}
+
+	wg := sync.WaitGroup{}
+	results := make([]interface{}, 32)
+
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client, err := clients.GetGroupClient("test", "11111111-1111-1111-1111-111111111111")
+
+			if err != nil {
+				t.Errorf("Expected no error but got %v", err)
+				return
+			}
+
+			results[i] = client
+		}(i)
+	}
+
+	wg.Wait()
+
+	for i := range results {
+		if results[i] != results[0] {
+			t.Fatalf("Expected %p but got %p", results[0], results[i])
+		}
+	}
+
+	SetProfiles(nil)
+
+	if c := GetAzureClients(); c == clients {
+		t.Fatalf("Expected a new client pool after profiles reload")
+	}
+}
@@ -0,0 +1,153 @@
+package azure
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// azureAPIConcurrencyInUse Number of Azure requests being sent
+	azureAPIConcurrencyInUse = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "azure_api",
+			Subsystem: "concurrency_limiter",
+			Name:      "in_use",
+			Help:      "Number of Azure requests being sent",
+		},
+	)
+
+	// azureAPIConcurrencyWaiting Number of Azure requests waiting for a slot
+	azureAPIConcurrencyWaiting = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "azure_api",
+			Subsystem: "concurrency_limiter",
+			Name:      "waiting",
+			Help:      "Number of Azure requests waiting for the number of requests being sent to go below max_concurrent_requests",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(azureAPIConcurrencyInUse)
+	prometheus.MustRegister(azureAPIConcurrencyWaiting)
+}
+
+var (
+	// This var holds the limiter of the number of concurrent requests sent by
+	// the shared HTTP client.
+	requestLimiter = &concurrencyLimiter{}
+)
+
+// SetMaxConcurrentRequests sets the maximum number of requests sent at the
+// same time by the shared HTTP client, 0 means no limit. Requests already
+// sent count towards the new limit.
+func SetMaxConcurrentRequests(max uint) {
+	requestLimiter.setMax(max)
+}
+
+// concurrencyLimiter bounds the number of concurrent requests.
+type concurrencyLimiter struct {
+	mutex    sync.Mutex
+	max      uint          // 0 means no limit
+	inUse    uint          // requests holding a slot, counted even without limit
+	released chan struct{} // closed when a slot is released or max changes
+}
+
+// setMax changes the maximum number of slots of the limiter.
+func (l *concurrencyLimiter) setMax(max uint) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if max == l.max {
+		return
+	}
+
+	l.max = max
+	l.wakeUp()
+}
+
+// wakeUp lets the requests waiting for a slot try again. Must be called with
+// the mutex held.
+func (l *concurrencyLimiter) wakeUp() {
+	if l.released != nil {
+		close(l.released)
+		l.released = nil
+	}
+}
+
+// acquire waits for a slot or for ctx to be done. The returned function
+// releases the slot.
+func (l *concurrencyLimiter) acquire(ctx context.Context) (func(), error) {
+	waiting := false
+
+	for {
+		l.mutex.Lock()
+
+		if l.max == 0 || l.inUse < l.max {
+			l.inUse++
+			l.mutex.Unlock()
+
+			if waiting {
+				azureAPIConcurrencyWaiting.Dec()
+			}
+
+			azureAPIConcurrencyInUse.Inc()
+
+			return l.release, nil
+		}
+
+		if l.released == nil {
+			l.released = make(chan struct{})
+		}
+
+		released := l.released
+		l.mutex.Unlock()
+
+		if !waiting {
+			waiting = true
+			azureAPIConcurrencyWaiting.Inc()
+		}
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			azureAPIConcurrencyWaiting.Dec()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// release releases a slot taken by acquire().
+func (l *concurrencyLimiter) release() {
+	azureAPIConcurrencyInUse.Dec()
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.inUse--
+	l.wakeUp()
+}
+
+// limitingTransport sends requests through next once the limiter lets them
+// through. The slot is released when the response headers are received so
+// that bodies which are not closed cannot hold it.
+type limitingTransport struct {
+	limiter *concurrencyLimiter
+	next    http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *limitingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	release, err := t.limiter.acquire(req.Context())
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer release()
+
+	return t.next.RoundTrip(req)
+}
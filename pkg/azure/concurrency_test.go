@@ -0,0 +1,140 @@
+package azure
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// blockingTransport blocks requests until release is closed.
+type blockingTransport struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *blockingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.started <- struct{}{}
+	<-t.release
+
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+}
+
+func TestLimitingTransport(t *testing.T) {
+	limiter := &concurrencyLimiter{}
+	limiter.setMax(2)
+
+	next := &blockingTransport{started: make(chan struct{}, 10), release: make(chan struct{})}
+	transport := &limitingTransport{limiter: limiter, next: next}
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			req, _ := http.NewRequest(http.MethodGet, "http://azure.test/", nil)
+			transport.RoundTrip(req)
+		}()
+	}
+
+	<-next.started
+	<-next.started
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for testutil.ToFloat64(azureAPIConcurrencyWaiting) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %v but got %v", 1, testutil.ToFloat64(azureAPIConcurrencyWaiting))
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	if v := testutil.ToFloat64(azureAPIConcurrencyInUse); v != 2 {
+		t.Fatalf("Expected %v but got %v", 2, v)
+	}
+
+	// Requests which cannot get a slot before their deadline are rejected.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://azure.test/", nil)
+
+	if _, err := transport.RoundTrip(req); err != context.DeadlineExceeded {
+		t.Fatalf("Expected %v but got %v", context.DeadlineExceeded, err)
+	}
+
+	close(next.release)
+	wg.Wait()
+
+	if v := testutil.ToFloat64(azureAPIConcurrencyInUse); v != 0 {
+		t.Fatalf("Expected %v but got %v", 0, v)
+	}
+
+	if v := testutil.ToFloat64(azureAPIConcurrencyWaiting); v != 0 {
+		t.Fatalf("Expected %v but got %v", 0, v)
+	}
+}
+
+func TestConcurrencyLimiterSetMax(t *testing.T) {
+	limiter := &concurrencyLimiter{}
+	limiter.setMax(1)
+
+	release, err := limiter.acquire(context.Background())
+
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+
+	// Reloading the same limit does not free the slot in use.
+	limiter.setMax(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := limiter.acquire(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected %v but got %v", context.DeadlineExceeded, err)
+	}
+
+	// A new limit accounts for the slot in use.
+	limiter.setMax(2)
+	second, err := limiter.acquire(context.Background())
+
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if _, err := limiter.acquire(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected %v but got %v", context.DeadlineExceeded, err)
+	}
+
+	// Waiting requests get the released slots.
+	acquired := make(chan struct{})
+
+	go func() {
+		if r, err := limiter.acquire(context.Background()); err == nil {
+			r()
+		}
+		close(acquired)
+	}()
+
+	release()
+
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the waiting request to get a slot")
+	}
+
+	second()
+
+	if limiter.inUse != 0 {
+		t.Fatalf("Expected %v but got %v", 0, limiter.inUse)
+	}
+}
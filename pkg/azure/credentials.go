@@ -0,0 +1,289 @@
+package azure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest/adal"
+	"github.com/Azure/go-autorest/autorest/azure/cli"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// CredentialMethodAuto picks the first usable method of the credential chain.
+	CredentialMethodAuto = "auto"
+	// CredentialMethodClientSecret uses a service principal client secret.
+	CredentialMethodClientSecret = "client_secret"
+	// CredentialMethodCertificate uses a service principal PKCS#12 certificate.
+	CredentialMethodCertificate = "certificate"
+	// CredentialMethodUsernamePassword uses a user name and password.
+	CredentialMethodUsernamePassword = "username_password"
+	// CredentialMethodWorkloadIdentity uses a federated token file such as the
+	// one projected by AKS workload identity.
+	CredentialMethodWorkloadIdentity = "workload_identity"
+	// CredentialMethodManagedIdentity uses the managed identity endpoint.
+	CredentialMethodManagedIdentity = "managed_identity"
+	// CredentialMethodAzureCLI uses the tokens of the Azure CLI.
+	CredentialMethodAzureCLI = "azure_cli"
+)
+
+const (
+	// Tokens are refreshed when they expire in less than tokenRefreshWithin,
+	// same as adal's default.
+	tokenRefreshWithin = 5 * time.Minute
+)
+
+var (
+	// CredentialMethods lists all the valid credential methods.
+	CredentialMethods = []string{
+		CredentialMethodAuto,
+		CredentialMethodClientSecret,
+		CredentialMethodCertificate,
+		CredentialMethodUsernamePassword,
+		CredentialMethodWorkloadIdentity,
+		CredentialMethodManagedIdentity,
+		CredentialMethodAzureCLI,
+	}
+)
+
+var (
+	// AzureExporterCredentialMethodInfo Informative gauge describing the credential method used
+	AzureExporterCredentialMethodInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "azure_exporter",
+			Subsystem: "",
+			Name:      "credential_method_info",
+			Help:      "Credential method used to acquire tokens for each profile and resource",
+		},
+		[]string{"profile", "resource", "method"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(AzureExporterCredentialMethodInfo)
+}
+
+// TokenProvider is implemented by all the tokens returned by NewTokenProvider().
+// *adal.ServicePrincipalToken implements it.
+type TokenProvider interface {
+	adal.OAuthTokenProvider
+	adal.RefresherWithContext
+	Token() adal.Token
+}
+
+// NewTokenProvider returns a token for resource acquired with the credentials
+// of the profile. If the profile does not force a credential method, the first
+// usable method of the following chain is used:
+// client secret, certificate, username/password, federated token file,
+// managed identity and Azure CLI.
+// The federated token file is tried before the managed identity because the
+// managed identity endpoint is usually reachable from AKS nodes even when a
+// workload identity has been set up for the pod.
+func NewTokenProvider(profile *Profile, resource string) (TokenProvider, string, error) {
+	method := profile.Method
+
+	if len(method) == 0 || method == CredentialMethodAuto {
+		method = profile.detectCredentialMethod()
+	}
+
+	token, err := newTokenProviderWithMethod(profile, resource, method)
+
+	if err != nil {
+		return nil, method, err
+	}
+
+	log.WithFields(log.Fields{
+		"_id":      "00000000",
+		"profile":  profile.Name,
+		"resource": resource,
+	}).Infof("Using %s credentials", method)
+
+	AzureExporterCredentialMethodInfo.WithLabelValues(profile.Name, resource, method).Set(1)
+
+	return token, method, nil
+}
+
+// detectCredentialMethod returns the first credential method of the chain for
+// which the profile has the required settings.
+func (p *Profile) detectCredentialMethod() string {
+	switch {
+	case len(p.ClientSecret) > 0:
+		return CredentialMethodClientSecret
+	case len(p.CertificatePath) > 0:
+		return CredentialMethodCertificate
+	case len(p.Username) > 0 && len(p.Password) > 0:
+		return CredentialMethodUsernamePassword
+	case len(p.FederatedTokenFile) > 0:
+		return CredentialMethodWorkloadIdentity
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if adal.MSIAvailable(ctx, nil) {
+		return CredentialMethodManagedIdentity
+	}
+
+	if _, err := exec.LookPath("az"); err == nil {
+		return CredentialMethodAzureCLI
+	}
+
+	// Fallback on managed identity to get a meaningful error.
+	return CredentialMethodManagedIdentity
+}
+
+// newTokenProviderWithMethod returns a token for resource acquired with the
+// given credential method.
+func newTokenProviderWithMethod(profile *Profile, resource string, method string) (TokenProvider, error) {
+	if method == CredentialMethodAzureCLI {
+		return &cliToken{resource: resource}, nil
+	}
+
+	token, err := newServicePrincipalToken(profile, resource, method)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Tokens are requested with the shared HTTP client like every other
+	// request sent to Azure.
+	token.SetSender(GetHTTPClient())
+
+	return token, nil
+}
+
+// newServicePrincipalToken returns an adal token for resource acquired with
+// the given credential method.
+func newServicePrincipalToken(profile *Profile, resource string, method string) (*adal.ServicePrincipalToken, error) {
+	env, err := getEnvironment()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if method == CredentialMethodManagedIdentity {
+		return adal.NewServicePrincipalTokenFromManagedIdentity(resource, &adal.ManagedIdentityOptions{
+			ClientID: profile.ClientID,
+		})
+	}
+
+	oauthConfig, err := adal.NewOAuthConfig(env.ActiveDirectoryEndpoint, profile.TenantID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	switch method {
+	case CredentialMethodClientSecret:
+		return adal.NewServicePrincipalToken(*oauthConfig, profile.ClientID, profile.ClientSecret, resource)
+	case CredentialMethodCertificate:
+		data, err := ioutil.ReadFile(profile.CertificatePath)
+
+		if err != nil {
+			return nil, fmt.Errorf("reading certificate %s: %v", profile.CertificatePath, err)
+		}
+
+		certificate, key, err := adal.DecodePfxCertificateData(data, profile.CertificatePassword)
+
+		if err != nil {
+			return nil, fmt.Errorf("decoding certificate %s: %v", profile.CertificatePath, err)
+		}
+
+		return adal.NewServicePrincipalTokenFromCertificate(*oauthConfig, profile.ClientID, certificate, key, resource)
+	case CredentialMethodUsernamePassword:
+		return adal.NewServicePrincipalTokenFromUsernamePassword(*oauthConfig, profile.ClientID, profile.Username, profile.Password, resource)
+	case CredentialMethodWorkloadIdentity:
+		// The token file is rotated by kubelet so it needs to be read on
+		// each refresh.
+		jwt := func() (string, error) {
+			data, err := ioutil.ReadFile(profile.FederatedTokenFile)
+
+			if err != nil {
+				return "", err
+			}
+
+			return strings.TrimSpace(string(data)), nil
+		}
+
+		return adal.NewServicePrincipalTokenFromFederatedTokenCallback(*oauthConfig, profile.ClientID, jwt, resource)
+	}
+
+	return nil, fmt.Errorf("unknown credential method `%s`", method)
+}
+
+// ----------------------------------------------------------------------------
+
+// cliToken is a TokenProvider backed by the Azure CLI.
+type cliToken struct {
+	mutex    sync.RWMutex
+	resource string
+	token    adal.Token
+}
+
+// OAuthToken returns the current access token.
+func (t *cliToken) OAuthToken() string {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	return t.token.AccessToken
+}
+
+// Token returns a copy of the current token.
+func (t *cliToken) Token() adal.Token {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	return t.token
+}
+
+// RefreshWithContext asks the Azure CLI for a new token.
+func (t *cliToken) RefreshWithContext(ctx context.Context) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	token, err := cli.GetTokenFromCLI(t.resource)
+
+	if err != nil {
+		return err
+	}
+
+	adalToken, err := token.ToADALToken()
+
+	if err != nil {
+		return err
+	}
+
+	if len(adalToken.AccessToken) == 0 {
+		return errors.New("azure cli returned an empty access token")
+	}
+
+	t.token = adalToken
+
+	return nil
+}
+
+// RefreshExchangeWithContext asks the Azure CLI for a token for another resource.
+func (t *cliToken) RefreshExchangeWithContext(ctx context.Context, resource string) error {
+	t.mutex.Lock()
+	t.resource = resource
+	t.mutex.Unlock()
+
+	return t.RefreshWithContext(ctx)
+}
+
+// EnsureFreshWithContext refreshes the token if it expires in less than
+// tokenRefreshWithin.
+func (t *cliToken) EnsureFreshWithContext(ctx context.Context) error {
+	if t.Token().WillExpireIn(tokenRefreshWithin) {
+		return t.RefreshWithContext(ctx)
+	}
+
+	return nil
+}
@@ -0,0 +1,23 @@
+package azure
+
+import (
+	"testing"
+)
+
+func TestDetectCredentialMethod(t *testing.T) {
+	tests := []struct {
+		profile Profile
+		method  string
+	}{
+		{Profile{ClientID: "id", ClientSecret: "secret", CertificatePath: "/cert.pfx"}, CredentialMethodClientSecret},
+		{Profile{ClientID: "id", CertificatePath: "/cert.pfx"}, CredentialMethodCertificate},
+		{Profile{ClientID: "id", Username: "user", Password: "password"}, CredentialMethodUsernamePassword},
+		{Profile{ClientID: "id", Username: "user", FederatedTokenFile: "/token"}, CredentialMethodWorkloadIdentity},
+	}
+
+	for _, test := range tests {
+		if m := test.profile.detectCredentialMethod(); m != test.method {
+			t.Fatalf("Expected %s but got %s for %+v", test.method, m, test.profile)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package azure
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+var (
+	// Mutex used to lock read/writes of the environment.
+	environmentMutex = sync.RWMutex{}
+	// This var holds the environment built from AZURE_ENVIRONMENT and the
+	// endpoint overrides. It is lazily computed by getEnvironment().
+	environment *Environment
+	// This var holds the endpoint overrides set with SetEndpoints().
+	endpoints = Endpoints{}
+)
+
+// Endpoints overrides the endpoints of the Azure environment named by
+// AZURE_ENVIRONMENT. Empty fields keep the value of the environment.
+type Endpoints struct {
+	ResourceManager string
+	ActiveDirectory string
+	Graph           string
+	// Batch is the resource used to authenticate against the Batch data plane.
+	Batch string
+	// BatchAccount is a format string building the Batch data plane URL from
+	// the account endpoint, e.g. `https://%s`.
+	BatchAccount string
+	// Blob is a format string building the blob service URL from the storage
+	// account name, e.g. `http://127.0.0.1:10000/%s` for Azurite.
+	Blob string
+	// Storage is the resource used to authenticate against the storage data plane.
+	Storage string
+}
+
+// Environment is an Azure environment with the endpoints the exporter needs
+// which are not part of azure.Environment.
+type Environment struct {
+	azure.Environment
+	BatchResource   string
+	BatchAccountURL string
+	BlobURL         string
+	StorageResource string
+}
+
+// SetEndpoints replaces the endpoint overrides. Authorizers and clients built
+// with the previous endpoints are dropped.
+func SetEndpoints(e Endpoints) {
+	environmentMutex.Lock()
+	endpoints = e
+	environment = nil
+	environmentMutex.Unlock()
+
+	resetAuthorizers()
+	resetClients()
+}
+
+// getEnvironment returns the Azure environment named by AZURE_ENVIRONMENT,
+// defaulting to the public cloud, with the endpoint overrides applied.
+// AZURE_ENVIRONMENT=AzureStackCloud reads the environment from the file
+// pointed by AZURE_ENVIRONMENT_FILEPATH.
+func getEnvironment() (*Environment, error) {
+	environmentMutex.RLock()
+	env := environment
+	environmentMutex.RUnlock()
+
+	if env != nil {
+		return env, nil
+	}
+
+	environmentMutex.Lock()
+	defer environmentMutex.Unlock()
+
+	if environment != nil {
+		return environment, nil
+	}
+
+	env, err := newEnvironment(os.Getenv("AZURE_ENVIRONMENT"), endpoints)
+
+	if err != nil {
+		return nil, err
+	}
+
+	environment = env
+
+	return environment, nil
+}
+
+// newEnvironment builds the environment named `name` and applies overrides.
+func newEnvironment(name string, overrides Endpoints) (*Environment, error) {
+	if len(name) == 0 {
+		name = azure.PublicCloud.Name
+	}
+
+	azenv, err := azure.EnvironmentFromName(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	env := &Environment{
+		Environment:     azenv,
+		BatchResource:   azenv.ResourceIdentifiers.Batch,
+		BatchAccountURL: "https://%s",
+		BlobURL:         "https://%s.blob." + azenv.StorageEndpointSuffix,
+		StorageResource: azenv.ResourceIdentifiers.Storage,
+	}
+
+	// Azure Stack environment files do not always provide resource identifiers.
+	if len(env.BatchResource) == 0 || env.BatchResource == azure.NotAvailable {
+		env.BatchResource = azenv.BatchManagementEndpoint
+	}
+
+	if len(env.StorageResource) == 0 || env.StorageResource == azure.NotAvailable {
+		env.StorageResource = azure.PublicCloud.ResourceIdentifiers.Storage
+	}
+
+	if len(overrides.ResourceManager) > 0 {
+		env.ResourceManagerEndpoint = overrides.ResourceManager
+	}
+
+	if len(overrides.ActiveDirectory) > 0 {
+		env.ActiveDirectoryEndpoint = overrides.ActiveDirectory
+	}
+
+	if len(overrides.Graph) > 0 {
+		env.GraphEndpoint = overrides.Graph
+	}
+
+	if len(overrides.Batch) > 0 {
+		env.BatchResource = overrides.Batch
+	}
+
+	if len(overrides.BatchAccount) > 0 {
+		env.BatchAccountURL = overrides.BatchAccount
+	}
+
+	if len(overrides.Blob) > 0 {
+		env.BlobURL = overrides.Blob
+	}
+
+	if len(overrides.Storage) > 0 {
+		env.StorageResource = overrides.Storage
+	}
+
+	if strings.Count(env.BlobURL, "%s") != 1 {
+		return nil, fmt.Errorf("blob endpoint `%s` must contain exactly one %%s", env.BlobURL)
+	}
+
+	if strings.Count(env.BatchAccountURL, "%s") != 1 {
+		return nil, fmt.Errorf("batch account endpoint `%s` must contain exactly one %%s", env.BatchAccountURL)
+	}
+
+	return env, nil
+}
+
+// ResourceManagerResource returns the resource used to authenticate against
+// the resource manager.
+func (e *Environment) ResourceManagerResource() string {
+	if len(e.TokenAudience) > 0 && e.TokenAudience != azure.NotAvailable {
+		return e.TokenAudience
+	}
+
+	return e.ResourceManagerEndpoint
+}
+
+// GetBlobServiceURL returns the blob service URL of a storage account.
+func (e *Environment) GetBlobServiceURL(account string) string {
+	return fmt.Sprintf(e.BlobURL, account)
+}
+
+// GetBatchAccountURL returns the Batch data plane URL of a Batch account.
+func (e *Environment) GetBatchAccountURL(accountEndpoint string) string {
+	return fmt.Sprintf(e.BatchAccountURL, accountEndpoint)
+}
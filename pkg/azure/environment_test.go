@@ -0,0 +1,46 @@
+package azure
+
+import (
+	"testing"
+)
+
+func TestNewEnvironment(t *testing.T) {
+	env, err := newEnvironment("AzureChinaCloud", Endpoints{})
+
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+
+	if u := env.GetBlobServiceURL("account"); u != "https://account.blob.core.chinacloudapi.cn" {
+		t.Fatalf("Expected %v but got %v", "https://account.blob.core.chinacloudapi.cn", u)
+	}
+
+	if env.BatchResource != "https://batch.chinacloudapi.cn/" {
+		t.Fatalf("Expected %v but got %v", "https://batch.chinacloudapi.cn/", env.BatchResource)
+	}
+
+	env, err = newEnvironment("", Endpoints{
+		Blob:            "http://127.0.0.1:10000/%s",
+		ResourceManager: "http://127.0.0.1:8080/",
+	})
+
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+
+	if u := env.GetBlobServiceURL("devstoreaccount1"); u != "http://127.0.0.1:10000/devstoreaccount1" {
+		t.Fatalf("Expected %v but got %v", "http://127.0.0.1:10000/devstoreaccount1", u)
+	}
+
+	if env.ResourceManagerEndpoint != "http://127.0.0.1:8080/" {
+		t.Fatalf("Expected %v but got %v", "http://127.0.0.1:8080/", env.ResourceManagerEndpoint)
+	}
+
+	if r := env.ResourceManagerResource(); r != "https://management.azure.com/" {
+		t.Fatalf("Expected %v but got %v", "https://management.azure.com/", r)
+	}
+
+	if _, err := newEnvironment("", Endpoints{Blob: "http://127.0.0.1:10000"}); err == nil {
+		t.Fatalf("Expected an error but got nil")
+	}
+}
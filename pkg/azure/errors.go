@@ -0,0 +1,94 @@
+package azure
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/adal"
+)
+
+// ErrorClass is the cause of an error returned by Azure API calls.
+type ErrorClass string
+
+const (
+	// ErrorClassAuth is the class of authentication and authorization errors.
+	ErrorClassAuth ErrorClass = "auth"
+	// ErrorClassThrottled is the class of requests throttled by Azure or by
+	// the client side rate limiter.
+	ErrorClassThrottled ErrorClass = "throttled"
+	// ErrorClassTimeout is the class of requests which did not complete in
+	// time.
+	ErrorClassTimeout ErrorClass = "timeout"
+	// ErrorClassNotFound is the class of requests on missing resources.
+	ErrorClassNotFound ErrorClass = "not_found"
+	// ErrorClassOther is the class of every other error.
+	ErrorClassOther ErrorClass = "other"
+)
+
+var (
+	// ErrRateLimited is returned by requests rejected by the client side rate
+	// limiter.
+	ErrRateLimited = errors.New("rate limited")
+)
+
+// ClassifyError returns the class of err.
+func ClassifyError(err error) ErrorClass {
+	if err == nil {
+		return ""
+	}
+
+	var storageErr azblob.StorageError
+	var tokenErr adal.TokenRefreshError
+	var netErr net.Error
+
+	switch {
+	// Storage errors also implement adal.TokenRefreshError.
+	case !errors.As(err, &storageErr) && errors.As(err, &tokenErr):
+		return ErrorClassAuth
+	case errors.Is(err, ErrRateLimited):
+		return ErrorClassThrottled
+	case errors.Is(err, context.DeadlineExceeded):
+		return ErrorClassTimeout
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorClassTimeout
+	}
+
+	switch errorStatusCode(err) {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return ErrorClassAuth
+	case http.StatusTooManyRequests:
+		return ErrorClassThrottled
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return ErrorClassTimeout
+	case http.StatusNotFound:
+		return ErrorClassNotFound
+	}
+
+	return ErrorClassOther
+}
+
+// errorStatusCode returns the HTTP status code carried by err, or 0.
+func errorStatusCode(err error) int {
+	var detailedErr autorest.DetailedError
+	var storageErr azblob.StorageError
+
+	if errors.As(err, &detailedErr) {
+		if code, ok := detailedErr.StatusCode.(int); ok && code != 0 {
+			return code
+		}
+
+		if detailedErr.Response != nil {
+			return detailedErr.Response.StatusCode
+		}
+	}
+
+	if errors.As(err, &storageErr) && storageErr.Response() != nil {
+		return storageErr.Response().StatusCode
+	}
+
+	return 0
+}
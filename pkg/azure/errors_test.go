@@ -0,0 +1,66 @@
+package azure
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/azure"
+)
+
+// fakeStorageError mimics azblob.StorageError.
+type fakeStorageError struct {
+	resp *http.Response
+}
+
+func (e fakeStorageError) Error() string {
+	return "storage error"
+}
+
+func (e fakeStorageError) Response() *http.Response {
+	return e.resp
+}
+
+func (e fakeStorageError) ServiceCode() azblob.ServiceCodeType {
+	return azblob.ServiceCodeContainerNotFound
+}
+
+func (e fakeStorageError) Temporary() bool {
+	return false
+}
+
+func (e fakeStorageError) Timeout() bool {
+	return false
+}
+
+func TestClassifyError(t *testing.T) {
+	detailed := func(code int, original error) error {
+		return autorest.NewErrorWithError(original, "batch.AccountClient", "List", &http.Response{StatusCode: code}, "Failure responding to request")
+	}
+
+	tests := []struct {
+		err      error
+		expected ErrorClass
+	}{
+		{nil, ""},
+		{errors.New("boom"), ErrorClassOther},
+		{detailed(http.StatusForbidden, &azure.RequestError{}), ErrorClassAuth},
+		{detailed(http.StatusUnauthorized, nil), ErrorClassAuth},
+		{detailed(http.StatusTooManyRequests, nil), ErrorClassThrottled},
+		{detailed(http.StatusNotFound, nil), ErrorClassNotFound},
+		{detailed(http.StatusInternalServerError, nil), ErrorClassOther},
+		{detailed(0, fmt.Errorf("%w: subscription `x`", ErrRateLimited)), ErrorClassThrottled},
+		{detailed(0, context.DeadlineExceeded), ErrorClassTimeout},
+		{fmt.Errorf("listing: %w", fakeStorageError{&http.Response{StatusCode: http.StatusNotFound}}), ErrorClassNotFound},
+	}
+
+	for _, test := range tests {
+		if got := ClassifyError(test.err); got != test.expected {
+			t.Fatalf("Expected %v but got %v for %v", test.expected, got, test.err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package azure
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-pipeline-go/pipeline"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// Services used as `service` label of the requests metrics.
+	serviceSubscriptions   = "subscriptions"
+	serviceResources       = "resources"
+	serviceBatchManagement = "batch_management"
+	serviceBatch           = "batch"
+	serviceGraph           = "graph"
+	serviceStorage         = "storage"
+	serviceBlob            = "blob"
+
+	// Operation used when the request context does not carry one.
+	unknownOperation = "unknown"
+)
+
+var (
+	// AzureAPIRequestsTotal Total number of requests sent to Azure APIs
+	AzureAPIRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "azure_api",
+			Subsystem: "",
+			Name:      "requests_total",
+			Help:      "Total number of requests sent to Azure APIs, including retries and pagination",
+		},
+		[]string{"service", "operation", "method", "status_code"},
+	)
+
+	// AzureAPIRequestDurationSeconds Histograms of Azure APIs requests durations in seconds
+	AzureAPIRequestDurationSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "azure_api",
+			Subsystem: "",
+			Name:      "request_duration_seconds",
+			Help:      "Histograms of Azure APIs requests durations in seconds",
+			Buckets:   []float64{0.02, 0.03, 0.04, 0.05, 0.10, 0.20, 0.30, 0.40, 0.50, 0.75, 1.0, 2.0, 5.0},
+		},
+		[]string{"service", "operation", "method", "status_code"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(AzureAPIRequestsTotal)
+	prometheus.MustRegister(AzureAPIRequestDurationSeconds)
+}
+
+// operationContextKey is the context key holding the operation name.
+type operationContextKey struct{}
+
+// withOperation returns a context carrying the name of the operation used to
+// label requests sent with it, including the ones fetching next pages.
+func withOperation(ctx context.Context, operation string) context.Context {
+	return context.WithValue(ctx, operationContextKey{}, operation)
+}
+
+// operationFromContext returns the operation carried by ctx.
+func operationFromContext(ctx context.Context) string {
+	if operation, ok := ctx.Value(operationContextKey{}).(string); ok {
+		return operation
+	}
+
+	return unknownOperation
+}
+
+// newSender returns the sender of the clients of `service`: the shared HTTP
+// client decorated with requests instrumentation.
+func newSender(service string) autorest.Sender {
+	return autorest.DecorateSender(GetHTTPClient(), instrumentRequests(service))
+}
+
+// instrumentRequests is a SendDecorator measuring every request sent to `service`.
+func instrumentRequests(service string) autorest.SendDecorator {
+	return func(s autorest.Sender) autorest.Sender {
+		return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+			t0 := time.Now()
+			resp, err := s.Do(r)
+			observeRequest(r.Context(), service, r.Method, resp, err, time.Since(t0))
+
+			return resp, err
+		})
+	}
+}
+
+// observeRequest records a request in requests metrics. Requests interrupted
+// because their context has been canceled are not recorded.
+func observeRequest(ctx context.Context, service string, method string, resp *http.Response, err error, duration time.Duration) {
+	if err != nil && ctx.Err() == context.Canceled {
+		return
+	}
+
+	statusCode := "error"
+	failed := err != nil
+
+	if resp != nil {
+		statusCode = strconv.Itoa(resp.StatusCode)
+		failed = failed || resp.StatusCode >= http.StatusBadRequest
+	}
+
+	operation := operationFromContext(ctx)
+	AzureAPIRequestsTotal.WithLabelValues(service, operation, method, statusCode).Inc()
+	AzureAPIRequestDurationSeconds.WithLabelValues(service, operation, method, statusCode).Observe(duration.Seconds())
+
+	if failed {
+		ObserveAzureAPICallFailed(duration.Seconds())
+	} else {
+		ObserveAzureAPICall(duration.Seconds())
+	}
+}
+
+// newBlobHTTPSender returns an azblob pipeline sender which uses the shared
+// HTTP client and instruments requests.
+func newBlobHTTPSender() pipeline.Factory {
+	return pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
+		return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+			t0 := time.Now()
+			resp, err := GetHTTPClient().Do(request.WithContext(ctx))
+			observeRequest(ctx, serviceBlob, request.Method, resp, err, time.Since(t0))
+
+			if err != nil {
+				err = pipeline.NewError(err, "HTTP request failed")
+			}
+
+			return pipeline.NewHTTPResponse(resp), err
+		}
+	})
+}
@@ -0,0 +1,56 @@
+package azure
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInstrumentRequests(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/throttled" {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	sender := newSender("test")
+	ctx := withOperation(context.Background(), "TestOperation")
+
+	for _, path := range []string{"/ok", "/ok", "/throttled"} {
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+path, nil)
+		resp, err := sender.Do(req)
+
+		if err != nil {
+			t.Fatalf("Expected no error but got %v", err)
+		}
+
+		resp.Body.Close()
+	}
+
+	if v := testutil.ToFloat64(AzureAPIRequestsTotal.WithLabelValues("test", "TestOperation", "GET", "200")); v != 2 {
+		t.Fatalf("Expected %v but got %v", 2, v)
+	}
+
+	if v := testutil.ToFloat64(AzureAPIRequestsTotal.WithLabelValues("test", "TestOperation", "GET", "429")); v != 1 {
+		t.Fatalf("Expected %v but got %v", 1, v)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/ok", nil)
+	resp, err := sender.Do(req)
+
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+
+	resp.Body.Close()
+
+	if v := testutil.ToFloat64(AzureAPIRequestsTotal.WithLabelValues("test", unknownOperation, "GET", "200")); v != 1 {
+		t.Fatalf("Expected %v but got %v", 1, v)
+	}
+}
@@ -0,0 +1,153 @@
+package azure
+
+import (
+	"context"
+	"reflect"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// AzureAPIListPagesTotal Number of pages fetched by list operations
+	AzureAPIListPagesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "azure_api",
+			Subsystem: "list",
+			Name:      "pages_total",
+			Help:      "Number of pages fetched by list operations",
+		},
+		[]string{"operation"},
+	)
+
+	// AzureAPIListTruncatedTotal Number of list operations stopped because they reached the maximum number of items
+	AzureAPIListTruncatedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "azure_api",
+			Subsystem: "list",
+			Name:      "truncated_total",
+			Help:      "Number of list operations stopped before the last page because they reached the maximum number of items",
+		},
+		[]string{"operation"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(AzureAPIListPagesTotal)
+	prometheus.MustRegister(AzureAPIListTruncatedTotal)
+}
+
+var (
+	// Mutex used to lock read/writes of maxListItems.
+	maxListItemsMutex = sync.RWMutex{}
+	// This var holds the maximum number of items returned by list functions,
+	// 0 means no limit.
+	maxListItems = 0
+)
+
+// Pager is implemented by the result pages of the Azure SDK.
+type Pager interface {
+	NotDone() bool
+	NextWithContext(ctx context.Context) error
+}
+
+// SetMaxListItems sets the maximum number of items list functions return.
+// 0 disables the limit.
+func SetMaxListItems(max int) {
+	maxListItemsMutex.Lock()
+	maxListItems = max
+	maxListItemsMutex.Unlock()
+}
+
+// getMaxListItems returns the maximum number of items list functions return.
+func getMaxListItems() int {
+	maxListItemsMutex.RLock()
+	defer maxListItemsMutex.RUnlock()
+
+	return maxListItems
+}
+
+// walkPages calls collect on every page of `page`, fetching the next one
+// after each call. `collect` must keep at most `max` items in total when `max`
+// is greater than 0, see capItems(), and return the number of items seen so
+// far including the ones it dropped. It stops once the maximum number of
+// items is reached, with a warning if items were left out, and returns ctx's
+// error if ctx is done.
+func walkPages(ctx context.Context, page Pager, collect func(max int) int) error {
+	operation := operationFromContext(ctx)
+	max := getMaxListItems()
+
+	// Pages are not done as long as they hold values, NextWithContext() on the
+	// last page returns an empty page.
+	for page.NotDone() {
+		AzureAPIListPagesTotal.WithLabelValues(operation).Inc()
+		count := collect(max)
+
+		if max > 0 && count >= max {
+			truncated := count > max
+
+			// The limit is reached at the end of a page, items are only left
+			// out if there are more pages.
+			if !truncated {
+				truncated = hasNextLink(page)
+			}
+
+			if truncated {
+				AzureAPIListTruncatedTotal.WithLabelValues(operation).Inc()
+				log.WithFields(log.Fields{
+					"_id":       ctx.Value("id"),
+					"operation": operation,
+				}).Warnf("Listing stopped at the maximum number of items (%d), results are incomplete", max)
+			}
+
+			return nil
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		if err := page.NextWithContext(ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hasNextLink returns true unless the current page of `page` tells that it is
+// the last one. The result pages of the Azure SDK return their content with a
+// Response() method whose result holds a `NextLink` or `OdataNextLink` field.
+func hasNextLink(page Pager) bool {
+	method := reflect.ValueOf(page).MethodByName("Response")
+
+	if !method.IsValid() || method.Type().NumIn() != 0 || method.Type().NumOut() != 1 {
+		return true
+	}
+
+	response := reflect.Indirect(method.Call(nil)[0])
+
+	if response.Kind() != reflect.Struct {
+		return true
+	}
+
+	for _, name := range []string{"NextLink", "OdataNextLink"} {
+		field := response.FieldByName(name)
+
+		if field.IsValid() && field.Kind() == reflect.Ptr && field.Type().Elem().Kind() == reflect.String {
+			return !field.IsNil() && len(field.Elem().String()) > 0
+		}
+	}
+
+	return true
+}
+
+// capItems returns the number of items out of count to keep according to max.
+func capItems(count int, max int) int {
+	if max > 0 && count > max {
+		return max
+	}
+
+	return count
+}
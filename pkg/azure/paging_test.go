@@ -0,0 +1,159 @@
+package azure
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/graphrbac/1.6/graphrbac"
+	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2019-06-01/storage"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakePage is a Pager over a slice of pages.
+type fakePage struct {
+	pages [][]int
+	index int
+}
+
+func (p *fakePage) Values() []int {
+	if p.index >= len(p.pages) {
+		return nil
+	}
+	return p.pages[p.index]
+}
+
+// fakePageResponse mimics the results of the Azure SDK pages.
+type fakePageResponse struct {
+	NextLink *string
+}
+
+func (p *fakePage) Response() fakePageResponse {
+	if p.index+1 >= len(p.pages) {
+		return fakePageResponse{}
+	}
+
+	next := "next"
+	return fakePageResponse{NextLink: &next}
+}
+
+func (p *fakePage) NotDone() bool {
+	return len(p.Values()) > 0
+}
+
+func (p *fakePage) NextWithContext(ctx context.Context) error {
+	p.index++
+	return nil
+}
+
+func TestWalkPages(t *testing.T) {
+	defer SetMaxListItems(0)
+
+	ctx := context.WithValue(context.Background(), "id", "00000000")
+	page := &fakePage{pages: [][]int{{1, 2}, {3, 4}, {5}}}
+	vals := make([]int, 0)
+
+	err := walkPages(ctx, page, func(max int) int {
+		vals = append(vals, page.Values()...)
+		count := len(vals)
+		vals = vals[:capItems(count, max)]
+		return count
+	})
+
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+
+	if len(vals) != 5 {
+		t.Fatalf("Expected %v but got %v", 5, len(vals))
+	}
+
+	// Limits
+	truncated := AzureAPIListTruncatedTotal.WithLabelValues("TestWalkPages")
+	ctx = withOperation(ctx, "TestWalkPages")
+
+	tests := []struct {
+		max       int
+		expected  int
+		truncated float64
+		index     int
+	}{
+		// max in the middle of a page
+		{3, 3, 1, 1},
+		// max at the end of a page which is not the last one
+		{2, 2, 1, 0},
+		// max at the end of the last page
+		{5, 5, 0, 2},
+		// max above the number of items
+		{10, 5, 0, 3},
+	}
+
+	for _, test := range tests {
+		SetMaxListItems(test.max)
+		page = &fakePage{pages: [][]int{{1, 2}, {3, 4}, {5}}}
+		vals = make([]int, 0)
+		before := testutil.ToFloat64(truncated)
+
+		err = walkPages(ctx, page, func(max int) int {
+			vals = append(vals, page.Values()...)
+			count := len(vals)
+			vals = vals[:capItems(count, max)]
+			return count
+		})
+
+		if err != nil {
+			t.Fatalf("Expected no error but got %v", err)
+		}
+
+		if len(vals) != test.expected {
+			t.Fatalf("Expected %v but got %v for max %d", test.expected, len(vals), test.max)
+		}
+
+		if v := testutil.ToFloat64(truncated) - before; v != test.truncated {
+			t.Fatalf("Expected %v but got %v truncations for max %d", test.truncated, v, test.max)
+		}
+
+		// No page is fetched past the limit.
+		if page.index != test.index {
+			t.Fatalf("Expected %v but got %v fetched pages for max %d", test.index, page.index, test.max)
+		}
+	}
+
+	// Canceled context
+	SetMaxListItems(0)
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	page = &fakePage{pages: [][]int{{1, 2}, {3, 4}, {5}}}
+
+	err = walkPages(ctx, page, func(max int) int { return 0 })
+
+	if err != context.Canceled {
+		t.Fatalf("Expected %v but got %v", context.Canceled, err)
+	}
+}
+
+func TestHasNextLink(t *testing.T) {
+	next := "https://management.azure.com/next"
+
+	tests := []struct {
+		page     Pager
+		expected bool
+	}{
+		{&graphrbac.ApplicationListResultPage{}, false},
+		{func() Pager {
+			page := graphrbac.NewApplicationListResultPage(graphrbac.ApplicationListResult{OdataNextLink: &next}, nil)
+			return &page
+		}(), true},
+		{func() Pager {
+			page := storage.NewListContainerItemsPage(storage.ListContainerItems{NextLink: &next}, nil)
+			return &page
+		}(), true},
+		{&storage.ListContainerItemsPage{}, false},
+	}
+
+	for i, test := range tests {
+		if b := hasNextLink(test.page); b != test.expected {
+			t.Fatalf("Expected %v but got %v for test %d", test.expected, b, i)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package azure
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/Azure/azure-sdk-for-go/services/preview/subscription/mgmt/2018-03-01-preview/subscription"
+	"github.com/Azure/go-autorest/autorest/azure/auth"
+)
+
+const (
+	// DefaultProfile is the name of the credential profile built from the
+	// AZURE_* environment variables. It is used when no profile is specified.
+	DefaultProfile = "default"
+)
+
+var (
+	// Mutex used to lock read/writes of profiles.
+	profilesMutex = sync.RWMutex{}
+	// This var holds all the credential profiles indexed by name.
+	profiles = make(map[string]*Profile)
+)
+
+// Profile is a named set of credentials used to authenticate against an
+// Azure tenant.
+type Profile struct {
+	Name                string
+	TenantID            string
+	ClientID            string
+	ClientSecret        string
+	CertificatePath     string
+	CertificatePassword string
+	Username            string
+	Password            string
+	FederatedTokenFile  string
+	// Method forces the credential method, see CredentialMethods.
+	Method string
+}
+
+// Subscription is a subscription bound to the credential profile which must
+// be used to query it.
+type Subscription struct {
+	*subscription.Model
+	Profile string
+}
+
+// NewProfileFromEnvironment returns a profile built from the AZURE_* environment
+// variables, see https://github.com/Azure/go-autorest/blob/v13.3.0/autorest/azure/auth/auth.go#L41-L51
+func NewProfileFromEnvironment(name string) *Profile {
+	return &Profile{
+		Name:                name,
+		TenantID:            os.Getenv(auth.TenantID),
+		ClientID:            os.Getenv(auth.ClientID),
+		ClientSecret:        os.Getenv(auth.ClientSecret),
+		CertificatePath:     os.Getenv(auth.CertificatePath),
+		CertificatePassword: os.Getenv(auth.CertificatePassword),
+		Username:            os.Getenv(auth.Username),
+		Password:            os.Getenv(auth.Password),
+		FederatedTokenFile:  os.Getenv("AZURE_FEDERATED_TOKEN_FILE"),
+	}
+}
+
+// SetProfiles replaces the registered credential profiles. The default profile
+// is always available and built from the environment unless a profile named
+// DefaultProfile is given. Authorizers and clients built with previous
+// profiles are dropped.
+func SetProfiles(ps []*Profile) {
+	next := make(map[string]*Profile)
+	next[DefaultProfile] = NewProfileFromEnvironment(DefaultProfile)
+
+	for _, p := range ps {
+		next[p.Name] = p
+	}
+
+	profilesMutex.Lock()
+	profiles = next
+	profilesMutex.Unlock()
+
+	resetAuthorizers()
+	resetClients()
+}
+
+// GetProfile returns the credential profile registered with `name`. An empty
+// name returns the default profile.
+func GetProfile(name string) (*Profile, error) {
+	if len(name) == 0 {
+		name = DefaultProfile
+	}
+
+	profilesMutex.RLock()
+	p, ok := profiles[name]
+	profilesMutex.RUnlock()
+
+	if ok {
+		return p, nil
+	}
+
+	if name == DefaultProfile {
+		return NewProfileFromEnvironment(DefaultProfile), nil
+	}
+
+	return nil, fmt.Errorf("unknown credential profile `%s`", name)
+}
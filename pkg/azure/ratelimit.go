@@ -0,0 +1,307 @@
+package azure
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	rateLimitScopeTenant       = "tenant"
+	rateLimitScopeSubscription = "subscription"
+)
+
+var (
+	// AzureAPIRateLimiterWaitSeconds Histograms of the time requests waited for the rate limiter
+	AzureAPIRateLimiterWaitSeconds = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "azure_api",
+			Subsystem: "rate_limiter",
+			Name:      "wait_seconds",
+			Help:      "Histograms of the time requests waited for the client side rate limiter",
+			Buckets:   []float64{0, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60},
+		},
+		[]string{"scope", "name"},
+	)
+
+	// AzureAPIRateLimiterRejectedTotal Number of requests rejected by the rate limiter
+	AzureAPIRateLimiterRejectedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "azure_api",
+			Subsystem: "rate_limiter",
+			Name:      "rejected_total",
+			Help:      "Number of requests not sent because the client side rate limiter could not let them through before their deadline",
+		},
+		[]string{"scope", "name"},
+	)
+
+	// AzureAPIRateLimiterThrottledTotal Number of throttled responses seen by the rate limiter
+	AzureAPIRateLimiterThrottledTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "azure_api",
+			Subsystem: "rate_limiter",
+			Name:      "throttled_total",
+			Help:      "Number of 429 responses which paused the client side rate limiter",
+		},
+		[]string{"scope", "name"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(AzureAPIRateLimiterWaitSeconds)
+	prometheus.MustRegister(AzureAPIRateLimiterRejectedTotal)
+	prometheus.MustRegister(AzureAPIRateLimiterThrottledTotal)
+}
+
+// RateLimits configures the client side rate limiters.
+type RateLimits struct {
+	// RequestsPerSecond is the rate at which tokens are added to the buckets.
+	RequestsPerSecond float64
+	// Burst is the capacity of the buckets.
+	Burst uint
+	// Reserve is the number of remaining requests reported by Azure below
+	// which requests are paced so that the quota is not exhausted.
+	Reserve uint
+}
+
+var (
+	// Mutex used to lock read/writes of rateLimits and rateLimiters.
+	rateLimitersMutex = sync.Mutex{}
+	// This var holds the rate limits applied to new limiters.
+	rateLimits = RateLimits{RequestsPerSecond: 10, Burst: 50, Reserve: 100}
+	// This var holds the rate limiters indexed by scope and name.
+	rateLimiters = make(map[string]*rateLimiter)
+)
+
+// SetRateLimits replaces the rate limits. Existing limiters keep their
+// remaining tokens and their pauses so that reloading the configuration while
+// Azure throttles does not send a burst of requests.
+func SetRateLimits(limits RateLimits) {
+	rateLimitersMutex.Lock()
+	defer rateLimitersMutex.Unlock()
+
+	if limits == rateLimits {
+		return
+	}
+
+	rateLimits = limits
+
+	for _, l := range rateLimiters {
+		l.setLimits(limits)
+	}
+}
+
+// getRateLimiter returns the limiter of the given scope and name.
+func getRateLimiter(scope string, name string) *rateLimiter {
+	rateLimitersMutex.Lock()
+	defer rateLimitersMutex.Unlock()
+
+	key := scope + "/" + name
+
+	if l, ok := rateLimiters[key]; ok {
+		return l
+	}
+
+	l := newRateLimiter(scope, name, rateLimits, time.Now)
+	rateLimiters[key] = l
+
+	return l
+}
+
+// rateLimiter is a token bucket whose content is lowered when Azure reports
+// that the remaining quota is getting low and which is paused when Azure
+// throttles requests.
+type rateLimiter struct {
+	mutex       sync.Mutex
+	scope       string
+	name        string
+	limits      RateLimits
+	now         func() time.Time
+	tokens      float64
+	last        time.Time
+	pausedUntil time.Time
+}
+
+// newRateLimiter returns a full rate limiter.
+func newRateLimiter(scope string, name string, limits RateLimits, now func() time.Time) *rateLimiter {
+	return &rateLimiter{
+		scope:  scope,
+		name:   name,
+		limits: limits,
+		now:    now,
+		tokens: float64(limits.Burst),
+		last:   now(),
+	}
+}
+
+// setLimits replaces the limits of the limiter. The tokens accumulated with
+// the previous rate are kept up to the new burst.
+func (l *rateLimiter) setLimits(limits RateLimits) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := l.now()
+
+	if l.limits.RequestsPerSecond > 0 {
+		elapsed := now.Sub(l.last).Seconds()
+		l.tokens = math.Min(float64(l.limits.Burst), l.tokens+elapsed*l.limits.RequestsPerSecond)
+	}
+
+	l.limits = limits
+	l.last = now
+	l.tokens = math.Min(float64(limits.Burst), l.tokens)
+}
+
+// reserve takes a token and returns how long the caller must wait before
+// sending its request. Must be called with the mutex held.
+func (l *rateLimiter) reserve() time.Duration {
+	now := l.now()
+
+	if l.limits.RequestsPerSecond <= 0 {
+		return 0
+	}
+
+	elapsed := now.Sub(l.last).Seconds()
+	l.tokens = math.Min(float64(l.limits.Burst), l.tokens+elapsed*l.limits.RequestsPerSecond)
+	l.last = now
+	l.tokens--
+
+	wait := time.Duration(0)
+
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.limits.RequestsPerSecond * float64(time.Second))
+	}
+
+	if pause := l.pausedUntil.Sub(now); pause > wait {
+		wait = pause
+	}
+
+	return wait
+}
+
+// cancel gives back a token taken by reserve.
+func (l *rateLimiter) cancel() {
+	l.mutex.Lock()
+	l.tokens++
+	l.mutex.Unlock()
+}
+
+// wait blocks until the request can be sent. It returns an error without
+// waiting if the context would expire before.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	l.mutex.Lock()
+	wait := l.reserve()
+	l.mutex.Unlock()
+
+	if deadline, ok := ctx.Deadline(); ok && l.now().Add(wait).After(deadline) {
+		l.cancel()
+		AzureAPIRateLimiterRejectedTotal.WithLabelValues(l.scope, l.name).Inc()
+		return fmt.Errorf("%w: %s `%s` would delay the request by %s which exceeds its deadline", ErrRateLimited, l.scope, l.name, wait)
+	}
+
+	AzureAPIRateLimiterWaitSeconds.WithLabelValues(l.scope, l.name).Observe(wait.Seconds())
+
+	if wait == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.cancel()
+		AzureAPIRateLimiterRejectedTotal.WithLabelValues(l.scope, l.name).Inc()
+		return ctx.Err()
+	}
+}
+
+// observe adjusts the limiter with the quota reported in the response.
+func (l *rateLimiter) observe(resp *http.Response, header string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if remaining := resp.Header.Get(header); len(remaining) > 0 {
+		if f, err := strconv.ParseFloat(remaining, 64); err == nil {
+			// Do not let more requests through than what Azure still accepts
+			// minus the reserve. The bucket may go below zero but no more than
+			// one burst so that pauses stay reasonable.
+			available := math.Max(f-float64(l.limits.Reserve), -float64(l.limits.Burst))
+			l.tokens = math.Min(l.tokens, available)
+		}
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		AzureAPIRateLimiterThrottledTotal.WithLabelValues(l.scope, l.name).Inc()
+
+		if until := retryAfter(resp, l.now()); until.After(l.pausedUntil) {
+			l.pausedUntil = until
+		}
+	}
+}
+
+// retryAfter returns the time given by the Retry-After header, defaulting to
+// one second from now.
+func retryAfter(resp *http.Response, now time.Time) time.Time {
+	value := resp.Header.Get("Retry-After")
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return now.Add(time.Duration(seconds) * time.Second)
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		return date
+	}
+
+	return now.Add(time.Second)
+}
+
+// limitRequests is a SendDecorator pacing requests sent to the resource
+// manager with the limiters of the subscription and of the tenant.
+func limitRequests(tenant string, subscription string) autorest.SendDecorator {
+	return func(s autorest.Sender) autorest.Sender {
+		return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+			limiters := make([]*rateLimiter, 0, 2)
+
+			if len(subscription) > 0 {
+				limiters = append(limiters, getRateLimiter(rateLimitScopeSubscription, subscription))
+			}
+
+			if len(tenant) > 0 {
+				limiters = append(limiters, getRateLimiter(rateLimitScopeTenant, tenant))
+			}
+
+			for _, l := range limiters {
+				if err := l.wait(r.Context()); err != nil {
+					return nil, err
+				}
+			}
+
+			resp, err := s.Do(r)
+
+			if resp == nil {
+				return resp, err
+			}
+
+			kind := "writes"
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				kind = "reads"
+			}
+
+			for _, l := range limiters {
+				l.observe(resp, fmt.Sprintf("x-ms-ratelimit-remaining-%s-%s", l.scope, kind))
+			}
+
+			return resp, err
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package azure
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterReserve(t *testing.T) {
+	now := time.Unix(0, 0)
+	clock := func() time.Time { return now }
+	l := newRateLimiter(rateLimitScopeSubscription, "test", RateLimits{RequestsPerSecond: 10, Burst: 2, Reserve: 100}, clock)
+
+	// Burst
+	for i := 0; i < 2; i++ {
+		if wait := l.reserve(); wait != 0 {
+			t.Fatalf("Expected %v but got %v", time.Duration(0), wait)
+		}
+	}
+
+	// Bucket is empty, next token in 100ms
+	if wait := l.reserve(); wait != 100*time.Millisecond {
+		t.Fatalf("Expected %v but got %v", 100*time.Millisecond, wait)
+	}
+
+	// Refill
+	now = now.Add(time.Second)
+
+	if wait := l.reserve(); wait != 0 {
+		t.Fatalf("Expected %v but got %v", time.Duration(0), wait)
+	}
+
+	// Azure reports a quota below the reserve
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+	resp.Header.Set("x-ms-ratelimit-remaining-subscription-reads", "99")
+	l.observe(resp, "x-ms-ratelimit-remaining-subscription-reads")
+
+	if wait := l.reserve(); wait != 200*time.Millisecond {
+		t.Fatalf("Expected %v but got %v", 200*time.Millisecond, wait)
+	}
+
+	// Azure throttles
+	now = now.Add(10 * time.Second)
+	resp = &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}}
+	resp.Header.Set("Retry-After", "30")
+	l.observe(resp, "x-ms-ratelimit-remaining-subscription-reads")
+
+	if wait := l.reserve(); wait != 30*time.Second {
+		t.Fatalf("Expected %v but got %v", 30*time.Second, wait)
+	}
+}
+
+func TestRateLimiterWaitDeadline(t *testing.T) {
+	l := newRateLimiter(rateLimitScopeTenant, "test", RateLimits{RequestsPerSecond: 1, Burst: 1}, time.Now)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := l.wait(ctx); err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+
+	if err := l.wait(ctx); err == nil {
+		t.Fatalf("Expected an error but got nil")
+	}
+
+	// The rejected request must not have consumed a token.
+	if l.tokens < -0.01 || l.tokens > 0.5 {
+		t.Fatalf("Expected about %v tokens but got %v", 0, l.tokens)
+	}
+}
+
+func TestSetRateLimitsKeepsLimiters(t *testing.T) {
+	defer SetRateLimits(rateLimits)
+
+	SetRateLimits(RateLimits{RequestsPerSecond: 10, Burst: 50, Reserve: 100})
+
+	now := time.Unix(0, 0)
+	l := getRateLimiter(rateLimitScopeSubscription, "reload")
+	l.now = func() time.Time { return now }
+	l.last = now
+
+	// The bucket is empty and Azure throttles.
+	l.tokens = 0
+	resp := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}}
+	resp.Header.Set("Retry-After", "30")
+	l.observe(resp, "x-ms-ratelimit-remaining-subscription-reads")
+
+	// Same limits, nothing changes.
+	SetRateLimits(RateLimits{RequestsPerSecond: 10, Burst: 50, Reserve: 100})
+
+	if got := getRateLimiter(rateLimitScopeSubscription, "reload"); got != l {
+		t.Fatalf("Expected the limiter to be kept")
+	}
+
+	// New limits are applied without refilling the bucket or lifting the pause.
+	SetRateLimits(RateLimits{RequestsPerSecond: 20, Burst: 100, Reserve: 100})
+
+	if got := getRateLimiter(rateLimitScopeSubscription, "reload"); got != l {
+		t.Fatalf("Expected the limiter to be kept")
+	}
+
+	if l.limits.RequestsPerSecond != 20 || l.limits.Burst != 100 {
+		t.Fatalf("Expected %v but got %v", RateLimits{RequestsPerSecond: 20, Burst: 100, Reserve: 100}, l.limits)
+	}
+
+	l.mutex.Lock()
+	wait := l.reserve()
+	l.mutex.Unlock()
+
+	if wait != 30*time.Second {
+		t.Fatalf("Expected %v but got %v", 30*time.Second, wait)
+	}
+
+	// A lower burst caps the tokens.
+	now = now.Add(time.Minute)
+	SetRateLimits(RateLimits{RequestsPerSecond: 20, Burst: 5, Reserve: 100})
+
+	if l.tokens != 5 {
+		t.Fatalf("Expected %v but got %v", 5, l.tokens)
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/Azure/azure-sdk-for-go/services/preview/subscription/mgmt/2018-03-01-preview/subscription"
 	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2018-05-01/resources"
 	log "github.com/sirupsen/logrus"
 	"sylr.dev/libqd/cache"
@@ -16,9 +15,9 @@ var (
 )
 
 // GetResourceGroup returns a Group
-func GetResourceGroup(ctx context.Context, clients *AzureClients, subscription *subscription.Model, name string) (*resources.Group, error) {
+func GetResourceGroup(ctx context.Context, clients *AzureClients, subscription *Subscription, name string) (*resources.Group, error) {
 	c := cache.GetCache(1*time.Hour, time.Minute)
-	cacheKey := fmt.Sprintf(cacheKeyResourceGroup, *subscription.DisplayName, name)
+	cacheKey := fmt.Sprintf(cacheKeyResourceGroup, *subscription.SubscriptionID, name)
 
 	if cgroup, ok := c.Get(cacheKey); ok {
 		if group, ok := cgroup.(*resources.Group); !ok {
@@ -28,28 +27,21 @@ func GetResourceGroup(ctx context.Context, clients *AzureClients, subscription *
 		}
 	}
 
-	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	ctx, cancel := context.WithTimeout(withOperation(ctx, "GetResourceGroup"), 20*time.Second)
 	defer cancel()
 
-	client, err := clients.GetGroupClient(*subscription.SubscriptionID)
+	client, err := clients.GetGroupClient(subscription.Profile, *subscription.SubscriptionID)
 
 	if err != nil {
 		return nil, err
 	}
 
-	t0 := time.Now()
 	group, err := client.Get(ctx, name)
-	t1 := time.Since(t0).Seconds()
 
 	if err != nil {
-		if ctx.Err() != context.Canceled {
-			ObserveAzureAPICallFailed(t1)
-		}
 		return nil, err
 	}
 
-	ObserveAzureAPICall(t1)
-
 	c.SetDefault(cacheKey, &group)
 
 	return &group, nil
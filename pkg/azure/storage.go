@@ -21,67 +21,14 @@ var (
 	cacheKeySubscriptionStorageAccountKeys       = `sub-%s-rg-%s-storageaccount-%s-keys`
 )
 
-var (
-	// AzureAPIStorageCallsTotal Total number of Azure Storage API calls
-	AzureAPIStorageCallsTotal = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Namespace: "azure_api",
-			Subsystem: "storage",
-			Name:      "calls_total",
-			Help:      "Total number of calls to the Azure API",
-		},
-		[]string{"subscription", "resource_group", "account"},
-	)
-
-	// AzureAPIStorageCallsFailedTotal Total number of failed Azure Storage API calls
-	AzureAPIStorageCallsFailedTotal = prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Namespace: "azure_api",
-			Subsystem: "storage",
-			Name:      "calls_failed_total",
-			Help:      "Total number of failed calls to the Azure API",
-		},
-		[]string{"subscription", "resource_group", "account"},
-	)
-
-	// AzureAPIStorageCallsDurationSecondsBuckets Histograms of Azure Storage API calls durations in seconds
-	AzureAPIStorageCallsDurationSecondsBuckets = prometheus.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Namespace: "azure_api",
-			Subsystem: "storage",
-			Name:      "calls_duration_seconds",
-			Help:      "Histograms of successful Azure Storage API calls durations in seconds",
-			Buckets:   []float64{0.02, 0.03, 0.04, 0.05, 0.10, 0.20, 0.30, 0.40, 0.50, 0.75, 1.0, 2.0},
-		},
-		[]string{"subscription", "resource_group", "account"},
-	)
-)
-
-func init() {
-	prometheus.MustRegister(AzureAPIStorageCallsTotal)
-	prometheus.MustRegister(AzureAPIStorageCallsFailedTotal)
-	prometheus.MustRegister(AzureAPIStorageCallsDurationSecondsBuckets)
-}
-
-// ObserveAzureStorageAPICall ...
-func ObserveAzureStorageAPICall(duration float64, labels ...string) {
-	AzureAPIStorageCallsTotal.WithLabelValues(labels...).Inc()
-	AzureAPIStorageCallsDurationSecondsBuckets.WithLabelValues(labels...).Observe(duration)
-}
-
-// ObserveAzureStorageAPICallFailed ...
-func ObserveAzureStorageAPICallFailed(duration float64, labels ...string) {
-	AzureAPIStorageCallsFailedTotal.WithLabelValues(labels...).Inc()
-}
-
 // ListSubscriptionStorageAccounts ...
-func ListSubscriptionStorageAccounts(ctx context.Context, clients *AzureClients, subscription *subscription.Model) (*[]storage.Account, error) {
+func ListSubscriptionStorageAccounts(ctx context.Context, clients *AzureClients, subscription *Subscription) (*[]storage.Account, error) {
 	c := cache.GetCache(5*time.Minute, time.Minute)
-	cacheKey := fmt.Sprintf(cacheKeySubscriptionStorageAccounts, subscription.SubscriptionID)
+	cacheKey := fmt.Sprintf(cacheKeySubscriptionStorageAccounts, *subscription.SubscriptionID)
 
 	contextLogger := log.WithFields(log.Fields{
 		"_id":          ctx.Value("id").(string),
-		"subscription": subscription.DisplayName,
+		"subscription": *subscription.DisplayName,
 	})
 
 	if caccounts, ok := c.Get(cacheKey); ok {
@@ -92,36 +39,39 @@ func ListSubscriptionStorageAccounts(ctx context.Context, clients *AzureClients,
 		}
 	}
 
-	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	ctx, cancel := context.WithTimeout(withOperation(ctx, "ListSubscriptionStorageAccounts"), 20*time.Second)
 	defer cancel()
 
-	client, err := clients.GetStorageAccountsClient(*subscription.SubscriptionID)
+	client, err := clients.GetStorageAccountsClient(subscription.Profile, *subscription.SubscriptionID)
 
 	if err != nil {
 		return nil, err
 	}
 
-	t0 := time.Now()
 	accounts, err := client.List(ctx)
-	t1 := time.Since(t0).Seconds()
 
 	if err != nil {
-		if ctx.Err() != context.Canceled {
-			ObserveAzureAPICallFailed(t1)
-		}
 		return nil, err
 	}
 
-	ObserveAzureAPICall(t1)
+	vals := make([]storage.Account, 0)
+	err = walkPages(ctx, &accounts, func(max int) int {
+		vals = append(vals, accounts.Values()...)
+		count := len(vals)
+		vals = vals[:capItems(count, max)]
+		return count
+	})
 
-	vals := accounts.Values()
+	if err != nil {
+		return nil, err
+	}
 	c.SetDefault(cacheKey, &vals)
 
 	return &vals, nil
 }
 
 // ListStorageAccountContainers ...
-func ListStorageAccountContainers(ctx context.Context, clients *AzureClients, subscription *subscription.Model, account *storage.Account) (*[]storage.ListContainerItem, error) {
+func ListStorageAccountContainers(ctx context.Context, clients *AzureClients, subscription *Subscription, account *storage.Account) (*[]storage.ListContainerItem, error) {
 	c := cache.GetCache(5*time.Minute, time.Minute)
 
 	accountDetails, _ := ParseResourceID(*account.ID)
@@ -146,38 +96,39 @@ func ListStorageAccountContainers(ctx context.Context, clients *AzureClients, su
 		}
 	}
 
-	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	ctx, cancel := context.WithTimeout(withOperation(ctx, "ListStorageAccountContainers"), 20*time.Second)
 	defer cancel()
 
-	client, err := clients.GetBlobContainersClient(*subscription.SubscriptionID)
+	client, err := clients.GetBlobContainersClient(subscription.Profile, *subscription.SubscriptionID)
 
 	if err != nil {
 		return nil, err
 	}
 
-	t0 := time.Now()
 	containers, err := client.List(ctx, accountDetails.ResourceGroup, *account.Name, "", "", "")
-	t1 := time.Since(t0).Seconds()
 
 	if err != nil {
-		if ctx.Err() != context.Canceled {
-			ObserveAzureAPICallFailed(t1)
-			ObserveAzureStorageAPICallFailed(t1, *subscription.DisplayName, accountDetails.ResourceGroup, *account.Name)
-		}
 		return nil, err
 	}
 
-	ObserveAzureAPICall(t1)
-	ObserveAzureStorageAPICall(t1, *subscription.DisplayName, accountDetails.ResourceGroup, *account.Name)
+	vals := make([]storage.ListContainerItem, 0)
+	err = walkPages(ctx, &containers, func(max int) int {
+		vals = append(vals, containers.Values()...)
+		count := len(vals)
+		vals = vals[:capItems(count, max)]
+		return count
+	})
 
-	vals := containers.Values()
+	if err != nil {
+		return nil, err
+	}
 	c.SetDefault(cacheKey, &vals)
 
 	return &vals, nil
 }
 
 // ListStorageAccountKeys ...
-func ListStorageAccountKeys(ctx context.Context, clients *AzureClients, subscription *subscription.Model, account *storage.Account) (*[]storage.AccountKey, error) {
+func ListStorageAccountKeys(ctx context.Context, clients *AzureClients, subscription *Subscription, account *storage.Account) (*[]storage.AccountKey, error) {
 	c := cache.GetCache(30*time.Second, time.Minute)
 
 	accountDetails, _ := ParseResourceID(*account.ID)
@@ -202,30 +153,21 @@ func ListStorageAccountKeys(ctx context.Context, clients *AzureClients, subscrip
 		}
 	}
 
-	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	ctx, cancel := context.WithTimeout(withOperation(ctx, "ListStorageAccountKeys"), 20*time.Second)
 	defer cancel()
 
-	client, err := clients.GetStorageAccountsClient(*subscription.SubscriptionID)
+	client, err := clients.GetStorageAccountsClient(subscription.Profile, *subscription.SubscriptionID)
 
 	if err != nil {
 		return nil, err
 	}
 
-	t0 := time.Now()
 	keys, err := client.ListKeys(ctx, accountDetails.ResourceGroup, *account.Name, "")
-	t1 := time.Since(t0).Seconds()
 
 	if err != nil {
-		if ctx.Err() != context.Canceled {
-			ObserveAzureAPICallFailed(t1)
-			ObserveAzureStorageAPICallFailed(t1, *subscription.DisplayName, accountDetails.ResourceGroup, *account.Name)
-		}
 		return nil, err
 	}
 
-	ObserveAzureAPICall(t1)
-	ObserveAzureStorageAPICall(t1, *subscription.DisplayName, accountDetails.ResourceGroup, *account.Name)
-
 	vals := *keys.Keys
 	c.SetDefault(cacheKey, &vals)
 
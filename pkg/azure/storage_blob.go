@@ -2,9 +2,7 @@ package azure
 
 import (
 	"context"
-	"fmt"
 	"net/url"
-	"time"
 
 	"github.com/Azure/azure-sdk-for-go/services/preview/subscription/mgmt/2018-03-01-preview/subscription"
 	"github.com/Azure/azure-sdk-for-go/services/resources/mgmt/2018-05-01/resources"
@@ -12,10 +10,6 @@ import (
 	"github.com/Azure/azure-storage-blob-go/azblob"
 )
 
-var (
-	blobFormatString = `https://%s.blob.core.windows.net`
-)
-
 // StorageAccountContainerWalker in an interface that is to be implemented by struct you want
 // to pass to Walking functions like WalkStorageAccount().
 type StorageAccountContainerWalker interface {
@@ -28,8 +22,14 @@ type StorageAccountContainerWalker interface {
 }
 
 // WalkStorageAccountContainer applies a function on all storage account container blobs.
-func WalkStorageAccountContainer(ctx context.Context, clients *AzureClients, subscription *subscription.Model, account *storage.Account, container *storage.ListContainerItem, walker StorageAccountContainerWalker) error {
-	token, err := GetStorageToken(ctx)
+func WalkStorageAccountContainer(ctx context.Context, clients *AzureClients, subscription *Subscription, account *storage.Account, container *storage.ListContainerItem, walker StorageAccountContainerWalker) error {
+	env, err := getEnvironment()
+
+	if err != nil {
+		return err
+	}
+
+	token, err := GetStorageToken(ctx, subscription.Profile)
 
 	if err != nil {
 		return err
@@ -43,12 +43,19 @@ func WalkStorageAccountContainer(ctx context.Context, clients *AzureClients, sub
 	}
 
 	// ADAL credentials
-	accessToken := token.Token().AccessToken
+	accessToken := token.OAuthToken()
 	credential := azblob.NewTokenCredential(accessToken, nil)
 
 	// Preparing browsing container.
-	pipeline := azblob.NewPipeline(credential, azblob.PipelineOptions{})
-	url, _ := url.Parse(fmt.Sprintf(blobFormatString, *account.Name))
+	pipeline := azblob.NewPipeline(credential, azblob.PipelineOptions{
+		HTTPSender: newBlobHTTPSender(),
+	})
+	url, err := url.Parse(env.GetBlobServiceURL(*account.Name))
+
+	if err != nil {
+		return err
+	}
+
 	serviceURL := azblob.NewServiceURL(*url, pipeline)
 	containerURL := serviceURL.NewContainerURL(*container.Name)
 
@@ -59,28 +66,23 @@ func WalkStorageAccountContainer(ctx context.Context, clients *AzureClients, sub
 		},
 	}
 
+	ctx = withOperation(ctx, "WalkStorageAccountContainer")
+
 	for i := 0; ; i++ {
-		t0 := time.Now()
 		list, err := containerURL.ListBlobsFlatSegment(ctx, marker, listOptions)
-		t1 := time.Since(t0).Seconds()
 
 		if err != nil {
-			if ctx.Err() != context.Canceled {
-				ObserveAzureAPICallFailed(t1)
-				ObserveAzureStorageAPICallFailed(t1, *subscription.DisplayName, *group.Name, *account.Name)
-			}
 			return err
 		}
 
-		ObserveAzureAPICall(t1)
-		ObserveAzureStorageAPICall(t1, *subscription.DisplayName, *group.Name, *account.Name)
+		AzureAPIListPagesTotal.WithLabelValues(operationFromContext(ctx)).Inc()
 
 		// Update request marker.
 		marker = list.NextMarker
 
 		walker.Lock()
 		for _, blob := range list.Segment.BlobItems {
-			walker.WalkBlob(subscription, group, account, container, &blob)
+			walker.WalkBlob(subscription.Model, group, account, container, &blob)
 		}
 		walker.Unlock()
 
@@ -2,48 +2,149 @@ package azure
 
 import (
 	"context"
+	"fmt"
 	"time"
 
-	"github.com/Azure/azure-sdk-for-go/services/preview/subscription/mgmt/2018-03-01-preview/subscription"
 	log "github.com/sirupsen/logrus"
 	"sylr.dev/libqd/cache"
 )
 
-// GetSubscription returns a subscription
-func GetSubscription(ctx context.Context, clients *AzureClients, subscriptionID string) (*subscription.Model, error) {
+const (
+	cacheKeySubscription     = `profile-%s-sub-%s`
+	cacheKeySubscriptions    = `profile-%s-subscriptions`
+	cacheKeySubscriptionTags = `profile-%s-sub-%s-tags`
+)
+
+// GetSubscription returns a subscription bound to the given credential profile
+func GetSubscription(ctx context.Context, clients *AzureClients, profile string, subscriptionID string) (*Subscription, error) {
 	c := cache.GetCache(30*time.Second, time.Minute)
+	cacheKey := fmt.Sprintf(cacheKeySubscription, profile, subscriptionID)
 
-	if csub, ok := c.Get(subscriptionID); ok {
-		if sub, ok := csub.(*subscription.Model); !ok {
-			log.WithField("subscription", subscriptionID).Errorf("Failed to cast object from cache back to *subscription.Model")
+	if csub, ok := c.Get(cacheKey); ok {
+		if sub, ok := csub.(*Subscription); !ok {
+			log.WithField("subscription", subscriptionID).Errorf("Failed to cast object from cache back to *Subscription")
 		} else {
 			return sub, nil
 		}
 	}
 
-	ctx, cancel := context.WithTimeout(ctx, 20*time.Second)
+	ctx, cancel := context.WithTimeout(withOperation(ctx, "GetSubscription"), 20*time.Second)
 	defer cancel()
 
-	client, err := clients.GetSubscriptionClient(subscriptionID)
+	client, err := clients.GetSubscriptionClient(profile, subscriptionID)
 
 	if err != nil {
 		return nil, err
 	}
 
-	t0 := time.Now()
 	sub, err := client.Get(ctx, subscriptionID)
-	t1 := time.Since(t0).Seconds()
 
 	if err != nil {
-		if ctx.Err() != context.Canceled {
-			ObserveAzureAPICallFailed(t1)
+		return nil, err
+	}
+
+	ret := &Subscription{
+		Model:   &sub,
+		Profile: profile,
+	}
+
+	c.SetDefault(cacheKey, ret)
+
+	return ret, nil
+}
+
+// ListSubscriptions returns all the subscriptions the principal of the given
+// credential profile has access to
+func ListSubscriptions(ctx context.Context, clients *AzureClients, profile string) (*[]Subscription, error) {
+	c := cache.GetCache(5*time.Minute, time.Minute)
+	cacheKey := fmt.Sprintf(cacheKeySubscriptions, profile)
+
+	contextLogger := log.WithFields(log.Fields{
+		"_id": ctx.Value("id").(string),
+	})
+
+	if csubs, ok := c.Get(cacheKey); ok {
+		if subs, ok := csubs.(*[]Subscription); !ok {
+			contextLogger.Errorf("Failed to cast object from cache back to *[]Subscription")
+		} else {
+			return subs, nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(withOperation(ctx, "ListSubscriptions"), 20*time.Second)
+	defer cancel()
+
+	client, err := clients.GetSubscriptionClient(profile, "")
+
+	if err != nil {
+		return nil, err
+	}
+
+	subs, err := client.List(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	vals := make([]Subscription, 0)
+	err = walkPages(ctx, &subs, func(max int) int {
+		for _, sub := range subs.Values() {
+			sub := sub
+			vals = append(vals, Subscription{
+				Model:   &sub,
+				Profile: profile,
+			})
+		}
+		count := len(vals)
+		vals = vals[:capItems(count, max)]
+		return count
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	c.SetDefault(cacheKey, &vals)
+
+	return &vals, nil
+}
+
+// GetSubscriptionTags returns the tags of a subscription, which are not part
+// of the subscription model.
+func GetSubscriptionTags(ctx context.Context, clients *AzureClients, subscription *Subscription) (map[string]*string, error) {
+	c := cache.GetCache(1*time.Hour, time.Minute)
+	cacheKey := fmt.Sprintf(cacheKeySubscriptionTags, subscription.Profile, *subscription.SubscriptionID)
+
+	if ctags, ok := c.Get(cacheKey); ok {
+		if tags, ok := ctags.(map[string]*string); !ok {
+			log.WithField("subscription", *subscription.SubscriptionID).Errorf("Failed to cast object from cache back to map[string]*string")
+		} else {
+			return tags, nil
 		}
+	}
+
+	ctx, cancel := context.WithTimeout(withOperation(ctx, "GetSubscriptionTags"), 20*time.Second)
+	defer cancel()
+
+	client, err := clients.GetTagsClient(subscription.Profile, *subscription.SubscriptionID)
+
+	if err != nil {
 		return nil, err
 	}
 
-	ObserveAzureAPICall(t1)
+	resource, err := client.GetAtScope(ctx, "subscriptions/"+*subscription.SubscriptionID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]*string)
+
+	if resource.Properties != nil && resource.Properties.Tags != nil {
+		tags = resource.Properties.Tags
+	}
 
-	c.SetDefault(subscriptionID, &sub)
+	c.SetDefault(cacheKey, tags)
 
-	return &sub, nil
+	return tags, nil
 }
@@ -0,0 +1,126 @@
+package azure
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// azureClientsGauge Number of Azure clients in the process wide pool
+	azureClientsGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "azure_exporter",
+			Subsystem: "",
+			Name:      "clients",
+			Help:      "Number of Azure API clients held in the shared client pool",
+		},
+		[]string{"type"},
+	)
+
+	// azureHTTPConnectionsTotal Number of HTTP connections used by Azure clients
+	azureHTTPConnectionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "azure_exporter",
+			Subsystem: "http",
+			Name:      "connections_total",
+			Help:      "Number of connections obtained to send Azure API requests, by whether they were reused from the idle pool",
+		},
+		[]string{"reused"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(azureClientsGauge)
+	prometheus.MustRegister(azureHTTPConnectionsTotal)
+}
+
+var (
+	// This var holds the HTTP client shared by all Azure clients so that
+	// connections are kept alive and reused between update runs.
+	httpClient = &http.Client{
+		Transport: &limitingTransport{limiter: requestLimiter, next: sharedTransport},
+	}
+
+	// This var holds the transport of the shared HTTP client.
+	sharedTransport = &tracingTransport{next: defaultTransport}
+
+	// This var holds the transport used to reach Azure endpoints.
+	defaultTransport = newTransport()
+)
+
+// newTransport returns the transport used to reach Azure endpoints. It keeps
+// more idle connections per host than http.DefaultTransport as most requests
+// go to a handful of hosts.
+func newTransport() *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   20,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+// tracingTransport counts new and reused connections. The transport it
+// forwards requests to can be replaced at any time.
+type tracingTransport struct {
+	mutex sync.RWMutex
+	next  http.RoundTripper
+}
+
+// setNext replaces the transport requests are forwarded to.
+func (t *tracingTransport) setNext(next http.RoundTripper) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.next = next
+}
+
+// getNext returns the transport requests are forwarded to.
+func (t *tracingTransport) getNext() http.RoundTripper {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	return t.next
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			azureHTTPConnectionsTotal.WithLabelValues(strconv.FormatBool(info.Reused)).Inc()
+		},
+	}
+
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	return t.getNext().RoundTrip(req)
+}
+
+// GetHTTPClient returns the HTTP client shared by all Azure clients.
+func GetHTTPClient() *http.Client {
+	return httpClient
+}
+
+// SetTransport replaces the transport used by the shared HTTP client to send
+// requests, e.g. to reach a fake Azure backend in tests.
+func SetTransport(next http.RoundTripper) {
+	sharedTransport.setNext(next)
+}
+
+// observeClientCreated accounts a client added to the shared client pool.
+func observeClientCreated(kind string) {
+	azureClientsGauge.WithLabelValues(kind).Inc()
+}
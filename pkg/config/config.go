@@ -4,15 +4,24 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"regexp"
+	"strings"
 	"time"
 
 	flags "github.com/jessevdk/go-flags"
 	log "github.com/sirupsen/logrus"
+	"github.com/sylr/prometheus-azure-exporter/pkg/cron"
 	"gopkg.in/yaml.v2"
 )
 
+const (
+	// DefaultProfile is the name of the credential profile built from
+	// AZURE_* environment variables.
+	DefaultProfile = "default"
+)
+
 var (
 	// ConfigFromFlagParser ...
 	ConfigFromFlagParser *PrometheusAzureExporterConfig
@@ -26,6 +35,18 @@ var (
 	AutoDiscoveryTagTrue = regexp.MustCompile(`^([Tt]rue|[Yy]es)$`)
 	// AutoDiscoveryTagFalse ...
 	AutoDiscoveryTagFalse = regexp.MustCompile(`^([Ff]alse|[Nn]o)$`)
+	// SubscriptionsModeStatic ...
+	SubscriptionsModeStatic = regexp.MustCompile(`^([Ss]tatic)$`)
+	// SubscriptionsModeAll ...
+	SubscriptionsModeAll = regexp.MustCompile(`^([Aa]ll)$`)
+	// CredentialMethod ...
+	CredentialMethod = regexp.MustCompile(`^(auto|client_secret|certificate|username_password|workload_identity|managed_identity|azure_cli)$`)
+	// OverlapPolicy ...
+	OverlapPolicy = regexp.MustCompile(`^(skip|queue-one|allow)$`)
+	// CollectionModeBackground ...
+	CollectionModeBackground = regexp.MustCompile(`^([Bb]ackground)?$`)
+	// CollectionModeScrape ...
+	CollectionModeScrape = regexp.MustCompile(`^([Ss]crape)$`)
 )
 
 // PrometheusAzureExporterConfig ...
@@ -41,6 +62,32 @@ type PrometheusAzureExporterConfig struct {
 	AutoDiscoveryMode string        `yaml:"autodiscovery_mode" short:"m"   long:"autodiscovery-mode"   description:"Which Azure resources should we pocess: All, Tagged" default:"All"`
 	AutoDiscoveryTag  string        `yaml:"autodiscovery_tag"  short:"t"   long:"autodiscovery-tag"    description:"If discovery mode set to Tagged we process Azure Resources with this tag set to True, If discovery mode set to All, resources with this tag set to False will be discarded" default:"prometheus_io_azure_exporter_discover"`
 
+	SubscriptionsMode        string `yaml:"subscriptions_mode"        long:"subscriptions-mode"        description:"Which subscriptions should we process: Static (the ones listed in the config file or AZURE_SUBSCRIPTION_ID), All (every subscription the principal can see)" default:"Static"`
+	SubscriptionsConcurrency uint   `yaml:"subscriptions_concurrency" long:"subscriptions-concurrency" description:"Number of subscriptions processed concurrently by update metrics functions" default:"4"`
+
+	RateLimitRequestsPerSecond float64 `yaml:"rate_limit_requests_per_second" long:"rate-limit-requests-per-second" description:"Number of Azure Resource Manager requests per second allowed per subscription and per tenant, 0 disables rate limiting" default:"10"`
+	RateLimitBurst             uint    `yaml:"rate_limit_burst"               long:"rate-limit-burst"               description:"Number of Azure Resource Manager requests which can be sent at once per subscription and per tenant" default:"50"`
+	RateLimitReserve           uint    `yaml:"rate_limit_reserve"             long:"rate-limit-reserve"             description:"Number of remaining requests reported by Azure below which requests are slowed down" default:"100"`
+
+	MaxConcurrentRequests uint `yaml:"max_concurrent_requests" long:"max-concurrent-requests" description:"Maximum number of Azure requests sent at the same time by all update metrics functions, 0 means no limit" default:"0"`
+
+	MaxListItems uint `yaml:"max_list_items" long:"max-list-items" description:"Maximum number of items returned by Azure list calls, 0 means no limit" default:"100000"`
+
+	RecordDir string `yaml:"record_dir" long:"record-dir" description:"Directory where Azure requests and responses are recorded with credentials redacted"`
+	ReplayDir string `yaml:"replay_dir" long:"replay-dir" description:"Directory of recorded Azure responses to serve instead of reaching Azure"`
+
+	AdminAPI bool `yaml:"admin_api" long:"admin-api" description:"Serve the admin API under /api/v1/ to inspect and trigger update metrics functions"`
+
+	CollectionMode      string        `yaml:"collection_mode"        long:"collection-mode"        description:"When update metrics functions run: Background (on their schedule), Scrape (when scraped if their metrics are old enough)" default:"Background"`
+	ScrapeMinRefreshAge time.Duration `yaml:"scrape_min_refresh_age" long:"scrape-min-refresh-age" description:"In Scrape collection mode, age of the metrics of update metrics functions without interval from which they are refreshed" default:"5m"`
+	ScrapeRefreshWait   time.Duration `yaml:"scrape_refresh_wait"    long:"scrape-refresh-wait"    description:"In Scrape collection mode, maximum time a scrape waits for refreshes before serving previous metrics" default:"10s"`
+
+	ShutdownGracePeriod time.Duration `yaml:"shutdown_grace_period" long:"shutdown-grace-period" description:"Time given to running update metrics functions and HTTP requests to complete on shutdown" default:"30s"`
+	StaleGracePeriod    time.Duration `yaml:"stale_grace_period"    long:"stale-grace-period"    description:"Time during which the last metrics of accounts which cannot be updated are still served" default:"1h"`
+
+	StorageCircuitBreakerThreshold uint `yaml:"storage_circuit_breaker_threshold" long:"storage-circuit-breaker-threshold" description:"Number of consecutive failed runs after which a storage account is skipped, 0 disables the circuit breaker" default:"3"`
+	StorageCircuitBreakerSkipRuns  uint `yaml:"storage_circuit_breaker_skip_runs"  long:"storage-circuit-breaker-skip-runs"  description:"Number of runs a failing storage account is skipped for" default:"5"`
+
 	// Env vars used for Azure Authent, see
 	// https://github.com/Azure/go-autorest/blob/v13.3.0/autorest/azure/auth/auth.go#L41-L51
 	AzureTenantID            string `env:"AZURE_TENANT_ID"              description:"Azure tenant id"`
@@ -54,13 +101,62 @@ type PrometheusAzureExporterConfig struct {
 	AzureEnvironment         string `env:"AZURE_ENVIRONMENT"            description:"Azure environment"`
 	AzureADResource          string `env:"AZURE_AD_RESOURCE"            description:"Azure AD resource"`
 
-	UpdateMetricsFunctions []UpdateMetricsFunctionConfig `yaml:"update_metrics_functions,omitempty"`
+	Endpoints               EndpointsConfig               `yaml:"endpoints,omitempty"`
+	CredentialProfiles      []CredentialProfileConfig     `yaml:"credential_profiles,omitempty"`
+	Subscriptions           []SubscriptionConfig          `yaml:"subscriptions,omitempty"`
+	GraphTenants            []GraphTenantConfig           `yaml:"graph_tenants,omitempty"`
+	UpdateMetricsFunctions  []UpdateMetricsFunctionConfig `yaml:"update_metrics_functions,omitempty"`
+	DiscoveryRules          []DiscoveryRuleConfig         `yaml:"discovery_rules,omitempty"`
+	DiscoveryTagsPrecedence []string                      `yaml:"discovery_tags_precedence,omitempty"`
+}
+
+// EndpointsConfig overrides the endpoints of the Azure environment.
+type EndpointsConfig struct {
+	ResourceManager string `yaml:"resource_manager,omitempty"`
+	ActiveDirectory string `yaml:"active_directory,omitempty"`
+	Graph           string `yaml:"graph,omitempty"`
+	Batch           string `yaml:"batch,omitempty"`
+	BatchAccount    string `yaml:"batch_account,omitempty"`
+	Blob            string `yaml:"blob,omitempty"`
+	Storage         string `yaml:"storage,omitempty"`
+}
+
+// CredentialProfileConfig ...
+type CredentialProfileConfig struct {
+	Name                string `yaml:"name,omitempty"`
+	TenantID            string `yaml:"tenant_id,omitempty"`
+	ClientID            string `yaml:"client_id,omitempty"`
+	ClientSecret        string `yaml:"client_secret,omitempty"`
+	CertificatePath     string `yaml:"certificate_path,omitempty"`
+	CertificatePassword string `yaml:"certificate_password,omitempty"`
+	Username            string `yaml:"username,omitempty"`
+	Password            string `yaml:"password,omitempty"`
+	FederatedTokenFile  string `yaml:"federated_token_file,omitempty"`
+	Method              string `yaml:"method,omitempty"`
+}
+
+// SubscriptionConfig ...
+type SubscriptionConfig struct {
+	ID      string `yaml:"id,omitempty"`
+	Profile string `yaml:"profile,omitempty"`
+}
+
+// GraphTenantConfig ...
+type GraphTenantConfig struct {
+	TenantID string `yaml:"tenant_id,omitempty"`
+	Profile  string `yaml:"profile,omitempty"`
 }
 
 // UpdateMetricsFunctionConfig ...
 type UpdateMetricsFunctionConfig struct {
-	Name     string        `yaml:"name,omitempty"`
-	Interval time.Duration `yaml:"interval,omitempty"`
+	Name        string        `yaml:"name,omitempty"`
+	Interval    time.Duration `yaml:"interval,omitempty"`
+	Cron        string        `yaml:"cron,omitempty"`
+	Overlap     string        `yaml:"overlap,omitempty"`
+	Timeout     time.Duration `yaml:"timeout,omitempty"`
+	Jitter      time.Duration `yaml:"jitter,omitempty"`
+	Backoff     time.Duration `yaml:"backoff,omitempty"`
+	Concurrency uint          `yaml:"concurrency,omitempty"`
 }
 
 // ParseConfigFile parses the config file defined by -f/--config
@@ -138,6 +234,25 @@ func ValidateConfig(conf *PrometheusAzureExporterConfig) []error {
 		errs = append(errs, errors.New("config: cannot change listening port"))
 	}
 
+	if CurrentConfig != nil && conf.CollectionMode != CurrentConfig.CollectionMode {
+		errs = append(errs, errors.New("config: cannot change collection mode"))
+	}
+
+	switch {
+	case CollectionModeBackground.MatchString(conf.CollectionMode):
+	case CollectionModeScrape.MatchString(conf.CollectionMode):
+		if conf.ScrapeMinRefreshAge <= 0 {
+			errs = append(errs, errors.New("config: scrape min refresh age must be greater than 0"))
+		}
+	default:
+		str := fmt.Sprintf("config: `%s` is not a valid collection mode", conf.CollectionMode)
+		errs = append(errs, errors.New(str))
+	}
+
+	if CurrentConfig != nil && conf.AdminAPI != CurrentConfig.AdminAPI {
+		errs = append(errs, errors.New("config: cannot change admin api"))
+	}
+
 	switch {
 	case AutoDiscoveryModeAll.MatchString(conf.AutoDiscoveryMode):
 	case AutoDiscoveryModeTagged.MatchString(conf.AutoDiscoveryMode):
@@ -146,9 +261,218 @@ func ValidateConfig(conf *PrometheusAzureExporterConfig) []error {
 		errs = append(errs, errors.New(str))
 	}
 
+	errs = append(errs, validateDiscoveryRules(conf.DiscoveryRules)...)
+	errs = append(errs, validateDiscoveryTagsPrecedence(conf.DiscoveryTagsPrecedence)...)
+
+	switch {
+	case SubscriptionsModeStatic.MatchString(conf.SubscriptionsMode):
+	case SubscriptionsModeAll.MatchString(conf.SubscriptionsMode):
+	default:
+		str := fmt.Sprintf("config: `%s` is not a valid subscriptions mode", conf.SubscriptionsMode)
+		errs = append(errs, errors.New(str))
+	}
+
+	if conf.SubscriptionsConcurrency == 0 {
+		errs = append(errs, errors.New("config: subscriptions concurrency must be greater than 0"))
+	}
+
+	if conf.RateLimitRequestsPerSecond < 0 {
+		errs = append(errs, errors.New("config: rate limit requests per second must not be negative"))
+	}
+
+	if conf.StaleGracePeriod < 0 {
+		errs = append(errs, errors.New("config: stale grace period must not be negative"))
+	}
+
+	if conf.RateLimitRequestsPerSecond > 0 && conf.RateLimitBurst == 0 {
+		errs = append(errs, errors.New("config: rate limit burst must be greater than 0"))
+	}
+
+	if len(conf.RecordDir) > 0 && len(conf.ReplayDir) > 0 {
+		errs = append(errs, errors.New("config: record dir and replay dir can not be set at the same time"))
+	}
+
+	errs = append(errs, validateEndpoints(conf.Endpoints)...)
+
+	profiles := map[string]bool{DefaultProfile: true}
+
+	for i, profile := range conf.CredentialProfiles {
+		if len(profile.Name) == 0 {
+			str := fmt.Sprintf("config: credential profile #%d has no name", i)
+			errs = append(errs, errors.New(str))
+		} else if profiles[profile.Name] && profile.Name != DefaultProfile {
+			str := fmt.Sprintf("config: credential profile `%s` is defined several times", profile.Name)
+			errs = append(errs, errors.New(str))
+		}
+
+		if len(profile.Method) > 0 && !CredentialMethod.MatchString(profile.Method) {
+			str := fmt.Sprintf("config: `%s` is not a valid credential method", profile.Method)
+			errs = append(errs, errors.New(str))
+		}
+
+		profiles[profile.Name] = true
+	}
+
+	for i, sub := range conf.Subscriptions {
+		if len(sub.ID) == 0 {
+			str := fmt.Sprintf("config: subscription #%d has no id", i)
+			errs = append(errs, errors.New(str))
+		}
+
+		if len(sub.Profile) > 0 && !profiles[sub.Profile] {
+			str := fmt.Sprintf("config: subscription `%s` uses unknown credential profile `%s`", sub.ID, sub.Profile)
+			errs = append(errs, errors.New(str))
+		}
+	}
+
+	for i, tenant := range conf.GraphTenants {
+		if len(tenant.Profile) > 0 && !profiles[tenant.Profile] {
+			str := fmt.Sprintf("config: graph tenant #%d uses unknown credential profile `%s`", i, tenant.Profile)
+			errs = append(errs, errors.New(str))
+		}
+	}
+
+	for i, function := range conf.UpdateMetricsFunctions {
+		if len(function.Name) == 0 {
+			str := fmt.Sprintf("config: update metrics function #%d has no name", i)
+			errs = append(errs, errors.New(str))
+		}
+
+		if len(function.Overlap) > 0 && !OverlapPolicy.MatchString(function.Overlap) {
+			str := fmt.Sprintf("config: `%s` is not a valid overlap policy", function.Overlap)
+			errs = append(errs, errors.New(str))
+		}
+
+		if function.Timeout < 0 || function.Jitter < 0 || function.Backoff < 0 {
+			str := fmt.Sprintf("config: update metrics function `%s` timeout, jitter and backoff must not be negative", function.Name)
+			errs = append(errs, errors.New(str))
+		}
+
+		if _, err := cron.Parse(function.Cron); len(function.Cron) > 0 && err != nil {
+			str := fmt.Sprintf("config: update metrics function `%s`: %v", function.Name, err)
+			errs = append(errs, errors.New(str))
+		}
+
+		if len(function.Cron) > 0 && function.Interval > 0 {
+			str := fmt.Sprintf("config: update metrics function `%s` can not have both an interval and a cron schedule", function.Name)
+			errs = append(errs, errors.New(str))
+		}
+
+		if function.Backoff > 0 && function.Backoff < function.Interval {
+			str := fmt.Sprintf("config: update metrics function `%s` backoff must be greater than its interval", function.Name)
+			errs = append(errs, errors.New(str))
+		}
+	}
+
+	return errs
+}
+
+// validateEndpoints checks that endpoint overrides are absolute URLs and that
+// URL templates contain a single %s placeholder.
+func validateEndpoints(endpoints EndpointsConfig) []error {
+	errs := make([]error, 0)
+
+	checks := []struct {
+		name     string
+		endpoint string
+		template bool
+	}{
+		{"resource_manager", endpoints.ResourceManager, false},
+		{"active_directory", endpoints.ActiveDirectory, false},
+		{"graph", endpoints.Graph, false},
+		{"batch", endpoints.Batch, false},
+		{"batch_account", endpoints.BatchAccount, true},
+		{"blob", endpoints.Blob, true},
+		{"storage", endpoints.Storage, false},
+	}
+
+	for _, check := range checks {
+		if len(check.endpoint) == 0 {
+			continue
+		}
+
+		endpoint := check.endpoint
+
+		if check.template {
+			if strings.Count(endpoint, "%s") != 1 {
+				str := fmt.Sprintf("config: endpoint %s `%s` must contain exactly one %%s", check.name, check.endpoint)
+				errs = append(errs, errors.New(str))
+				continue
+			}
+
+			endpoint = fmt.Sprintf(endpoint, "name")
+		}
+
+		if u, err := url.Parse(endpoint); err != nil || !u.IsAbs() {
+			str := fmt.Sprintf("config: endpoint %s `%s` is not an absolute URL", check.name, check.endpoint)
+			errs = append(errs, errors.New(str))
+		}
+	}
+
 	return errs
 }
 
+// GetProfileNames returns the names of the credential profiles defined in the
+// configuration or the default profile if none is defined.
+func (c *PrometheusAzureExporterConfig) GetProfileNames() []string {
+	names := make([]string, 0, len(c.CredentialProfiles))
+
+	for _, profile := range c.CredentialProfiles {
+		names = append(names, profile.Name)
+	}
+
+	if len(names) == 0 {
+		names = append(names, DefaultProfile)
+	}
+
+	return names
+}
+
+// GetSubscriptions returns the subscriptions statically defined in the
+// configuration. It falls back on AZURE_SUBSCRIPTION_ID if no subscription
+// is listed in the config file. Subscriptions without profile are bound to
+// the default profile.
+func (c *PrometheusAzureExporterConfig) GetSubscriptions() []SubscriptionConfig {
+	subs := make([]SubscriptionConfig, 0, len(c.Subscriptions))
+
+	for _, sub := range c.Subscriptions {
+		if len(sub.Profile) == 0 {
+			sub.Profile = DefaultProfile
+		}
+
+		subs = append(subs, sub)
+	}
+
+	if len(subs) == 0 {
+		if id := os.Getenv("AZURE_SUBSCRIPTION_ID"); len(id) > 0 {
+			subs = append(subs, SubscriptionConfig{ID: id, Profile: DefaultProfile})
+		}
+	}
+
+	return subs
+}
+
+// GetGraphTenants returns the tenants whose Graph API must be queried. It
+// defaults to the tenant of the default profile. Tenants without profile are
+// bound to the default profile.
+func (c *PrometheusAzureExporterConfig) GetGraphTenants() []GraphTenantConfig {
+	tenants := make([]GraphTenantConfig, 0, len(c.GraphTenants))
+
+	for _, tenant := range c.GraphTenants {
+		if len(tenant.Profile) == 0 {
+			tenant.Profile = DefaultProfile
+		}
+
+		tenants = append(tenants, tenant)
+	}
+
+	if len(tenants) == 0 {
+		tenants = append(tenants, GraphTenantConfig{Profile: DefaultProfile})
+	}
+
+	return tenants
+}
+
 // MustDiscoverBasedOnTags tags an map of tags returns True if the object
 // must be discovered based on autodiscovery mode.
 func MustDiscoverBasedOnTags(tags map[string]*string) bool {
@@ -2,6 +2,7 @@ package config
 
 import (
 	"testing"
+	"time"
 )
 
 func TestMustDiscoverBasedOnTags(t *testing.T) {
@@ -96,3 +97,154 @@ func TestMustDiscoverBasedOnTags(t *testing.T) {
 		t.Fatalf("Expected %v but got %v", false, b)
 	}
 }
+
+func TestGetSubscriptions(t *testing.T) {
+	t.Setenv("AZURE_SUBSCRIPTION_ID", "00000000-0000-0000-0000-000000000000")
+
+	// No subscription in config: fall back on AZURE_SUBSCRIPTION_ID
+	conf := &PrometheusAzureExporterConfig{}
+
+	if subs := conf.GetSubscriptions(); len(subs) != 1 || subs[0].ID != "00000000-0000-0000-0000-000000000000" || subs[0].Profile != DefaultProfile {
+		t.Fatalf("Expected %v but got %v", []SubscriptionConfig{{ID: "00000000-0000-0000-0000-000000000000", Profile: DefaultProfile}}, subs)
+	}
+
+	// Subscriptions in config take precedence over AZURE_SUBSCRIPTION_ID
+	conf = &PrometheusAzureExporterConfig{
+		Subscriptions: []SubscriptionConfig{
+			{ID: "11111111-1111-1111-1111-111111111111", Profile: "tenant-a"},
+			{ID: "22222222-2222-2222-2222-222222222222"},
+		},
+	}
+
+	subs := conf.GetSubscriptions()
+
+	if len(subs) != 2 || subs[0].ID != "11111111-1111-1111-1111-111111111111" {
+		t.Fatalf("Expected %v but got %v", conf.Subscriptions, subs)
+	}
+
+	if subs[0].Profile != "tenant-a" || subs[1].Profile != DefaultProfile {
+		t.Fatalf("Expected profiles %v but got %v", []string{"tenant-a", DefaultProfile}, subs)
+	}
+}
+
+func TestValidateConfigProfiles(t *testing.T) {
+	CurrentConfig = nil
+
+	conf := &PrometheusAzureExporterConfig{
+		AutoDiscoveryMode:        "All",
+		SubscriptionsMode:        "Static",
+		SubscriptionsConcurrency: 1,
+		CredentialProfiles: []CredentialProfileConfig{
+			{Name: "tenant-a"},
+		},
+		Subscriptions: []SubscriptionConfig{
+			{ID: "11111111-1111-1111-1111-111111111111", Profile: "tenant-a"},
+			{ID: "22222222-2222-2222-2222-222222222222"},
+		},
+	}
+
+	if errs := ValidateConfig(conf); len(errs) > 0 {
+		t.Fatalf("Expected no error but got %v", errs)
+	}
+
+	conf.Subscriptions[1].Profile = "tenant-b"
+
+	if errs := ValidateConfig(conf); len(errs) != 1 {
+		t.Fatalf("Expected 1 error but got %v", errs)
+	}
+}
+
+func TestValidateConfigEndpoints(t *testing.T) {
+	CurrentConfig = nil
+
+	conf := &PrometheusAzureExporterConfig{
+		AutoDiscoveryMode:        "All",
+		SubscriptionsMode:        "Static",
+		SubscriptionsConcurrency: 1,
+		Endpoints: EndpointsConfig{
+			ResourceManager: "https://management.chinacloudapi.cn/",
+			Blob:            "http://127.0.0.1:10000/%s",
+		},
+	}
+
+	if errs := ValidateConfig(conf); len(errs) > 0 {
+		t.Fatalf("Expected no error but got %v", errs)
+	}
+
+	conf.Endpoints.Blob = "http://127.0.0.1:10000/devstoreaccount1"
+	conf.Endpoints.Graph = "graph.chinacloudapi.cn"
+
+	if errs := ValidateConfig(conf); len(errs) != 2 {
+		t.Fatalf("Expected 2 errors but got %v", errs)
+	}
+}
+
+func TestValidateConfigUpdateMetricsFunctions(t *testing.T) {
+	CurrentConfig = nil
+
+	conf := &PrometheusAzureExporterConfig{
+		AutoDiscoveryMode:        "All",
+		SubscriptionsMode:        "Static",
+		SubscriptionsConcurrency: 1,
+		UpdateMetricsFunctions: []UpdateMetricsFunctionConfig{
+			{Name: "storage", Interval: time.Hour, Timeout: 2 * time.Hour, Jitter: time.Minute, Backoff: 6 * time.Hour},
+		},
+	}
+
+	if errs := ValidateConfig(conf); len(errs) > 0 {
+		t.Fatalf("Expected no error but got %v", errs)
+	}
+
+	conf.UpdateMetricsFunctions[0].Jitter = -time.Minute
+	conf.UpdateMetricsFunctions[0].Backoff = time.Minute
+
+	if errs := ValidateConfig(conf); len(errs) != 2 {
+		t.Fatalf("Expected 2 errors but got %v", errs)
+	}
+
+	conf.UpdateMetricsFunctions = []UpdateMetricsFunctionConfig{
+		{Name: "storage", Cron: "0 2 * * *"},
+	}
+
+	if errs := ValidateConfig(conf); len(errs) > 0 {
+		t.Fatalf("Expected no error but got %v", errs)
+	}
+
+	conf.UpdateMetricsFunctions[0].Cron = "0 25 * * *"
+	conf.UpdateMetricsFunctions[0].Interval = time.Hour
+
+	if errs := ValidateConfig(conf); len(errs) != 2 {
+		t.Fatalf("Expected 2 errors but got %v", errs)
+	}
+}
+
+func TestValidateConfigCollectionMode(t *testing.T) {
+	CurrentConfig = nil
+
+	conf := &PrometheusAzureExporterConfig{
+		AutoDiscoveryMode:        "All",
+		SubscriptionsMode:        "Static",
+		SubscriptionsConcurrency: 1,
+		CollectionMode:           "Scrape",
+		ScrapeMinRefreshAge:      5 * time.Minute,
+	}
+
+	if errs := ValidateConfig(conf); len(errs) > 0 {
+		t.Fatalf("Expected no error but got %v", errs)
+	}
+
+	CurrentConfig = &PrometheusAzureExporterConfig{CollectionMode: "Background"}
+	defer func() { CurrentConfig = nil }()
+
+	conf.ScrapeMinRefreshAge = 0
+
+	if errs := ValidateConfig(conf); len(errs) != 2 {
+		t.Fatalf("Expected 2 errors but got %v", errs)
+	}
+
+	conf.CollectionMode = "Lazy"
+
+	if errs := ValidateConfig(conf); len(errs) != 2 {
+		t.Fatalf("Expected 2 errors but got %v", errs)
+	}
+}
@@ -0,0 +1,281 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// DiscoveryTagsResource is the source of the tags of the resource.
+	DiscoveryTagsResource = "resource"
+	// DiscoveryTagsResourceGroup is the source of the tags of the resource
+	// group of the resource.
+	DiscoveryTagsResourceGroup = "resource_group"
+	// DiscoveryTagsSubscription is the source of the tags of the subscription
+	// of the resource.
+	DiscoveryTagsSubscription = "subscription"
+)
+
+var (
+	// DiscoveryActionInclude ...
+	DiscoveryActionInclude = regexp.MustCompile(`^([Ii]nclude)$`)
+	// DiscoveryActionExclude ...
+	DiscoveryActionExclude = regexp.MustCompile(`^([Ee]xclude)$`)
+)
+
+// DiscoveryRuleConfig includes or excludes the resources matching all its
+// conditions. Empty conditions match every resource.
+type DiscoveryRuleConfig struct {
+	Action        string                   `yaml:"action"`
+	ResourceGroup string                   `yaml:"resource_group,omitempty"`
+	Name          string                   `yaml:"name,omitempty"`
+	Location      string                   `yaml:"location,omitempty"`
+	Type          string                   `yaml:"type,omitempty"`
+	Tags          []DiscoveryTagRuleConfig `yaml:"tags,omitempty"`
+
+	resourceGroupRegexp *regexp.Regexp
+	nameRegexp          *regexp.Regexp
+	compiled            bool
+}
+
+// DiscoveryTagRuleConfig matches resources having the tag `key`, with the
+// value `equals` or a value matching `matches` if set.
+type DiscoveryTagRuleConfig struct {
+	Key     string `yaml:"key"`
+	Equals  string `yaml:"equals,omitempty"`
+	Matches string `yaml:"matches,omitempty"`
+
+	matchesRegexp *regexp.Regexp
+}
+
+// DiscoveryResource is an Azure resource discovery rules apply to.
+type DiscoveryResource struct {
+	ResourceGroup     string
+	Name              string
+	Location          string
+	Type              string
+	Tags              map[string]*string
+	ResourceGroupTags map[string]*string
+	SubscriptionTags  map[string]*string
+}
+
+// inheritedTags returns the tags of the resource merged with the ones of its
+// resource group and subscription, the first source of precedence having a
+// tag gives its value.
+func (r DiscoveryResource) inheritedTags(precedence []string) map[string]*string {
+	tags := make(map[string]*string)
+
+	for i := len(precedence) - 1; i >= 0; i-- {
+		var source map[string]*string
+
+		switch precedence[i] {
+		case DiscoveryTagsResource:
+			source = r.Tags
+		case DiscoveryTagsResourceGroup:
+			source = r.ResourceGroupTags
+		case DiscoveryTagsSubscription:
+			source = r.SubscriptionTags
+		}
+
+		for k, v := range source {
+			tags[k] = v
+		}
+	}
+
+	return tags
+}
+
+// DiscoveryTagsPrecedence returns the sources of the tags discovery applies
+// to, from the one with the highest precedence. Only the tags of the
+// resources are used by default.
+func DiscoveryTagsPrecedence() []string {
+	if CurrentConfig == nil || len(CurrentConfig.DiscoveryTagsPrecedence) == 0 {
+		return []string{DiscoveryTagsResource}
+	}
+
+	return CurrentConfig.DiscoveryTagsPrecedence
+}
+
+// compile compiles the regular expressions of the rule.
+func (r *DiscoveryRuleConfig) compile() error {
+	var err error
+
+	if len(r.ResourceGroup) > 0 {
+		if r.resourceGroupRegexp, err = regexp.Compile(r.ResourceGroup); err != nil {
+			return fmt.Errorf("invalid resource group regexp: %v", err)
+		}
+	}
+
+	if len(r.Name) > 0 {
+		if r.nameRegexp, err = regexp.Compile(r.Name); err != nil {
+			return fmt.Errorf("invalid name regexp: %v", err)
+		}
+	}
+
+	for i := range r.Tags {
+		if len(r.Tags[i].Key) == 0 {
+			return errors.New("tag key must not be empty")
+		}
+
+		if len(r.Tags[i].Equals) > 0 && len(r.Tags[i].Matches) > 0 {
+			return fmt.Errorf("tag `%s` cannot have both equals and matches", r.Tags[i].Key)
+		}
+
+		if len(r.Tags[i].Matches) > 0 {
+			if r.Tags[i].matchesRegexp, err = regexp.Compile(r.Tags[i].Matches); err != nil {
+				return fmt.Errorf("invalid tag `%s` regexp: %v", r.Tags[i].Key, err)
+			}
+		}
+	}
+
+	r.compiled = true
+
+	return nil
+}
+
+// match returns true if resource matches all the conditions of the rule.
+func (r *DiscoveryRuleConfig) match(resource DiscoveryResource) bool {
+	// Rules of configs which have not been validated
+	if !r.compiled {
+		c := *r
+
+		if err := c.compile(); err != nil {
+			return false
+		}
+
+		return c.match(resource)
+	}
+
+	if r.resourceGroupRegexp != nil && !r.resourceGroupRegexp.MatchString(resource.ResourceGroup) {
+		return false
+	}
+
+	if r.nameRegexp != nil && !r.nameRegexp.MatchString(resource.Name) {
+		return false
+	}
+
+	// Locations are written `westeurope` or `West Europe`.
+	if len(r.Location) > 0 && !strings.EqualFold(normalizeLocation(r.Location), normalizeLocation(resource.Location)) {
+		return false
+	}
+
+	if len(r.Type) > 0 && !strings.EqualFold(r.Type, resource.Type) {
+		return false
+	}
+
+	for _, tag := range r.Tags {
+		if !tag.match(resource.Tags) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// match returns true if tags satisfy the tag rule.
+func (t *DiscoveryTagRuleConfig) match(tags map[string]*string) bool {
+	val, ok := tags[t.Key]
+
+	if !ok {
+		return false
+	}
+
+	value := ""
+	if val != nil {
+		value = *val
+	}
+
+	switch {
+	case len(t.Equals) > 0:
+		return value == t.Equals
+	case t.matchesRegexp != nil:
+		return t.matchesRegexp.MatchString(value)
+	}
+
+	return true
+}
+
+// normalizeLocation removes the spaces of an Azure location.
+func normalizeLocation(location string) string {
+	return strings.ReplaceAll(location, " ", "")
+}
+
+// validateDiscoveryTagsPrecedence returns the errors of precedence. The tags
+// of the resources must have the highest precedence so that they can always
+// override the inherited ones.
+func validateDiscoveryTagsPrecedence(precedence []string) []error {
+	errs := make([]error, 0)
+	seen := make(map[string]bool)
+
+	for _, source := range precedence {
+		switch source {
+		case DiscoveryTagsResource, DiscoveryTagsResourceGroup, DiscoveryTagsSubscription:
+		default:
+			str := fmt.Sprintf("config: `%s` is not a valid discovery tags source", source)
+			errs = append(errs, errors.New(str))
+		}
+
+		if seen[source] {
+			str := fmt.Sprintf("config: discovery tags source `%s` is listed several times", source)
+			errs = append(errs, errors.New(str))
+		}
+
+		seen[source] = true
+	}
+
+	switch {
+	case len(precedence) == 0:
+	case !seen[DiscoveryTagsResource]:
+		str := fmt.Sprintf("config: discovery tags source `%s` is missing", DiscoveryTagsResource)
+		errs = append(errs, errors.New(str))
+	case precedence[0] != DiscoveryTagsResource:
+		str := fmt.Sprintf("config: discovery tags source `%s` must be listed first", DiscoveryTagsResource)
+		errs = append(errs, errors.New(str))
+	}
+
+	return errs
+}
+
+// validateDiscoveryRules returns the errors of rules and compiles them.
+func validateDiscoveryRules(rules []DiscoveryRuleConfig) []error {
+	errs := make([]error, 0)
+
+	for i := range rules {
+		switch {
+		case DiscoveryActionInclude.MatchString(rules[i].Action):
+		case DiscoveryActionExclude.MatchString(rules[i].Action):
+		default:
+			str := fmt.Sprintf("config: discovery rule %d: `%s` is not a valid action", i, rules[i].Action)
+			errs = append(errs, errors.New(str))
+		}
+
+		if err := rules[i].compile(); err != nil {
+			str := fmt.Sprintf("config: discovery rule %d: %v", i, err)
+			errs = append(errs, errors.New(str))
+		}
+	}
+
+	return errs
+}
+
+// MustDiscover returns true if resource must be processed. The first
+// discovery rule matching resource decides, resources matching no rule are
+// discovered according to the autodiscovery mode and tag. Tags are inherited
+// according to DiscoveryTagsPrecedence().
+func MustDiscover(resource DiscoveryResource) bool {
+	resource.Tags = resource.inheritedTags(DiscoveryTagsPrecedence())
+
+	if CurrentConfig != nil {
+		for i := range CurrentConfig.DiscoveryRules {
+			rule := &CurrentConfig.DiscoveryRules[i]
+
+			if rule.match(resource) {
+				return DiscoveryActionInclude.MatchString(rule.Action)
+			}
+		}
+	}
+
+	return MustDiscoverBasedOnTags(resource.Tags)
+}
@@ -0,0 +1,152 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestMustDiscover(t *testing.T) {
+	prod := "prod"
+	team := "data-platform"
+
+	CurrentConfig = &PrometheusAzureExporterConfig{
+		AutoDiscoveryMode:        "All",
+		AutoDiscoveryTag:         "prometheus_io_azure_exporter_discover",
+		SubscriptionsMode:        "Static",
+		SubscriptionsConcurrency: 1,
+		DiscoveryRules: []DiscoveryRuleConfig{
+			{Action: "exclude", Name: "^tmp"},
+			{Action: "include", Tags: []DiscoveryTagRuleConfig{{Key: "env", Equals: "prod"}}},
+			{Action: "include", ResourceGroup: "^rg-data-", Location: "West Europe"},
+			{Action: "include", Type: "microsoft.batch/batchaccounts", Tags: []DiscoveryTagRuleConfig{{Key: "team", Matches: "^data-"}}},
+			{Action: "exclude", Tags: []DiscoveryTagRuleConfig{{Key: "team"}}},
+		},
+	}
+	defer func() { CurrentConfig = nil }()
+
+	if errs := ValidateConfig(CurrentConfig); len(errs) > 0 {
+		t.Fatalf("Expected no error but got %v", errs)
+	}
+
+	tests := []struct {
+		resource DiscoveryResource
+		expected bool
+	}{
+		// first rule wins
+		{DiscoveryResource{Name: "tmpaccount", Tags: map[string]*string{"env": &prod}}, false},
+		{DiscoveryResource{Name: "account", Tags: map[string]*string{"env": &prod}}, true},
+		// resource group and location
+		{DiscoveryResource{Name: "account", ResourceGroup: "rg-data-1", Location: "westeurope", Tags: map[string]*string{"team": &team}}, true},
+		{DiscoveryResource{Name: "account", ResourceGroup: "rg-data-1", Location: "northeurope", Tags: map[string]*string{"team": &team}}, false},
+		// type and tag regexp
+		{DiscoveryResource{Name: "account", Type: "Microsoft.Batch/batchAccounts", Tags: map[string]*string{"team": &team}}, true},
+		{DiscoveryResource{Name: "account", Type: "Microsoft.Storage/storageAccounts", Tags: map[string]*string{"team": &team}}, false},
+		// no rule matches, autodiscovery mode applies
+		{DiscoveryResource{Name: "account"}, true},
+	}
+
+	for i, test := range tests {
+		if b := MustDiscover(test.resource); b != test.expected {
+			t.Fatalf("Expected %v but got %v for test %d", test.expected, b, i)
+		}
+	}
+}
+
+func TestValidateConfigDiscoveryRules(t *testing.T) {
+	CurrentConfig = nil
+
+	conf := &PrometheusAzureExporterConfig{
+		AutoDiscoveryMode:        "All",
+		SubscriptionsMode:        "Static",
+		SubscriptionsConcurrency: 1,
+		DiscoveryRules: []DiscoveryRuleConfig{
+			{Action: "skip"},
+			{Action: "include", Name: "("},
+			{Action: "exclude", Tags: []DiscoveryTagRuleConfig{{Key: "env", Equals: "prod", Matches: "prod"}}},
+			{Action: "exclude", Tags: []DiscoveryTagRuleConfig{{Equals: "prod"}}},
+		},
+	}
+
+	if errs := ValidateConfig(conf); len(errs) != 4 {
+		t.Fatalf("Expected 4 errors but got %v", errs)
+	}
+}
+
+func TestMustDiscoverInheritedTags(t *testing.T) {
+	yes := "true"
+	no := "false"
+	prod := "prod"
+	dev := "dev"
+
+	CurrentConfig = &PrometheusAzureExporterConfig{
+		AutoDiscoveryMode:        "Tagged",
+		AutoDiscoveryTag:         "prometheus_io_azure_exporter_discover",
+		SubscriptionsMode:        "Static",
+		SubscriptionsConcurrency: 1,
+		DiscoveryRules: []DiscoveryRuleConfig{
+			{Action: "exclude", Tags: []DiscoveryTagRuleConfig{{Key: "env", Equals: "dev"}}},
+		},
+	}
+	defer func() { CurrentConfig = nil }()
+
+	if errs := ValidateConfig(CurrentConfig); len(errs) > 0 {
+		t.Fatalf("Expected no error but got %v", errs)
+	}
+
+	tests := []struct {
+		precedence []string
+		resource   DiscoveryResource
+		expected   bool
+	}{
+		// resource group and subscription tags are ignored by default
+		{nil, DiscoveryResource{ResourceGroupTags: map[string]*string{"prometheus_io_azure_exporter_discover": &yes}}, false},
+		// autodiscovery tag inherited from the resource group
+		{[]string{"resource", "resource_group"}, DiscoveryResource{ResourceGroupTags: map[string]*string{"prometheus_io_azure_exporter_discover": &yes}}, true},
+		// resource tag overrides resource group tag
+		{[]string{"resource", "resource_group"}, DiscoveryResource{Tags: map[string]*string{"prometheus_io_azure_exporter_discover": &no}, ResourceGroupTags: map[string]*string{"prometheus_io_azure_exporter_discover": &yes}}, false},
+		// resource group tag overrides subscription tag
+		{[]string{"resource", "resource_group", "subscription"}, DiscoveryResource{Tags: map[string]*string{"prometheus_io_azure_exporter_discover": &yes}, ResourceGroupTags: map[string]*string{"env": &prod}, SubscriptionTags: map[string]*string{"env": &dev}}, true},
+		{[]string{"resource", "subscription", "resource_group"}, DiscoveryResource{Tags: map[string]*string{"prometheus_io_azure_exporter_discover": &yes}, ResourceGroupTags: map[string]*string{"env": &prod}, SubscriptionTags: map[string]*string{"env": &dev}}, false},
+		// discovery rules apply to inherited tags
+		{[]string{"resource", "subscription"}, DiscoveryResource{Tags: map[string]*string{"prometheus_io_azure_exporter_discover": &yes}, SubscriptionTags: map[string]*string{"env": &dev}}, false},
+	}
+
+	for i, test := range tests {
+		CurrentConfig.DiscoveryTagsPrecedence = test.precedence
+
+		if b := MustDiscover(test.resource); b != test.expected {
+			t.Fatalf("Expected %v but got %v for test %d", test.expected, b, i)
+		}
+	}
+}
+
+func TestValidateConfigDiscoveryTagsPrecedence(t *testing.T) {
+	CurrentConfig = nil
+
+	conf := &PrometheusAzureExporterConfig{
+		AutoDiscoveryMode:        "All",
+		SubscriptionsMode:        "Static",
+		SubscriptionsConcurrency: 1,
+	}
+
+	tests := []struct {
+		precedence []string
+		expected   int
+	}{
+		{nil, 0},
+		{[]string{"resource", "resource_group", "subscription"}, 0},
+		// unknown and repeated sources
+		{[]string{"resource", "tenant", "resource_group", "resource"}, 2},
+		// resource tags would be dropped
+		{[]string{"resource_group", "subscription"}, 1},
+		// resource tags would be overridden by resource group tags
+		{[]string{"resource_group", "resource"}, 1},
+	}
+
+	for i, test := range tests {
+		conf.DiscoveryTagsPrecedence = test.precedence
+
+		if errs := ValidateConfig(conf); len(errs) != test.expected {
+			t.Fatalf("Expected %d errors but got %v for test %d", test.expected, errs, i)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fieldRange describes the range of a field of a cron expression.
+type fieldRange struct {
+	name string
+	min  int
+	max  int
+}
+
+var (
+	fieldRanges = []fieldRange{
+		{"minute", 0, 59},
+		{"hour", 0, 23},
+		{"day of month", 1, 31},
+		{"month", 1, 12},
+		{"day of week", 0, 7},
+	}
+)
+
+// Schedule is a schedule parsed from a standard 5 fields cron expression
+// (minute, hour, day of month, month, day of week). Fields accept `*`, values,
+// ranges `a-b`, steps `*/n`, `a-b/n` and lists of them separated by commas.
+// Times are matched in the location of the time given to Next().
+type Schedule struct {
+	expr   string
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	// Whether day of month and day of week are restricted, in which case a
+	// day matches if any of them does.
+	domRestricted bool
+	dowRestricted bool
+}
+
+// Parse parses a 5 fields cron expression.
+func Parse(expr string) (*Schedule, error) {
+	fields := strings.Fields(expr)
+
+	if len(fields) != len(fieldRanges) {
+		return nil, fmt.Errorf("cron expression `%s` must have %d fields", expr, len(fieldRanges))
+	}
+
+	sets := make([]uint64, len(fields))
+
+	for i, field := range fields {
+		set, err := parseField(field, fieldRanges[i])
+
+		if err != nil {
+			return nil, fmt.Errorf("cron expression `%s`: %v", expr, err)
+		}
+
+		sets[i] = set
+	}
+
+	schedule := &Schedule{
+		expr:          expr,
+		minute:        sets[0],
+		hour:          sets[1],
+		dom:           sets[2],
+		month:         sets[3],
+		dow:           sets[4],
+		domRestricted: !strings.HasPrefix(fields[2], "*"),
+		dowRestricted: !strings.HasPrefix(fields[4], "*"),
+	}
+
+	// Sunday is both 0 and 7.
+	if schedule.dow&(1<<7) != 0 {
+		schedule.dow |= 1
+	}
+
+	return schedule, nil
+}
+
+// parseField returns the set of values of a field as a bitset.
+func parseField(field string, desc fieldRange) (uint64, error) {
+	set := uint64(0)
+
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step `%s` in %s field", part[i+1:], desc.name)
+			}
+
+			rng, step = part[:i], n
+		}
+
+		start, end := desc.min, desc.max
+
+		switch {
+		case rng == "*":
+		case strings.Contains(rng, "-"):
+			bounds := strings.SplitN(rng, "-", 2)
+			var err error
+
+			if start, err = parseValue(bounds[0], desc); err != nil {
+				return 0, err
+			}
+
+			if end, err = parseValue(bounds[1], desc); err != nil {
+				return 0, err
+			}
+
+			if start > end {
+				return 0, fmt.Errorf("invalid range `%s` in %s field", rng, desc.name)
+			}
+		default:
+			value, err := parseValue(rng, desc)
+
+			if err != nil {
+				return 0, err
+			}
+
+			// `a/n` means from a to the end of the range.
+			start = value
+
+			if step == 1 {
+				end = value
+			}
+		}
+
+		for v := start; v <= end; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+
+	return set, nil
+}
+
+// parseValue parses a value of a field and checks its range.
+func parseValue(value string, desc fieldRange) (int, error) {
+	v, err := strconv.Atoi(value)
+
+	if err != nil || v < desc.min || v > desc.max {
+		return 0, fmt.Errorf("invalid value `%s` in %s field, expected %d-%d", value, desc.name, desc.min, desc.max)
+	}
+
+	return v, nil
+}
+
+// String returns the cron expression of the schedule.
+func (c *Schedule) String() string {
+	return c.expr
+}
+
+// Next returns the first time matching the schedule strictly after t, or the
+// zero time if there is none in the next five years.
+func (c *Schedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+		case !c.matchDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+
+	return time.Time{}
+}
+
+// matchDay returns true if the day of t matches the day of month and day of
+// week fields.
+func (c *Schedule) matchDay(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+
+	if c.domRestricted && c.dowRestricted {
+		return dom || dow
+	}
+
+	return dom && dow
+}
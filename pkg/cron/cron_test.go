@@ -0,0 +1,68 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		expr  string
+		valid bool
+	}{
+		{"* * * * *", true},
+		{"0 2 * * *", true},
+		{"*/15 1-5,22 1 */3 1-5", true},
+		{"30 4 * * 7", true},
+		{"5/10 * * * *", true},
+		{"* * * *", false},
+		{"60 * * * *", false},
+		{"* 24 * * *", false},
+		{"* * 0 * *", false},
+		{"*/0 * * * *", false},
+		{"5-1 * * * *", false},
+		{"a * * * *", false},
+	}
+
+	for _, test := range tests {
+		if _, err := Parse(test.expr); (err == nil) != test.valid {
+			t.Fatalf("Expected %v but got %v for %s", test.valid, err, test.expr)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	// Wednesday
+	now := time.Date(2020, 1, 1, 10, 30, 15, 0, time.UTC)
+
+	tests := []struct {
+		expr     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2020, 1, 1, 10, 31, 0, 0, time.UTC)},
+		{"30 10 * * *", time.Date(2020, 1, 2, 10, 30, 0, 0, time.UTC)},
+		{"0 2 * * *", time.Date(2020, 1, 2, 2, 0, 0, 0, time.UTC)},
+		{"*/20 * * * *", time.Date(2020, 1, 1, 10, 40, 0, 0, time.UTC)},
+		{"0 0 * * 0", time.Date(2020, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2020, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 3 *", time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Day of month or day of week when both are restricted.
+		{"0 0 15 * 5", time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC)},
+		// Day of week only when day of month is a wildcard step.
+		{"0 0 */2 * 5", time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+	}
+
+	for _, test := range tests {
+		schedule, err := Parse(test.expr)
+
+		if err != nil {
+			t.Fatalf("Expected no error but got %v", err)
+		}
+
+		if got := schedule.Next(now); !got.Equal(test.expected) {
+			t.Fatalf("Expected %v but got %v for %s", test.expected, got, test.expr)
+		}
+	}
+}
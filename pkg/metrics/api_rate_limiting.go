@@ -2,7 +2,6 @@ package metrics
 
 import (
 	"context"
-	"os"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -10,6 +9,10 @@ import (
 )
 
 func init() {
+	// Metrics are registered by pkg/azure, they are refreshed when the
+	// function is collected on demand but only exposed by the next scrape.
+	RegisterUpdateMetricsFunctionCollectors("api_rate_limiting")
+
 	if GetUpdateMetricsFunctionInterval("api_rate_limiting") == nil {
 		RegisterUpdateMetricsFunctionWithInterval("api_rate_limiting", UpdateAPIRateLimitingMetrics, 30*time.Second)
 	}
@@ -17,8 +20,6 @@ func init() {
 
 // UpdateAPIRateLimitingMetrics updates api metrics.
 func UpdateAPIRateLimitingMetrics(ctx context.Context) error {
-	var err error
-
 	contextLogger := log.WithFields(log.Fields{
 		"_id":   ctx.Value("id").(string),
 		"_func": "UpdateApiRateLimitingMetrics",
@@ -36,31 +37,40 @@ func UpdateAPIRateLimitingMetrics(ctx context.Context) error {
 	// - pkg/azure/azure.go   -> SetReadRateLimitRemaining()
 	//                           SetWriteRateLimitRemaining()
 
-	azureClients := azure.NewAzureClients()
-	sub, err := azure.GetSubscription(ctx, azureClients, os.Getenv("AZURE_SUBSCRIPTION_ID"))
+	failures := NewFailures()
+	azureClients := azure.GetAzureClients()
+	subs, err := listSubscriptions(ctx, azureClients, failures)
 
 	if err != nil {
-		contextLogger.Errorf("Unable to get subscription: %s", err)
+		contextLogger.Errorf("Unable to list subscriptions: %s", err)
 		return err
 	}
 
-	storageAccounts, err := azure.ListSubscriptionStorageAccounts(ctx, azureClients, sub)
+	err = forEachSubscription(ctx, "api_rate_limiting", subs, failures, func(ctx context.Context, sub *azure.Subscription) error {
+		subscriptionLogger := contextLogger.WithFields(log.Fields{
+			"subscription": *sub.DisplayName,
+		})
 
-	if err != nil {
-		contextLogger.Errorf("Unable to list account azure storage accounts: %s", err)
-		return err
-	}
-
-	// Loop over storage accounts.
-	for accountKey := range *storageAccounts {
-		_, err := azure.ListStorageAccountKeys(ctx, azureClients, sub, &(*storageAccounts)[accountKey])
+		storageAccounts, err := azure.ListSubscriptionStorageAccounts(ctx, azureClients, sub)
 
 		if err != nil {
-			contextLogger.Error(err)
-		} else {
-			break
+			subscriptionLogger.Errorf("Unable to list account azure storage accounts: %s", err)
+			return err
 		}
-	}
+
+		// Loop over storage accounts.
+		for accountKey := range *storageAccounts {
+			_, err = azure.ListStorageAccountKeys(ctx, azureClients, sub, &(*storageAccounts)[accountKey])
+
+			if err != nil {
+				subscriptionLogger.Error(err)
+			} else {
+				break
+			}
+		}
+
+		return err
+	})
 
 	return err
 }
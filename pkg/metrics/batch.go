@@ -2,34 +2,16 @@ package metrics
 
 import (
 	"context"
-	"os"
-	"sync"
 
 	"github.com/Azure/azure-sdk-for-go/services/batch/2019-08-01.10.0/batch"
 	azurebatch "github.com/Azure/azure-sdk-for-go/services/batch/mgmt/2019-08-01/batch"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	"github.com/sylr/prometheus-azure-exporter/pkg/azure"
-	"github.com/sylr/prometheus-azure-exporter/pkg/config"
-	qdsync "sylr.dev/libqd/sync"
 )
 
 var (
-	mu                        = sync.Mutex{}
-	batchPoolQuota            = newBatchPoolQuota()
-	batchDedicatedCoreQuota   = newBatchDedicatedCoreQuota()
-	batchPoolsDedicatedNodes  = newBatchPoolsDedicatedNodes()
-	batchPoolsNodesState      = newBatchPoolsNodesState()
-	batchPoolsAllocationState = newBatchPoolsAllocationState()
-	batchPoolsMetadata        = newBatchPoolsMetadata()
-	batchJobsTasksActive      = newBatchJobsTasksActive()
-	batchJobsTasksRunning     = newBatchJobsTasksRunning()
-	batchJobsTasksCompleted   = newBatchJobsTasksCompleted()
-	batchJobsTasksSucceeded   = newBatchJobsTasksSucceeded()
-	batchJobsTasksFailed      = newBatchJobsTasksFailed()
-	batchJobsInfo             = newBatchJobsInfo()
-	batchJobsStates           = newBatchJobsStates()
-	batchJobsMetadata         = newBatchJobsMetadata()
+	batchSnapshot *Snapshot
 )
 
 // -----------------------------------------------------------------------------
@@ -205,20 +187,24 @@ func newBatchJobsMetadata() *prometheus.GaugeVec {
 // -----------------------------------------------------------------------------
 
 func init() {
-	prometheus.MustRegister(batchPoolQuota)
-	prometheus.MustRegister(batchDedicatedCoreQuota)
-	prometheus.MustRegister(batchPoolsDedicatedNodes)
-	prometheus.MustRegister(batchPoolsNodesState)
-	prometheus.MustRegister(batchPoolsAllocationState)
-	prometheus.MustRegister(batchPoolsMetadata)
-	prometheus.MustRegister(batchJobsTasksActive)
-	prometheus.MustRegister(batchJobsTasksRunning)
-	prometheus.MustRegister(batchJobsTasksCompleted)
-	prometheus.MustRegister(batchJobsTasksSucceeded)
-	prometheus.MustRegister(batchJobsTasksFailed)
-	prometheus.MustRegister(batchJobsInfo)
-	prometheus.MustRegister(batchJobsStates)
-	prometheus.MustRegister(batchJobsMetadata)
+	batchSnapshot = NewUpdateMetricsFunctionAccountSnapshot(
+		"batch",
+		"batch_account",
+		newBatchPoolQuota(),
+		newBatchDedicatedCoreQuota(),
+		newBatchPoolsDedicatedNodes(),
+		newBatchPoolsNodesState(),
+		newBatchPoolsAllocationState(),
+		newBatchPoolsMetadata(),
+		newBatchJobsTasksActive(),
+		newBatchJobsTasksRunning(),
+		newBatchJobsTasksCompleted(),
+		newBatchJobsTasksSucceeded(),
+		newBatchJobsTasksFailed(),
+		newBatchJobsInfo(),
+		newBatchJobsStates(),
+		newBatchJobsMetadata(),
+	)
 
 	if GetUpdateMetricsFunctionInterval("batch") == nil {
 		RegisterUpdateMetricsFunction("batch", UpdateBatchMetrics)
@@ -227,28 +213,11 @@ func init() {
 
 // UpdateBatchMetrics updates batch metrics
 func UpdateBatchMetrics(ctx context.Context) error {
-	var err error
-
 	contextLogger := log.WithFields(log.Fields{
 		"_id":   ctx.Value("id").(string),
 		"_func": "UpdateBatchMetrics",
 	})
 
-	azureClients := azure.NewAzureClients()
-	sub, err := azure.GetSubscription(ctx, azureClients, os.Getenv("AZURE_SUBSCRIPTION_ID"))
-
-	if err != nil {
-		contextLogger.Errorf("Unable to get subscription: %s", err)
-		return err
-	}
-
-	batchAccounts, err := azure.ListSubscriptionBatchAccounts(ctx, azureClients, sub)
-
-	if err != nil {
-		contextLogger.Errorf("Unable to list account azure batch accounts: %s", err)
-		return err
-	}
-
 	// Create new metric vectors
 	nextBatchPoolQuota := newBatchPoolQuota()
 	nextBatchDedicatedCoreQuota := newBatchDedicatedCoreQuota()
@@ -265,171 +234,231 @@ func UpdateBatchMetrics(ctx context.Context) error {
 	nextBatchJobsStates := newBatchJobsStates()
 	nextBatchJobsMetadata := newBatchJobsMetadata()
 
-	wg := qdsync.NewCancelableWaitGroup(ctx, 50)
+	// Accounts whose previous metrics are retained
+	failures := NewFailures()
 
-	for i := range *batchAccounts {
-		accountProperties, _ := azure.ParseResourceID(*(*batchAccounts)[i].ID)
+	azureClients := azure.GetAzureClients()
+	subs, err := listSubscriptions(ctx, azureClients, failures)
 
-		// logger
-		accountLogger := contextLogger.WithFields(log.Fields{
-			"rg":      accountProperties.ResourceGroup,
-			"account": *(*batchAccounts)[i].Name,
+	if err != nil {
+		contextLogger.Errorf("Unable to list subscriptions: %s", err)
+		return err
+	}
+
+	// Create a bounded wait group, shared by all subscriptions, which allows
+	// the configured number of concurrent processes, 50 by default, for
+	// updating pools and jobs.
+	wg := newFunctionWaitGroup(ctx, "batch", 50)
+
+	err = forEachSubscription(ctx, "batch", subs, failures, func(ctx context.Context, sub *azure.Subscription) error {
+		subscriptionLogger := contextLogger.WithFields(log.Fields{
+			"subscription": *sub.DisplayName,
 		})
 
-		// Autodiscovery
-		if !config.MustDiscoverBasedOnTags((*batchAccounts)[i].Tags) {
-			accountLogger.Debugf("Account skipped by autodiscovery")
-			continue
+		batchAccounts, err := azure.ListSubscriptionBatchAccounts(ctx, azureClients, sub)
+
+		if err != nil {
+			subscriptionLogger.Errorf("Unable to list account azure batch accounts: %s", err)
+			failures.Subscription(*sub.DisplayName)
+			return err
 		}
 
-		// Metrics
-		nextBatchPoolQuota.WithLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *(*batchAccounts)[i].Name).Set(float64(*(*batchAccounts)[i].PoolQuota))
-		nextBatchDedicatedCoreQuota.WithLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *(*batchAccounts)[i].Name).Set(float64(*(*batchAccounts)[i].DedicatedCoreQuota))
+		for i := range *batchAccounts {
+			accountProperties, err := azure.ParseResourceID(stringValue((*batchAccounts)[i].ID))
 
-		// -- POOLS ------------------------------------------------------------
+			if err != nil {
+				subscriptionLogger.WithField("account", stringValue((*batchAccounts)[i].Name)).Errorf("Unable to parse account ID: %s", err)
+				continue
+			}
 
-		pools, err := azure.ListBatchAccountPools(ctx, azureClients, sub, &(*batchAccounts)[i])
+			// logger
+			accountLogger := contextLogger.WithFields(log.Fields{
+				"rg":      accountProperties.ResourceGroup,
+				"account": *(*batchAccounts)[i].Name,
+			})
 
-		if err != nil {
-			accountLogger.Errorf("Unable to list account `%s` pools: %s", *(*batchAccounts)[i].Name, err)
-		} else {
-			for _, pool := range pools {
-				wg.Add(1)
-
-				go func(account *azurebatch.Account, pool azurebatch.Pool) {
-					// Pool allocation state
-					for _, state := range batch.PossibleAllocationStateValues() {
-						nextBatchPoolsAllocationState.DeleteLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name, *pool.Name, string(state))
-					}
-
-					nextBatchPoolsAllocationState.WithLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name, *pool.Name, string(pool.AllocationState)).Set(1)
-
-					// Nodes state
-					for _, state := range batch.PossibleComputeNodeStateValues() {
-						nextBatchPoolsNodesState.DeleteLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name, *pool.Name, string(state))
-					}
-
-					nextBatchPoolsDedicatedNodes.WithLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name, *pool.Name).Set(float64(*pool.PoolProperties.CurrentDedicatedNodes))
-
-					// Metadata
-					if pool.Metadata != nil {
-						for _, metadata := range *pool.Metadata {
-							nextBatchPoolsMetadata.WithLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name, *pool.Name, *metadata.Name, *metadata.Value).Set(1)
+			// Autodiscovery
+			account := &(*batchAccounts)[i]
+			discover, err := mustDiscover(ctx, azureClients, sub, account.ID, account.Name, account.Location, account.Type, account.Tags)
+
+			if err != nil {
+				accountLogger.Errorf("Unable to get inherited tags for autodiscovery: %s", err)
+				failures.Account(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name)
+				continue
+			}
+
+			if !discover {
+				accountLogger.Debugf("Account skipped by autodiscovery")
+				continue
+			}
+
+			// Metrics
+			nextBatchPoolQuota.WithLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *(*batchAccounts)[i].Name).Set(float64(*(*batchAccounts)[i].PoolQuota))
+			nextBatchDedicatedCoreQuota.WithLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *(*batchAccounts)[i].Name).Set(float64(*(*batchAccounts)[i].DedicatedCoreQuota))
+
+			// -- POOLS ------------------------------------------------------------
+
+			pools, err := azure.ListBatchAccountPools(ctx, azureClients, sub, &(*batchAccounts)[i])
+
+			if err != nil {
+				accountLogger.Errorf("Unable to list account `%s` pools: %s", *(*batchAccounts)[i].Name, err)
+				failures.Account(*sub.DisplayName, accountProperties.ResourceGroup, *(*batchAccounts)[i].Name)
+			} else {
+				for _, pool := range pools {
+					wg.Add(1)
+
+					go func(account *azurebatch.Account, pool azurebatch.Pool) {
+						defer wg.Done()
+
+						// A panic while updating a pool only fails its account.
+						defer defaultScheduler.recoverPanic("batch", accountLogger, func(err error) {
+							failures.Account(*sub.DisplayName, accountProperties.ResourceGroup, stringValue(account.Name))
+						})
+
+						// Pool allocation state
+						for _, state := range batch.PossibleAllocationStateValues() {
+							nextBatchPoolsAllocationState.DeleteLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name, *pool.Name, string(state))
+						}
+
+						nextBatchPoolsAllocationState.WithLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name, *pool.Name, string(pool.AllocationState)).Set(1)
+
+						// Nodes state
+						for _, state := range batch.PossibleComputeNodeStateValues() {
+							nextBatchPoolsNodesState.DeleteLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name, *pool.Name, string(state))
 						}
-					}
 
-					nodes, err := azure.ListBatchComputeNodes(ctx, azureClients, sub, account, &pool)
+						nextBatchPoolsDedicatedNodes.WithLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name, *pool.Name).Set(float64(*pool.PoolProperties.CurrentDedicatedNodes))
 
-					if err != nil {
-						accountLogger.WithFields(log.Fields{}).Error(err.Error())
-					} else {
-						for _, node := range *nodes {
-							nextBatchPoolsNodesState.WithLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name, *pool.Name, string(node.State)).Inc()
+						// Metadata
+						if pool.Metadata != nil {
+							for _, metadata := range *pool.Metadata {
+								nextBatchPoolsMetadata.WithLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name, *pool.Name, *metadata.Name, *metadata.Value).Set(1)
+							}
 						}
-					}
 
-					accountLogger.WithFields(log.Fields{
-						"metric":          "pool",
-						"pool":            *pool.Name,
-						"dedicated_nodes": *pool.PoolProperties.CurrentDedicatedNodes,
-					}).Debug("")
+						nodes, err := azure.ListBatchComputeNodes(ctx, azureClients, sub, account, &pool)
+
+						if err != nil {
+							accountLogger.WithFields(log.Fields{}).Error(err.Error())
+							failures.Account(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name)
+						} else {
+							for _, node := range *nodes {
+								nextBatchPoolsNodesState.WithLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name, *pool.Name, string(node.State)).Inc()
+							}
+						}
 
-					wg.Done()
-				}(&(*batchAccounts)[i], pool)
+						accountLogger.WithFields(log.Fields{
+							"metric":          "pool",
+							"pool":            *pool.Name,
+							"dedicated_nodes": *pool.PoolProperties.CurrentDedicatedNodes,
+						}).Debug("")
+					}(&(*batchAccounts)[i], pool)
+				}
 			}
-		}
 
-		// -- JOBS -------------------------------------------------------------
+			// -- JOBS -------------------------------------------------------------
 
-		jobs, err := azure.ListBatchAccountJobs(ctx, azureClients, sub, &(*batchAccounts)[i])
+			jobs, err := azure.ListBatchAccountJobs(ctx, azureClients, sub, &(*batchAccounts)[i])
 
-		if err != nil {
-			accountLogger.Errorf("Unable to list account jobs: %s", err)
-		} else {
-			for _, job := range jobs {
-				wg.Add(1)
-
-				go func(account *azurebatch.Account, job batch.CloudJob) {
-					jobLogger := accountLogger.WithFields(log.Fields{
-						"job_id": *job.ID,
-					})
-
-					// job.DisplayName can be nil but we don't want that
-					displayName := *job.ID
-					if job.DisplayName != nil {
-						displayName = *job.DisplayName
-					} else {
-						jobLogger.Debugf("Job has no display name, defaulting to job.ID")
-					}
-
-					// <!-- metrics
-					// We init JobStateActive state to 0 to be sure to have a value for each jobs so we can have alerts on the state value.
-					nextBatchJobsStates.WithLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name, *job.ID, string(batch.JobStateActive)).Set(0)
-					nextBatchJobsStates.WithLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name, *job.ID, string(job.State)).Set(1)
-					// metrics -->
-
-					// job metadata
-					if job.Metadata != nil {
-						for _, metadata := range *job.Metadata {
-							// <!-- metrics
-							nextBatchJobsMetadata.WithLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name, *job.ID, *metadata.Name, *metadata.Value).Set(1)
-							// metrics -->
-						}
-					}
+			if err != nil {
+				accountLogger.Errorf("Unable to list account jobs: %s", err)
+				failures.Account(*sub.DisplayName, accountProperties.ResourceGroup, *(*batchAccounts)[i].Name)
+			} else {
+				for _, job := range jobs {
+					wg.Add(1)
+
+					go func(account *azurebatch.Account, job batch.CloudJob) {
+						defer wg.Done()
 
-					// job task count
-					taskCounts, err := azure.GetBatchJobTaskCounts(ctx, azureClients, sub, account, &job)
+						// A panic while updating a job only fails its account.
+						defer defaultScheduler.recoverPanic("batch", accountLogger, func(err error) {
+							failures.Account(*sub.DisplayName, accountProperties.ResourceGroup, stringValue(account.Name))
+						})
+
+						jobLogger := accountLogger.WithFields(log.Fields{
+							"job_id": *job.ID,
+						})
+
+						// job.DisplayName can be nil but we don't want that
+						displayName := *job.ID
+						if job.DisplayName != nil {
+							displayName = *job.DisplayName
+						} else {
+							jobLogger.Debugf("Job has no display name, defaulting to job.ID")
+						}
 
-					if err != nil {
-						jobLogger.Errorf("Unable to get jobs task count: %s", err)
-					} else {
 						// <!-- metrics
-						nextBatchJobsTasksActive.WithLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name, *job.ID).Set(float64(*taskCounts.Active))
-						nextBatchJobsTasksRunning.WithLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name, *job.ID).Set(float64(*taskCounts.Running))
-						nextBatchJobsTasksCompleted.WithLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name, *job.ID).Set(float64(*taskCounts.Completed))
-						nextBatchJobsTasksSucceeded.WithLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name, *job.ID).Set(float64(*taskCounts.Succeeded))
-						nextBatchJobsTasksFailed.WithLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name, *job.ID).Set(float64(*taskCounts.Failed))
-						nextBatchJobsInfo.WithLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name, *job.ID, displayName, *job.PoolInfo.PoolID).Set(1)
+						// We init JobStateActive state to 0 to be sure to have a value for each jobs so we can have alerts on the state value.
+						nextBatchJobsStates.WithLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name, *job.ID, string(batch.JobStateActive)).Set(0)
+						nextBatchJobsStates.WithLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name, *job.ID, string(job.State)).Set(1)
 						// metrics -->
 
-						jobLogger.WithFields(log.Fields{
-							"metric":    "job",
-							"job":       displayName,
-							"pool":      *job.PoolInfo.PoolID,
-							"active":    *taskCounts.Active,
-							"running":   *taskCounts.Running,
-							"completed": *taskCounts.Completed,
-							"succeeded": *taskCounts.Succeeded,
-							"failed":    *taskCounts.Failed,
-						}).Debug("")
-					}
+						// job metadata
+						if job.Metadata != nil {
+							for _, metadata := range *job.Metadata {
+								// <!-- metrics
+								nextBatchJobsMetadata.WithLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name, *job.ID, *metadata.Name, *metadata.Value).Set(1)
+								// metrics -->
+							}
+						}
+
+						// job task count
+						taskCounts, err := azure.GetBatchJobTaskCounts(ctx, azureClients, sub, account, &job)
+
+						if err != nil {
+							jobLogger.Errorf("Unable to get jobs task count: %s", err)
+							failures.Account(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name)
+						} else {
+							// <!-- metrics
+							nextBatchJobsTasksActive.WithLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name, *job.ID).Set(float64(*taskCounts.Active))
+							nextBatchJobsTasksRunning.WithLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name, *job.ID).Set(float64(*taskCounts.Running))
+							nextBatchJobsTasksCompleted.WithLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name, *job.ID).Set(float64(*taskCounts.Completed))
+							nextBatchJobsTasksSucceeded.WithLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name, *job.ID).Set(float64(*taskCounts.Succeeded))
+							nextBatchJobsTasksFailed.WithLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name, *job.ID).Set(float64(*taskCounts.Failed))
+							nextBatchJobsInfo.WithLabelValues(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name, *job.ID, displayName, *job.PoolInfo.PoolID).Set(1)
+							// metrics -->
 
-					wg.Done()
-				}(&(*batchAccounts)[i], job)
+							jobLogger.WithFields(log.Fields{
+								"metric":    "job",
+								"job":       displayName,
+								"pool":      *job.PoolInfo.PoolID,
+								"active":    *taskCounts.Active,
+								"running":   *taskCounts.Running,
+								"completed": *taskCounts.Completed,
+								"succeeded": *taskCounts.Succeeded,
+								"failed":    *taskCounts.Failed,
+							}).Debug("")
+						}
+					}(&(*batchAccounts)[i], job)
+				}
 			}
+			// ----------------------------------------------------------- JOBS --!>
 		}
-		// ----------------------------------------------------------- JOBS --!>
-	}
+
+		return nil
+	})
 
 	wg.Wait()
 
-	// swapping current registered metrics with updated copies
-	mu.Lock()
-	*batchPoolQuota = *nextBatchPoolQuota
-	*batchDedicatedCoreQuota = *nextBatchDedicatedCoreQuota
-	*batchPoolsDedicatedNodes = *nextBatchPoolsDedicatedNodes
-	*batchPoolsNodesState = *nextBatchPoolsNodesState
-	*batchPoolsAllocationState = *nextBatchPoolsAllocationState
-	*batchPoolsMetadata = *nextBatchPoolsMetadata
-	*batchJobsTasksActive = *nextBatchJobsTasksActive
-	*batchJobsTasksRunning = *nextBatchJobsTasksRunning
-	*batchJobsTasksCompleted = *nextBatchJobsTasksCompleted
-	*batchJobsTasksSucceeded = *nextBatchJobsTasksSucceeded
-	*batchJobsTasksFailed = *nextBatchJobsTasksFailed
-	*batchJobsInfo = *nextBatchJobsInfo
-	*batchJobsStates = *nextBatchJobsStates
-	*batchJobsMetadata = *nextBatchJobsMetadata
-	mu.Unlock()
+	// publishing updated metrics
+	batchSnapshot.PublishRetaining(
+		failures,
+		staleGracePeriod(),
+		nextBatchPoolQuota,
+		nextBatchDedicatedCoreQuota,
+		nextBatchPoolsDedicatedNodes,
+		nextBatchPoolsNodesState,
+		nextBatchPoolsAllocationState,
+		nextBatchPoolsMetadata,
+		nextBatchJobsTasksActive,
+		nextBatchJobsTasksRunning,
+		nextBatchJobsTasksCompleted,
+		nextBatchJobsTasksSucceeded,
+		nextBatchJobsTasksFailed,
+		nextBatchJobsInfo,
+		nextBatchJobsStates,
+		nextBatchJobsMetadata,
+	)
 
 	return err
 }
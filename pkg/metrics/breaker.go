@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"sync"
+)
+
+// circuitBreaker skips the resources which failed during too many
+// consecutive runs of an update metrics function.
+type circuitBreaker struct {
+	mutex     sync.Mutex
+	resources map[string]*breakerState
+}
+
+// breakerState is the state of a resource in a circuitBreaker.
+type breakerState struct {
+	failures int
+	skip     int
+}
+
+// newCircuitBreaker returns a circuitBreaker with all resources allowed.
+func newCircuitBreaker() *circuitBreaker {
+	return &circuitBreaker{
+		resources: make(map[string]*breakerState),
+	}
+}
+
+// Allow returns false if resource must be skipped during the current run.
+// It must be called once per run and per resource.
+func (b *circuitBreaker) Allow(resource string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	state := b.resources[resource]
+
+	if state == nil || state.skip == 0 {
+		return true
+	}
+
+	state.skip--
+
+	return false
+}
+
+// Done records the result of the update of resource. After threshold
+// consecutive failures, resource is skipped for the next skip runs, and again
+// each time the run following those fails. A zero threshold never skips.
+func (b *circuitBreaker) Done(resource string, failed bool, threshold int, skip int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !failed {
+		delete(b.resources, resource)
+		return
+	}
+
+	state := b.resources[resource]
+
+	if state == nil {
+		state = &breakerState{}
+		b.resources[resource] = state
+	}
+
+	state.failures++
+
+	if threshold > 0 && state.failures >= threshold {
+		state.skip = skip
+	}
+}
+
+// Open returns true if resource is currently skipped.
+func (b *circuitBreaker) Open(resource string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	state := b.resources[resource]
+
+	return state != nil && state.skip > 0
+}
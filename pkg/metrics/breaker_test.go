@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"testing"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	breaker := newCircuitBreaker()
+
+	// run calls Allow() then Done() if allowed and returns whether the run
+	// was allowed.
+	run := func(failed bool) bool {
+		if !breaker.Allow("account") {
+			return false
+		}
+
+		breaker.Done("account", failed, 2, 3)
+
+		return true
+	}
+
+	steps := []struct {
+		failed  bool
+		allowed bool
+		open    bool
+	}{
+		{true, true, false},
+		{false, true, false}, // success resets the failures
+		{true, true, false},
+		{true, true, true}, // second consecutive failure
+		{false, false, true},
+		{false, false, true},
+		{false, false, false}, // last skipped run
+		{true, true, true},    // trial run fails again
+		{false, false, true},
+		{false, false, true},
+		{false, false, false},
+		{false, true, false},
+		{true, true, false},
+	}
+
+	for i, step := range steps {
+		if allowed := run(step.failed); allowed != step.allowed {
+			t.Fatalf("Expected %v but got %v at step %d", step.allowed, allowed, i)
+		}
+
+		if open := breaker.Open("account"); open != step.open {
+			t.Fatalf("Expected %v but got %v at step %d", step.open, open, i)
+		}
+	}
+
+	// A zero threshold never skips.
+	for i := 0; i < 10; i++ {
+		breaker.Done("other", true, 0, 3)
+
+		if !breaker.Allow("other") {
+			t.Fatalf("Expected %v but got %v", true, false)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"time"
+)
+
+// Clock is the source of time of a Scheduler. It allows tests to drive the
+// scheduler without waiting.
+type Clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// NewTimer returns a timer firing once after d.
+	NewTimer(d time.Duration) Timer
+	// NewTicker returns a ticker firing every d.
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is the interface of the timers returned by Clock.NewTimer().
+type Timer interface {
+	// C returns the channel on which the time is delivered.
+	C() <-chan time.Time
+	// Stop prevents the timer from firing.
+	Stop() bool
+}
+
+// Ticker is the interface of the tickers returned by Clock.NewTicker().
+type Ticker interface {
+	// C returns the channel on which the ticks are delivered.
+	C() <-chan time.Time
+	// Stop turns off the ticker.
+	Stop()
+}
+
+// realClock is the Clock backed by the time package.
+type realClock struct{}
+
+// Now implements Clock.
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// NewTimer implements Clock.
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+// NewTicker implements Clock.
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+// realTimer wraps a *time.Timer.
+type realTimer struct {
+	*time.Timer
+}
+
+// C implements Timer.
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// realTicker wraps a *time.Ticker.
+type realTicker struct {
+	*time.Ticker
+}
+
+// C implements Ticker.
+func (t realTicker) C() <-chan time.Time {
+	return t.Ticker.C
+}
+
+// NewRealClock returns the Clock backed by the time package.
+func NewRealClock() Clock {
+	return realClock{}
+}
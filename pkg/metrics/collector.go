@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// Collector returns a collector of the metrics updated by the function
+// `name`. When the function is collected on demand, its metrics are
+// refreshed before being collected.
+func (s *Scheduler) Collector(name string, collectors ...prometheus.Collector) prometheus.Collector {
+	return &functionCollector{
+		scheduler:  s,
+		name:       name,
+		collectors: collectors,
+	}
+}
+
+// functionCollector is the prometheus.Collector returned by
+// Scheduler.Collector().
+type functionCollector struct {
+	scheduler  *Scheduler
+	name       string
+	collectors []prometheus.Collector
+}
+
+// Describe implements prometheus.Collector.
+func (c *functionCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, collector := range c.collectors {
+		collector.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *functionCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.scheduler
+
+	s.mutex.RLock()
+	onDemand := s.runs[c.name] != nil && s.runs[c.name].onDemand > 0
+	wait := s.refreshWait
+	s.mutex.RUnlock()
+
+	if onDemand {
+		ctx, cancel := context.WithTimeout(context.Background(), wait)
+		err := s.Refresh(ctx, c.name)
+		cancel()
+
+		if err != nil {
+			log.WithField("_id", "00000000").Warnf("Serving previous metrics of `%s`, refresh is still going: %s", c.name, err)
+		}
+	}
+
+	for _, collector := range c.collectors {
+		collector.Collect(ch)
+	}
+}
@@ -0,0 +1,127 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCollectorOnDemand(t *testing.T) {
+	clock := newFakeClock(time.Date(2020, 1, 1, 0, 0, 10, 0, time.UTC))
+	scheduler := NewScheduler(clock, nil)
+	gauge := prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_value"})
+	started := make(chan struct{}, 10)
+	release := make(chan struct{})
+
+	scheduler.RegisterWithInterval("test", func(ctx context.Context) error {
+		started <- struct{}{}
+		<-release
+		gauge.Inc()
+		return nil
+	}, time.Minute)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(scheduler.Collector("test", gauge))
+
+	// Collected in the background, the function does not run on scrape.
+	if v := testutil.ToFloat64(gauge); v != 0 {
+		t.Fatalf("Expected %v but got %v", 0, v)
+	}
+
+	if _, err := registry.Gather(); err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+
+	if len(started) != 0 {
+		t.Fatalf("Expected the function not to run")
+	}
+
+	if err := scheduler.SetOnDemand("test", 5*time.Minute); err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+
+	if scheduler.Interval("test") != nil {
+		t.Fatalf("Expected the function to be unscheduled")
+	}
+
+	// Concurrent scrapes share the same run and get its metrics.
+	wg := sync.WaitGroup{}
+	values := make(chan float64, 3)
+
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			families, _ := registry.Gather()
+			values <- families[0].GetMetric()[0].GetGauge().GetValue()
+		}()
+	}
+
+	<-started
+	close(release)
+	wg.Wait()
+	close(values)
+
+	for v := range values {
+		if v != 1 {
+			t.Fatalf("Expected %v but got %v", 1, v)
+		}
+	}
+
+	if len(started) != 0 {
+		t.Fatalf("Expected a single run but got %v more", len(started))
+	}
+
+	// Metrics younger than the minimum refresh age are served from cache.
+	clock.Advance(4 * time.Minute)
+	registry.Gather()
+
+	if len(started) != 0 || testutil.ToFloat64(gauge) != 1 {
+		t.Fatalf("Expected the function not to run")
+	}
+
+	clock.Advance(time.Minute)
+	registry.Gather()
+	<-started
+
+	if v := testutil.ToFloat64(gauge); v != 2 {
+		t.Fatalf("Expected %v but got %v", 2, v)
+	}
+}
+
+func TestCollectorRefreshWait(t *testing.T) {
+	scheduler := NewScheduler(newFakeClock(time.Now()), nil)
+	release := make(chan struct{})
+	defer close(release)
+
+	scheduler.RegisterWithInterval("test", func(ctx context.Context) error {
+		<-release
+		return nil
+	}, time.Minute)
+	scheduler.SetOnDemand("test", time.Minute)
+	scheduler.SetRefreshWait(10 * time.Millisecond)
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(scheduler.Collector("test"))
+
+	done := make(chan struct{})
+
+	go func() {
+		registry.Gather()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the scrape not to wait for the refresh")
+	}
+
+	if running := scheduler.Running(); running != 1 {
+		t.Fatalf("Expected %v but got %v", 1, running)
+	}
+}
@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sylr/prometheus-azure-exporter/pkg/config"
+	qdsync "sylr.dev/libqd/sync"
+)
+
+var (
+	functionConcurrencyInUse = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "azure_exporter",
+			Subsystem: "update_metrics_function",
+			Name:      "concurrency_in_use",
+			Help:      "Number of goroutines of update metrics functions processing resources",
+		},
+		[]string{"function"},
+	)
+	functionConcurrencyWaiting = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "azure_exporter",
+			Subsystem: "update_metrics_function",
+			Name:      "concurrency_waiting",
+			Help:      "Number of resources of update metrics functions waiting for a goroutine slot",
+		},
+		[]string{"function"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(functionConcurrencyInUse)
+	prometheus.MustRegister(functionConcurrencyWaiting)
+}
+
+// functionConcurrency returns the configured concurrency of the update
+// metrics function `name`, or def.
+func functionConcurrency(name string, def int) int {
+	if config.CurrentConfig == nil {
+		return def
+	}
+
+	for _, f := range config.CurrentConfig.UpdateMetricsFunctions {
+		if f.Name == name && f.Concurrency > 0 {
+			return int(f.Concurrency)
+		}
+	}
+
+	return def
+}
+
+// functionWaitGroup is a qdsync.Waiter bounded by the concurrency of an update
+// metrics function which reports its in use and waiting slots.
+type functionWaitGroup struct {
+	wg      *qdsync.CancelableWaitGroup
+	inUse   prometheus.Gauge
+	waiting prometheus.Gauge
+}
+
+// newFunctionWaitGroup returns a functionWaitGroup allowing the configured
+// concurrency of the update metrics function `name`, or def.
+func newFunctionWaitGroup(ctx context.Context, name string, def int) *functionWaitGroup {
+	return &functionWaitGroup{
+		wg:      qdsync.NewCancelableWaitGroup(ctx, functionConcurrency(name, def)),
+		inUse:   functionConcurrencyInUse.WithLabelValues(name),
+		waiting: functionConcurrencyWaiting.WithLabelValues(name),
+	}
+}
+
+// Add implements qdsync.Waiter.
+func (w *functionWaitGroup) Add(delta int) {
+	w.waiting.Add(float64(delta))
+	w.wg.Add(delta)
+	w.waiting.Sub(float64(delta))
+	w.inUse.Add(float64(delta))
+}
+
+// Done implements qdsync.Waiter.
+func (w *functionWaitGroup) Done() {
+	w.inUse.Dec()
+	w.wg.Done()
+}
+
+// Wait implements qdsync.Waiter.
+func (w *functionWaitGroup) Wait() {
+	w.wg.Wait()
+}
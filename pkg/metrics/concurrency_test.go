@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sylr/prometheus-azure-exporter/pkg/config"
+)
+
+func TestFunctionConcurrency(t *testing.T) {
+	defer func(c *config.PrometheusAzureExporterConfig) { config.CurrentConfig = c }(config.CurrentConfig)
+
+	config.CurrentConfig = nil
+
+	if c := functionConcurrency("storage", 10); c != 10 {
+		t.Fatalf("Expected %v but got %v", 10, c)
+	}
+
+	config.CurrentConfig = &config.PrometheusAzureExporterConfig{
+		UpdateMetricsFunctions: []config.UpdateMetricsFunctionConfig{
+			{Name: "storage", Concurrency: 4},
+			{Name: "batch"},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		expected int
+	}{
+		{"storage", 4},
+		{"batch", 50},
+		{"graph", 50},
+	}
+
+	for _, test := range tests {
+		if c := functionConcurrency(test.name, 50); c != test.expected {
+			t.Fatalf("Expected %v but got %v for %s", test.expected, c, test.name)
+		}
+	}
+
+	wg := newFunctionWaitGroup(context.Background(), "storage", 10)
+	wg.Add(1)
+
+	if v := testutil.ToFloat64(wg.inUse); v != 1 {
+		t.Fatalf("Expected %v but got %v", 1, v)
+	}
+
+	wg.Done()
+	wg.Wait()
+
+	if v := testutil.ToFloat64(wg.inUse); v != 0 {
+		t.Fatalf("Expected %v but got %v", 0, v)
+	}
+}
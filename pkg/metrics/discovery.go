@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"context"
+
+	"github.com/sylr/prometheus-azure-exporter/pkg/azure"
+	"github.com/sylr/prometheus-azure-exporter/pkg/config"
+)
+
+// mustDiscover returns true if the resource must be processed according to
+// the discovery rules. The tags of the resource group and of the subscription
+// are only fetched if discovery inherits them.
+func mustDiscover(ctx context.Context, clients *azure.AzureClients, sub *azure.Subscription, id *string, name *string, location *string, resourceType *string, tags map[string]*string) (bool, error) {
+	resource := config.DiscoveryResource{
+		Name:     stringValue(name),
+		Location: stringValue(location),
+		Type:     stringValue(resourceType),
+		Tags:     tags,
+	}
+
+	if properties, err := azure.ParseResourceID(stringValue(id)); err == nil {
+		resource.ResourceGroup = properties.ResourceGroup
+	}
+
+	for _, source := range config.DiscoveryTagsPrecedence() {
+		switch source {
+		case config.DiscoveryTagsResourceGroup:
+			if len(resource.ResourceGroup) == 0 {
+				continue
+			}
+
+			group, err := azure.GetResourceGroup(ctx, clients, sub, resource.ResourceGroup)
+
+			if err != nil {
+				return false, err
+			}
+
+			resource.ResourceGroupTags = group.Tags
+		case config.DiscoveryTagsSubscription:
+			subscriptionTags, err := azure.GetSubscriptionTags(ctx, clients, sub)
+
+			if err != nil {
+				return false, err
+			}
+
+			resource.SubscriptionTags = subscriptionTags
+		}
+	}
+
+	return config.MustDiscover(resource), nil
+}
+
+// stringValue returns the string pointed by s or an empty string.
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+
+	return *s
+}
@@ -2,12 +2,14 @@ package metrics
 
 import (
 	"context"
+	"fmt"
 	"regexp"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	"github.com/sylr/prometheus-azure-exporter/pkg/azure"
+	"github.com/sylr/prometheus-azure-exporter/pkg/config"
 )
 
 var (
@@ -15,8 +17,16 @@ var (
 )
 
 var (
-	graphApplicationKeyExpire      = newGraphApplicationKeyExpire()
-	graphApplicationPasswordExpire = newGraphApplicationPasswordExpire()
+	graphSnapshot     *Snapshot
+	graphTenantErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "azure_exporter",
+			Subsystem: "graph_tenant",
+			Name:      "errors_total",
+			Help:      "Number of errors while updating the metrics of graph tenants by cause",
+		},
+		[]string{"tenant", "cause"},
+	)
 )
 
 // -----------------------------------------------------------------------------
@@ -29,7 +39,7 @@ func newGraphApplicationKeyExpire() *prometheus.GaugeVec {
 			Name:      "application_key_expire_time",
 			Help:      "Unix timestamp of application key expiration",
 		},
-		[]string{"application", "key"},
+		[]string{"tenant", "application", "key"},
 	)
 }
 
@@ -41,15 +51,15 @@ func newGraphApplicationPasswordExpire() *prometheus.GaugeVec {
 			Name:      "application_password_expire_time",
 			Help:      "Unix timestamp of application password expiration",
 		},
-		[]string{"application", "password"},
+		[]string{"tenant", "application", "password"},
 	)
 }
 
 // -----------------------------------------------------------------------------
 
 func init() {
-	prometheus.MustRegister(graphApplicationKeyExpire)
-	prometheus.MustRegister(graphApplicationPasswordExpire)
+	graphSnapshot = NewUpdateMetricsFunctionSnapshot("graph", newGraphApplicationKeyExpire(), newGraphApplicationPasswordExpire())
+	prometheus.MustRegister(graphTenantErrors)
 
 	if GetUpdateMetricsFunctionInterval("graph") == nil {
 		RegisterUpdateMetricsFunctionWithInterval("graph", UpdateGraphMetrics, 60*time.Second)
@@ -58,7 +68,8 @@ func init() {
 
 // UpdateGraphMetrics updates graph metrics
 func UpdateGraphMetrics(ctx context.Context) error {
-	var err error
+	var lastErr error
+	var failed int
 
 	contextLogger := log.WithFields(log.Fields{
 		"_id":   ctx.Value("id").(string),
@@ -70,44 +81,82 @@ func UpdateGraphMetrics(ctx context.Context) error {
 	nextGraphApplicationPasswordExpire := newGraphApplicationPasswordExpire()
 
 	// <!-- APPLICATIONS -------------------------------------------------------
-	azureClients := azure.NewAzureClients()
-	applications, err := azure.ListApplications(ctx, azureClients)
+	azureClients := azure.GetAzureClients()
+
+	conf := config.CurrentConfig
+	if conf == nil {
+		conf = &config.PrometheusAzureExporterConfig{}
+	}
 
-	if err != nil {
-		contextLogger.Errorf("Unable to list applications: %s", err)
-		return err
+	// tenantError records that the update of tenant failed with err, the
+	// other tenants are still updated.
+	tenantError := func(tenant string, err error) {
+		graphTenantErrors.WithLabelValues(tenant, string(azure.ClassifyError(err))).Inc()
+		lastErr = err
+		failed++
 	}
 
-	for _, app := range *applications {
-		for _, key := range *app.KeyCredentials {
-			var decodedName string
-			if key.CustomKeyIdentifier != nil {
-				decodedName = string(*key.CustomKeyIdentifier)
-				decodedName = nameSanitationRegexp.ReplaceAllString(decodedName, "")
-			} else {
-				decodedName = *key.KeyID
+	for _, tenant := range conf.GetGraphTenants() {
+		tenantID := tenant.TenantID
+
+		if len(tenantID) == 0 {
+			profile, err := azure.GetProfile(tenant.Profile)
+
+			if err != nil {
+				contextLogger.WithField("profile", tenant.Profile).Errorf("Unable to get credential profile: %s", err)
+				tenantError(tenant.Profile, err)
+				continue
 			}
 
-			nextGraphApplicationKeyExpire.WithLabelValues(*app.DisplayName, decodedName).Set(float64(key.EndDate.Unix()))
+			tenantID = profile.TenantID
+		}
+
+		tenantLogger := contextLogger.WithFields(log.Fields{
+			"tenant": tenantID,
+		})
+
+		applications, err := azure.ListApplications(ctx, azureClients, tenant.Profile, tenantID)
+
+		if err != nil {
+			tenantLogger.Errorf("Unable to list applications: %s", err)
+			tenantError(tenantID, err)
+			continue
 		}
 
-		for _, password := range *app.PasswordCredentials {
-			var decodedName string
-			if password.CustomKeyIdentifier != nil {
-				decodedName = string(*password.CustomKeyIdentifier)
-				decodedName = nameSanitationRegexp.ReplaceAllString(decodedName, "")
-			} else {
-				decodedName = *password.KeyID
+		for _, app := range *applications {
+			for _, key := range *app.KeyCredentials {
+				var decodedName string
+				if key.CustomKeyIdentifier != nil {
+					decodedName = string(*key.CustomKeyIdentifier)
+					decodedName = nameSanitationRegexp.ReplaceAllString(decodedName, "")
+				} else {
+					decodedName = *key.KeyID
+				}
+
+				nextGraphApplicationKeyExpire.WithLabelValues(tenantID, *app.DisplayName, decodedName).Set(float64(key.EndDate.Unix()))
 			}
 
-			nextGraphApplicationPasswordExpire.WithLabelValues(*app.DisplayName, decodedName).Set(float64(password.EndDate.Unix()))
+			for _, password := range *app.PasswordCredentials {
+				var decodedName string
+				if password.CustomKeyIdentifier != nil {
+					decodedName = string(*password.CustomKeyIdentifier)
+					decodedName = nameSanitationRegexp.ReplaceAllString(decodedName, "")
+				} else {
+					decodedName = *password.KeyID
+				}
+
+				nextGraphApplicationPasswordExpire.WithLabelValues(tenantID, *app.DisplayName, decodedName).Set(float64(password.EndDate.Unix()))
+			}
 		}
 	}
 	// -- APPLICATIONS -------------------------------------------------------!>
 
-	// swapping current registered metrics with updated copies
-	*graphApplicationKeyExpire = *nextGraphApplicationKeyExpire
-	*graphApplicationPasswordExpire = *nextGraphApplicationPasswordExpire
+	// publishing updated metrics
+	graphSnapshot.Publish(nextGraphApplicationKeyExpire, nextGraphApplicationPasswordExpire)
+
+	if lastErr != nil {
+		return fmt.Errorf("unable to update %d graph tenants, last error: %w", failed, lastErr)
+	}
 
-	return err
+	return nil
 }
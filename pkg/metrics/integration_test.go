@@ -0,0 +1,293 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/expfmt"
+	"github.com/sylr/prometheus-azure-exporter/pkg/azure"
+	"github.com/sylr/prometheus-azure-exporter/pkg/azure/azuretest"
+	"github.com/sylr/prometheus-azure-exporter/pkg/config"
+	"sylr.dev/libqd/cache"
+)
+
+var (
+	update = flag.Bool("update", false, "update the golden files of the integration tests")
+)
+
+const (
+	integrationSubscriptionID = "00000000-0000-0000-0000-000000000001"
+	// The fixtures of this subscription answer 403.
+	integrationForbiddenSubscriptionID = "00000000-0000-0000-0000-000000000002"
+	// The pool of this subscription has no current dedicated nodes.
+	integrationPanicSubscriptionID = "00000000-0000-0000-0000-000000000003"
+	// The storage account of this subscription, which has the same display
+	// name as the main one, cannot list its containers.
+	integrationFailingStorageSubscriptionID = "00000000-0000-0000-0000-000000000004"
+	integrationTenantID                     = "00000000-0000-0000-0000-0000000000aa"
+	// The graph fixtures of this tenant answer 403.
+	integrationForbiddenTenantID = "00000000-0000-0000-0000-0000000000bb"
+)
+
+// setupIntegration points the exporter to a fake Azure backend serving the
+// fixtures found in testdata/fixtures.
+func setupIntegration(t *testing.T) (*azuretest.Server, context.Context) {
+	server := azuretest.NewServer(filepath.Join("testdata", "fixtures"))
+	t.Cleanup(server.Close)
+
+	cache.SetNoop(true)
+	azure.SetTransport(server.Client().Transport)
+	azure.SetEndpoints(server.Endpoints())
+	azure.SetRateLimits(azure.RateLimits{})
+	azure.SetProfiles([]*azure.Profile{
+		{
+			Name:         azure.DefaultProfile,
+			TenantID:     integrationTenantID,
+			ClientID:     "00000000-0000-0000-0000-0000000000ff",
+			ClientSecret: "secret",
+			Method:       azure.CredentialMethodClientSecret,
+		},
+	})
+
+	previous := config.CurrentConfig
+	config.CurrentConfig = &config.PrometheusAzureExporterConfig{
+		AutoDiscoveryMode:        "All",
+		AutoDiscoveryTag:         "prometheus_io_azure_exporter_discover",
+		SubscriptionsMode:        "Static",
+		SubscriptionsConcurrency: 1,
+		Subscriptions: []config.SubscriptionConfig{
+			{ID: integrationSubscriptionID},
+		},
+	}
+	t.Cleanup(func() { config.CurrentConfig = previous })
+
+	return server, context.WithValue(context.Background(), "id", "00000000")
+}
+
+// assertGolden compares the metrics whose name starts with prefix to the
+// content of testdata/golden/<name>.prom, or writes it when -update is set.
+func assertGolden(t *testing.T, server *azuretest.Server, name string, prefix string) {
+	if misses := server.Misses(); len(misses) > 0 {
+		t.Fatalf("Expected every request to have a fixture but got %v", misses)
+	}
+
+	families, err := prometheus.DefaultGatherer.Gather()
+
+	if err != nil {
+		t.Fatalf("Unable to gather metrics: %v", err)
+	}
+
+	buf := bytes.Buffer{}
+
+	for _, family := range families {
+		if strings.HasPrefix(family.GetName(), prefix) {
+			if _, err := expfmt.MetricFamilyToText(&buf, family); err != nil {
+				t.Fatalf("Unable to encode metrics: %v", err)
+			}
+		}
+	}
+
+	golden := filepath.Join("testdata", "golden", name+".prom")
+
+	if *update {
+		if err := ioutil.WriteFile(golden, buf.Bytes(), 0644); err != nil {
+			t.Fatalf("Unable to write golden file: %v", err)
+		}
+	}
+
+	expected, err := ioutil.ReadFile(golden)
+
+	if err != nil {
+		t.Fatalf("Unable to read golden file: %v", err)
+	}
+
+	if got := buf.String(); got != string(expected) {
+		t.Fatalf("Expected %v but got %v", string(expected), got)
+	}
+}
+
+func TestIntegrationUpdateBatchMetrics(t *testing.T) {
+	server, ctx := setupIntegration(t)
+
+	if err := UpdateBatchMetrics(ctx); err != nil {
+		t.Fatalf("Expected %v but got %v", nil, err)
+	}
+
+	assertGolden(t, server, "batch", "azure_batch_")
+}
+
+func TestIntegrationUpdateStorageMetrics(t *testing.T) {
+	server, ctx := setupIntegration(t)
+
+	if err := UpdateStorageMetrics(ctx); err != nil {
+		t.Fatalf("Expected %v but got %v", nil, err)
+	}
+
+	assertGolden(t, server, "storage", "azure_storage_")
+}
+
+func TestIntegrationUpdateStorageMetricsRetention(t *testing.T) {
+	server, ctx := setupIntegration(t)
+	config.CurrentConfig.StaleGracePeriod = time.Hour
+
+	if err := UpdateStorageMetrics(ctx); err != nil {
+		t.Fatalf("Expected %v but got %v", nil, err)
+	}
+
+	// The containers of the account cannot be listed anymore, their last
+	// metrics are still served.
+	config.CurrentConfig.Subscriptions = []config.SubscriptionConfig{
+		{ID: integrationFailingStorageSubscriptionID},
+	}
+
+	if err := UpdateStorageMetrics(ctx); err != nil {
+		t.Fatalf("Expected %v but got %v", nil, err)
+	}
+
+	assertGolden(t, server, "storage", "azure_storage_")
+}
+
+func TestIntegrationUpdateGraphMetrics(t *testing.T) {
+	server, ctx := setupIntegration(t)
+
+	if err := UpdateGraphMetrics(ctx); err != nil {
+		t.Fatalf("Expected %v but got %v", nil, err)
+	}
+
+	assertGolden(t, server, "graph", "azure_graph_")
+}
+
+func TestIntegrationForbiddenGraphTenant(t *testing.T) {
+	server, ctx := setupIntegration(t)
+	config.CurrentConfig.GraphTenants = []config.GraphTenantConfig{
+		{TenantID: integrationForbiddenTenantID},
+		{TenantID: integrationTenantID},
+	}
+
+	errors := graphTenantErrors.WithLabelValues(integrationForbiddenTenantID, string(azure.ErrorClassAuth))
+	before := testutil.ToFloat64(errors)
+
+	// The applications of the other tenant are still published.
+	if err := UpdateGraphMetrics(ctx); err == nil {
+		t.Fatalf("Expected an error but got %v", err)
+	}
+
+	if v := testutil.ToFloat64(errors) - before; v != 1 {
+		t.Fatalf("Expected %v but got %v", 1, v)
+	}
+
+	assertGolden(t, server, "graph", "azure_graph_")
+}
+
+func TestIntegrationForbiddenSubscription(t *testing.T) {
+	server, ctx := setupIntegration(t)
+	config.CurrentConfig.Subscriptions = append(config.CurrentConfig.Subscriptions, config.SubscriptionConfig{
+		ID: integrationForbiddenSubscriptionID,
+	})
+
+	failures := NewFailures()
+	subs, err := listSubscriptions(ctx, azure.GetAzureClients(), failures)
+
+	if err != nil {
+		t.Fatalf("Expected %v but got %v", nil, err)
+	}
+
+	if len(subs) != 1 || *subs[0].SubscriptionID != integrationSubscriptionID {
+		t.Fatalf("Expected %v but got %v", integrationSubscriptionID, subs)
+	}
+
+	if !failures.unlisted {
+		t.Fatalf("Expected the forbidden subscription to be recorded")
+	}
+
+	// The subscription which can be listed is still processed.
+	if err := UpdateBatchMetrics(ctx); err != nil {
+		t.Fatalf("Expected %v but got %v", nil, err)
+	}
+
+	assertGolden(t, server, "batch", "azure_batch_")
+}
+
+func TestIntegrationUpdateBatchMetricsPanic(t *testing.T) {
+	server, ctx := setupIntegration(t)
+	config.CurrentConfig.Subscriptions = []config.SubscriptionConfig{
+		{ID: integrationPanicSubscriptionID},
+	}
+
+	panics := defaultScheduler.metrics.panics.WithLabelValues("batch")
+	before := testutil.ToFloat64(panics)
+
+	// The pool goroutine dereferences the missing current dedicated nodes.
+	if err := UpdateBatchMetrics(ctx); err != nil {
+		t.Fatalf("Expected %v but got %v", nil, err)
+	}
+
+	if misses := server.Misses(); len(misses) > 0 {
+		t.Fatalf("Expected every request to have a fixture but got %v", misses)
+	}
+
+	if v := testutil.ToFloat64(panics) - before; v != 1 {
+		t.Fatalf("Expected %v but got %v", 1, v)
+	}
+}
+
+// samplingTransport delays the requests sent by the goroutines of update
+// metrics functions and samples the number of goroutines in use meanwhile.
+type samplingTransport struct {
+	next  http.RoundTripper
+	inUse prometheus.Gauge
+	mutex sync.Mutex
+	max   float64
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *samplingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if path := req.URL.Path; strings.HasSuffix(path, "/nodes") || strings.HasSuffix(path, "/taskcounts") {
+		time.Sleep(50 * time.Millisecond)
+
+		t.mutex.Lock()
+		if v := testutil.ToFloat64(t.inUse); v > t.max {
+			t.max = v
+		}
+		t.mutex.Unlock()
+	}
+
+	return t.next.RoundTrip(req)
+}
+
+func TestIntegrationUpdateBatchMetricsConcurrency(t *testing.T) {
+	server, ctx := setupIntegration(t)
+	config.CurrentConfig.SubscriptionsConcurrency = 2
+	config.CurrentConfig.Subscriptions = []config.SubscriptionConfig{
+		{ID: integrationSubscriptionID},
+		{ID: integrationPanicSubscriptionID},
+	}
+	config.CurrentConfig.UpdateMetricsFunctions = []config.UpdateMetricsFunctionConfig{
+		{Name: "batch", Concurrency: 1},
+	}
+
+	transport := &samplingTransport{
+		next:  server.Client().Transport,
+		inUse: functionConcurrencyInUse.WithLabelValues("batch"),
+	}
+	azure.SetTransport(transport)
+
+	if err := UpdateBatchMetrics(ctx); err != nil {
+		t.Fatalf("Expected %v but got %v", nil, err)
+	}
+
+	// Both subscriptions share the same goroutine.
+	if transport.max != 1 {
+		t.Fatalf("Expected %v but got %v", 1, transport.max)
+	}
+}
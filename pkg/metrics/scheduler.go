@@ -0,0 +1,1369 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/sylr/prometheus-azure-exporter/pkg/azure"
+	"github.com/sylr/prometheus-azure-exporter/pkg/cron"
+)
+
+// OverlapPolicy tells what to do when an update metrics function is due
+// while its previous run is still going.
+type OverlapPolicy string
+
+const (
+	// OverlapSkip skips the run.
+	OverlapSkip OverlapPolicy = "skip"
+	// OverlapQueueOne starts the run when the previous one ends. Only one run
+	// is queued, other runs are skipped.
+	OverlapQueueOne OverlapPolicy = "queue-one"
+	// OverlapAllow starts the run alongside the previous one.
+	OverlapAllow OverlapPolicy = "allow"
+
+	// DefaultOverlapPolicy is the policy of the functions which have not
+	// been given one.
+	DefaultOverlapPolicy = OverlapSkip
+)
+
+// ParseOverlapPolicy returns the policy named `name`, or the default policy
+// if name is empty.
+func ParseOverlapPolicy(name string) (OverlapPolicy, error) {
+	switch policy := OverlapPolicy(name); policy {
+	case "":
+		return DefaultOverlapPolicy, nil
+	case OverlapSkip, OverlapQueueOne, OverlapAllow:
+		return policy, nil
+	}
+
+	return "", fmt.Errorf("`%s` is not a valid overlap policy", name)
+}
+
+// RunStatus tells what happened to a run requested with Trigger().
+type RunStatus string
+
+const (
+	// RunStarted means that the run has started.
+	RunStarted RunStatus = "started"
+	// RunQueued means that the run will start when the previous one ends.
+	RunQueued RunStatus = "queued"
+	// RunSkipped means that the run was skipped because the previous one is
+	// still going.
+	RunSkipped RunStatus = "skipped"
+	// RunBackingOff means that the run was skipped because the function is
+	// backing off after failures.
+	RunBackingOff RunStatus = "backing-off"
+)
+
+// FunctionStatus is the state of an update metrics function.
+type FunctionStatus struct {
+	Name string
+	// Interval is zero if the function is not registered with an interval.
+	Interval time.Duration
+	// Cron is nil if the function is not registered with a cron schedule.
+	Cron *cron.Schedule
+	// MinRefreshAge is zero if the function is not collected on demand.
+	MinRefreshAge time.Duration
+	Overlap       OverlapPolicy
+	InFlight      int
+	// LastRun is the start time of the last run.
+	LastRun time.Time
+	// LastError is the error returned by the last failed run.
+	LastError     error
+	LastErrorTime time.Time
+	// NextRun is zero if the function is not scheduled.
+	NextRun time.Time
+}
+
+// FunctionOptions holds the run options of an update metrics function.
+type FunctionOptions struct {
+	// Timeout is the deadline of each run, zero means no deadline.
+	Timeout time.Duration
+	// Jitter spreads the first run at a random time within the given
+	// duration instead of aligning it on the interval.
+	Jitter time.Duration
+	// Backoff is the maximum interval the interval is doubled up to after
+	// each consecutive failure, zero disables backoff.
+	Backoff time.Duration
+}
+
+// backoffDelay returns the time to wait after the start of a run which
+// failed for the `failures`th time in a row before running the function
+// again.
+func backoffDelay(interval time.Duration, max time.Duration, failures int) time.Duration {
+	delay := interval
+
+	for i := 0; i < failures && delay < max; i++ {
+		delay *= 2
+	}
+
+	if delay > max && max > interval {
+		delay = max
+	}
+
+	return delay
+}
+
+// schedulerMetrics holds the metrics of a Scheduler.
+type schedulerMetrics struct {
+	duration     *prometheus.HistogramVec
+	lastDuration *prometheus.GaugeVec
+	interval     *prometheus.GaugeVec
+	exceeding    *prometheus.CounterVec
+	skipped      *prometheus.CounterVec
+	inFlight     *prometheus.GaugeVec
+	backoff      *prometheus.GaugeVec
+	nextRun      *prometheus.GaugeVec
+	lastSuccess  *prometheus.GaugeVec
+	lastError    *prometheus.GaugeVec
+	runs         *prometheus.CounterVec
+	failures     *prometheus.GaugeVec
+	up           *prometheus.GaugeVec
+	errors       *prometheus.CounterVec
+	panics       *prometheus.CounterVec
+}
+
+// newSchedulerMetrics returns the metrics of a scheduler registered with
+// registerer, which can be nil.
+func newSchedulerMetrics(registerer prometheus.Registerer) *schedulerMetrics {
+	m := &schedulerMetrics{
+		duration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "azure_exporter",
+				Subsystem: "update_metrics_function",
+				Name:      "duration_seconds",
+				Help:      "Duration of update metrics functions (does not include run which returned an error)",
+				Buckets:   []float64{1, 5, 10, 30, 60, 300, 600, 1800, 3600},
+			},
+			[]string{"function"},
+		),
+		lastDuration: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "azure_exporter",
+				Subsystem: "update_metrics_function",
+				Name:      "last_duration_seconds",
+				Help:      "Last duration of update metrics functions (does not include run which returned an error)",
+			},
+			[]string{"function"},
+		),
+		interval: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "azure_exporter",
+				Subsystem: "update_metrics_function",
+				Name:      "interval_duration_seconds",
+				Help:      "Interval of update metrics functions",
+			},
+			[]string{"function"},
+		),
+		exceeding: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "azure_exporter",
+				Subsystem: "update_metrics_function",
+				Name:      "exceeding_interval_total",
+				Help:      "Counter tracing functions that take more time than the interval they are registered with",
+			},
+			[]string{"function", "interval"},
+		),
+		skipped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "azure_exporter",
+				Subsystem: "update_metrics_function",
+				Name:      "skipped_total",
+				Help:      "Number of runs of update metrics functions skipped because the previous run was still going",
+			},
+			[]string{"function"},
+		),
+		inFlight: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "azure_exporter",
+				Subsystem: "update_metrics_function",
+				Name:      "in_flight",
+				Help:      "Number of runs of update metrics functions currently going",
+			},
+			[]string{"function"},
+		),
+		backoff: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "azure_exporter",
+				Subsystem: "update_metrics_function",
+				Name:      "backoff_seconds",
+				Help:      "Time added to the interval of update metrics functions because of consecutive failures",
+			},
+			[]string{"function"},
+		),
+		nextRun: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "azure_exporter",
+				Subsystem: "update_metrics_function",
+				Name:      "next_run_timestamp_seconds",
+				Help:      "Timestamp of the next planned run of update metrics functions",
+			},
+			[]string{"function"},
+		),
+		lastSuccess: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "azure_exporter",
+				Subsystem: "update_metrics_function",
+				Name:      "last_success_timestamp_seconds",
+				Help:      "Timestamp of the end of the last successful run of update metrics functions",
+			},
+			[]string{"function"},
+		),
+		lastError: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "azure_exporter",
+				Subsystem: "update_metrics_function",
+				Name:      "last_error_timestamp_seconds",
+				Help:      "Timestamp of the end of the last failed run of update metrics functions",
+			},
+			[]string{"function"},
+		),
+		runs: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "azure_exporter",
+				Subsystem: "update_metrics_function",
+				Name:      "runs_total",
+				Help:      "Number of runs of update metrics functions by result",
+			},
+			[]string{"function", "result"},
+		),
+		failures: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "azure_exporter",
+				Subsystem: "update_metrics_function",
+				Name:      "consecutive_failures",
+				Help:      "Number of runs of update metrics functions which failed since the last success",
+			},
+			[]string{"function"},
+		),
+		up: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "azure_exporter",
+				Subsystem: "update_metrics_function",
+				Name:      "up",
+				Help:      "Whether the last run of update metrics functions succeeded",
+			},
+			[]string{"function"},
+		),
+		errors: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "azure_exporter",
+				Subsystem: "update_metrics_function",
+				Name:      "errors_total",
+				Help:      "Number of errors returned by update metrics functions by cause",
+			},
+			[]string{"function", "cause"},
+		),
+		panics: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "azure_exporter",
+				Subsystem: "update_metrics_function",
+				Name:      "panics_total",
+				Help:      "Number of panics recovered from update metrics functions",
+			},
+			[]string{"function"},
+		),
+	}
+
+	if registerer != nil {
+		registerer.MustRegister(m.duration)
+		registerer.MustRegister(m.lastDuration)
+		registerer.MustRegister(m.interval)
+		registerer.MustRegister(m.exceeding)
+		registerer.MustRegister(m.skipped)
+		registerer.MustRegister(m.inFlight)
+		registerer.MustRegister(m.backoff)
+		registerer.MustRegister(m.nextRun)
+		registerer.MustRegister(m.lastSuccess)
+		registerer.MustRegister(m.lastError)
+		registerer.MustRegister(m.runs)
+		registerer.MustRegister(m.failures)
+		registerer.MustRegister(m.up)
+		registerer.MustRegister(m.errors)
+		registerer.MustRegister(m.panics)
+	}
+
+	return m
+}
+
+// Scheduler runs update metrics functions at the interval or on the cron
+// schedule they are registered with. It is safe for concurrent use.
+type Scheduler struct {
+	clock   Clock
+	metrics *schedulerMetrics
+	// Returns a random number in [0, n), used to jitter first runs.
+	random func(n int64) int64
+
+	// Mutex used to lock read/writes of the fields below.
+	mutex sync.RWMutex
+	// Interval of the functions registered without interval.
+	defaultInterval time.Duration
+	// All update functions that have been registered once. It is used when
+	// we want to move a function from an update interval to another.
+	functions map[string]UpdateMetricsFunction
+	// Update functions currently registered, by update interval.
+	intervals map[time.Duration]map[string]UpdateMetricsFunction
+	// Update functions currently registered with a cron schedule, by name.
+	crons map[string]*cronFunction
+	// Cancel functions of the contexts used by the running processes, by
+	// process key.
+	cancels map[string]context.CancelFunc
+	// Contexts of the running processes, by process key.
+	contexts map[string]context.Context
+	// Runs state of the functions.
+	runs map[string]*functionRuns
+	// Number of runs currently going, all functions included.
+	running int
+	// Channels closed when running drops to zero, used by Wait().
+	drained []chan struct{}
+	// Wakes up Run() when it has no interval process to wait for.
+	wakeup chan struct{}
+	// Context given to Run(), used by the runs of functions collected on
+	// demand.
+	root context.Context
+	// Maximum time a collection waits for the refresh of a function
+	// collected on demand before serving its previous metrics.
+	refreshWait time.Duration
+}
+
+// NewScheduler returns a scheduler using clock and registering its metrics
+// with registerer, which can be nil.
+func NewScheduler(clock Clock, registerer prometheus.Registerer) *Scheduler {
+	return &Scheduler{
+		clock:           clock,
+		metrics:         newSchedulerMetrics(registerer),
+		random:          rand.Int63n,
+		defaultInterval: 30 * time.Second,
+		functions:       make(map[string]UpdateMetricsFunction),
+		intervals:       make(map[time.Duration]map[string]UpdateMetricsFunction),
+		crons:           make(map[string]*cronFunction),
+		cancels:         make(map[string]context.CancelFunc),
+		contexts:        make(map[string]context.Context),
+		runs:            make(map[string]*functionRuns),
+		wakeup:          make(chan struct{}, 1),
+		refreshWait:     10 * time.Second,
+	}
+}
+
+// SetDefaultInterval sets the interval of the functions registered with
+// Register().
+func (s *Scheduler) SetDefaultInterval(interval time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.defaultInterval = interval
+}
+
+// DefaultInterval returns the interval of the functions registered with
+// Register().
+func (s *Scheduler) DefaultInterval() time.Duration {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.defaultInterval
+}
+
+// Register registers a function with the default interval.
+func (s *Scheduler) Register(name string, f UpdateMetricsFunction) {
+	s.RegisterWithInterval(name, f, s.DefaultInterval())
+}
+
+// RegisterWithInterval registers a function to run every interval. If the
+// function is already registered with another interval, it is moved.
+func (s *Scheduler) RegisterWithInterval(name string, f UpdateMetricsFunction, interval time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	previous := s.interval(name)
+
+	s.unregister(name)
+	s.register(name, f, interval)
+
+	// Function processes are only spawned when the interval processes start
+	// so a function new to interval requires to restart them.
+	if (previous == nil || *previous != interval) && len(s.cancels) > 0 {
+		s.restart()
+	}
+
+	s.notify()
+}
+
+// RegisterWithCron registers a function to run on schedule. If the function
+// is already registered, it is moved.
+func (s *Scheduler) RegisterWithCron(name string, f UpdateMetricsFunction, schedule *cron.Schedule) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.unregister(name)
+	s.registerCron(name, f, schedule)
+
+	if len(s.cancels) > 0 {
+		s.restart()
+	}
+
+	s.notify()
+}
+
+// Unregister unregisters a function and returns it. The function can be
+// registered again later with Reschedule().
+func (s *Scheduler) Unregister(name string) UpdateMetricsFunction {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.unregister(name)
+}
+
+// Reschedule moves a function which has been registered once to interval
+// and restarts the interval processes. A zero interval unregisters it.
+func (s *Scheduler) Reschedule(name string, interval time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	f, ok := s.functions[name]
+
+	if !ok {
+		return fmt.Errorf("unknown update metrics function `%s`", name)
+	}
+
+	current := s.interval(name)
+	_, cron := s.crons[name]
+
+	switch {
+	case interval == 0 && current == nil && !cron:
+		return nil
+	case interval == 0:
+		s.unregister(name)
+	case current != nil && *current == interval:
+		return nil
+	default:
+		s.unregister(name)
+		s.register(name, f, interval)
+	}
+
+	s.restart()
+
+	return nil
+}
+
+// RescheduleCron moves a function which has been registered once to
+// schedule and restarts the processes.
+func (s *Scheduler) RescheduleCron(name string, schedule *cron.Schedule) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	f, ok := s.functions[name]
+
+	if !ok {
+		return fmt.Errorf("unknown update metrics function `%s`", name)
+	}
+
+	if current, ok := s.crons[name]; ok && current.schedule.String() == schedule.String() {
+		return nil
+	}
+
+	s.unregister(name)
+	s.registerCron(name, f, schedule)
+	s.restart()
+
+	return nil
+}
+
+// Function returns the function registered once as `name`, whether it is
+// currently registered or not.
+func (s *Scheduler) Function(name string) UpdateMetricsFunction {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.functions[name]
+}
+
+// Interval returns the interval the function is currently registered at, or
+// nil if it is not registered.
+func (s *Scheduler) Interval(name string) *time.Duration {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.interval(name)
+}
+
+// Cron returns the cron schedule the function is currently registered with,
+// or nil if it is not registered with a cron schedule.
+func (s *Scheduler) Cron(name string) *cron.Schedule {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if c, ok := s.crons[name]; ok {
+		return c.schedule
+	}
+
+	return nil
+}
+
+// SetOverlapPolicy sets the overlap policy of the function `name`.
+func (s *Scheduler) SetOverlapPolicy(name string, policy OverlapPolicy) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.functionRuns(name).policy = policy
+}
+
+// OverlapPolicy returns the overlap policy of the function `name`.
+func (s *Scheduler) OverlapPolicy(name string) OverlapPolicy {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if runs, ok := s.runs[name]; ok {
+		return runs.policy
+	}
+
+	return DefaultOverlapPolicy
+}
+
+// SetFunctionOptions sets the run options of the function `name`. They
+// apply from its next run, jitter applies once the processes are restarted.
+func (s *Scheduler) SetFunctionOptions(name string, options FunctionOptions) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	runs := s.functionRuns(name)
+	runs.options = options
+
+	if options.Backoff <= 0 {
+		runs.notBefore = time.Time{}
+		s.metrics.backoff.WithLabelValues(name).Set(0)
+	}
+}
+
+// FunctionOptions returns the run options of the function `name`.
+func (s *Scheduler) FunctionOptions(name string) FunctionOptions {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if runs, ok := s.runs[name]; ok {
+		return runs.options
+	}
+
+	return FunctionOptions{}
+}
+
+// Functions returns the state of the functions registered once, sorted by
+// name.
+func (s *Scheduler) Functions() []FunctionStatus {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	statuses := make([]FunctionStatus, 0, len(s.functions))
+
+	for name := range s.functions {
+		status := FunctionStatus{
+			Name:    name,
+			Overlap: DefaultOverlapPolicy,
+		}
+
+		if interval := s.interval(name); interval != nil {
+			status.Interval = *interval
+		}
+
+		if c, ok := s.crons[name]; ok {
+			status.Cron = c.schedule
+		}
+
+		if runs, ok := s.runs[name]; ok {
+			status.MinRefreshAge = runs.onDemand
+			status.Overlap = runs.policy
+			status.InFlight = runs.inFlight
+			status.LastRun = runs.lastRun
+			status.LastError = runs.lastError
+			status.LastErrorTime = runs.lastErrorTime
+
+			switch {
+			case runs.next.IsZero():
+			case status.Interval > 0:
+				status.NextRun = nextRunAfter(runs.next, status.Interval, runs.notBefore)
+			case status.Cron != nil:
+				status.NextRun = runs.next
+
+				for !status.NextRun.IsZero() && status.NextRun.Before(runs.notBefore) {
+					status.NextRun = status.Cron.Next(status.NextRun)
+				}
+			}
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+
+	return statuses
+}
+
+// Trigger runs the function `name` now, in the context of its process. Its
+// overlap policy applies but backoff does not.
+func (s *Scheduler) Trigger(name string) (RunStatus, error) {
+	now := s.clock.Now()
+
+	s.mutex.RLock()
+	f, ok := s.functions[name]
+	var ctx context.Context
+	var interval time.Duration
+	scheduled := true
+
+	if current := s.interval(name); current != nil {
+		ctx = s.contexts[intervalProcessKey(*current)]
+		interval = *current
+	} else if c, isCron := s.crons[name]; isCron {
+		ctx = s.contexts[cronProcessKey(name)]
+		interval = c.schedule.Next(now).Sub(now)
+	} else if runs, onDemand := s.runs[name]; onDemand && runs.onDemand > 0 {
+		ctx = s.root
+		interval = runs.onDemand
+	} else {
+		scheduled = false
+	}
+	s.mutex.RUnlock()
+
+	switch {
+	case !ok:
+		return "", fmt.Errorf("unknown update metrics function `%s`", name)
+	case !scheduled:
+		return "", fmt.Errorf("update metrics function `%s` is not scheduled", name)
+	case ctx == nil:
+		return "", fmt.Errorf("update metrics function `%s` is not running", name)
+	}
+
+	processLogger := log.WithFields(log.Fields{
+		"_id":       "00000000",
+		"_interval": interval,
+	})
+
+	processLogger.Infof("Function `%s` triggered", name)
+
+	return s.start(&scheduledRun{
+		ctx:           ctx,
+		processLogger: processLogger,
+		interval:      interval,
+		name:          name,
+		f:             f,
+		t:             now,
+		triggered:     true,
+	}), nil
+}
+
+// Running returns the number of runs currently going.
+func (s *Scheduler) Running() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.running
+}
+
+// Wait waits until no run is going or ctx is done, in which case it returns
+// the error of ctx.
+func (s *Scheduler) Wait(ctx context.Context) error {
+	s.mutex.Lock()
+	if s.running == 0 {
+		s.mutex.Unlock()
+		return nil
+	}
+
+	drained := make(chan struct{})
+	s.drained = append(s.drained, drained)
+	s.mutex.Unlock()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SetOnDemand takes the function `name` out of its schedule and makes it
+// run when it is collected, if its metrics are older than minAge. A zero
+// minAge makes it a scheduled function again, which needs to be registered
+// with an interval or a cron schedule.
+func (s *Scheduler) SetOnDemand(name string, minAge time.Duration) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if _, ok := s.functions[name]; !ok {
+		return fmt.Errorf("unknown update metrics function `%s`", name)
+	}
+
+	s.functionRuns(name).onDemand = minAge
+
+	if minAge > 0 && (s.interval(name) != nil || s.crons[name] != nil) {
+		s.unregister(name)
+		s.restart()
+	}
+
+	return nil
+}
+
+// SetRefreshWait sets the maximum time a collection waits for the refresh of
+// a function collected on demand before serving its previous metrics.
+func (s *Scheduler) SetRefreshWait(wait time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.refreshWait = wait
+}
+
+// Refresh runs the function `name` unless its metrics are more recent than
+// its minimum refresh age or it is backing off. Concurrent calls share the
+// same run. It returns when the run ends or ctx is done, in which case the
+// run goes on.
+func (s *Scheduler) Refresh(ctx context.Context, name string) error {
+	s.mutex.Lock()
+	f, ok := s.functions[name]
+
+	if !ok {
+		s.mutex.Unlock()
+		return fmt.Errorf("unknown update metrics function `%s`", name)
+	}
+
+	runs := s.functionRuns(name)
+	now := s.clock.Now()
+
+	if (!runs.refreshed.IsZero() && now.Sub(runs.refreshed) < runs.onDemand) || now.Before(runs.notBefore) {
+		s.mutex.Unlock()
+		return nil
+	}
+
+	refreshing := runs.refreshing
+
+	if refreshing == nil {
+		refreshing = make(chan struct{})
+		runs.refreshing = refreshing
+
+		root := s.root
+
+		if root == nil {
+			root = context.Background()
+		}
+
+		run := &scheduledRun{
+			ctx: root,
+			processLogger: log.WithFields(log.Fields{
+				"_id":       "00000000",
+				"_interval": runs.onDemand,
+			}),
+			interval:  runs.onDemand,
+			name:      name,
+			f:         f,
+			t:         now,
+			triggered: true,
+		}
+
+		runs.lastRun = now
+		runs.inFlight++
+		s.running++
+		s.metrics.inFlight.WithLabelValues(name).Set(float64(runs.inFlight))
+
+		go func() {
+			s.run(run)
+
+			s.mutex.Lock()
+			runs.refreshed = s.clock.Now()
+			runs.refreshing = nil
+			s.mutex.Unlock()
+
+			close(refreshing)
+		}()
+	}
+	s.mutex.Unlock()
+
+	select {
+	case <-refreshing:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Restart cancels the interval processes and everything they run so that
+// Run() spawns them again.
+func (s *Scheduler) Restart() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.restart()
+}
+
+// Run spawns one process per interval which runs the functions registered
+// with it and one process per function registered with a cron schedule, and
+// spawns them again when they are restarted. It returns when ctx is
+// canceled.
+// This method loops until then so it needs to be detached.
+func (s *Scheduler) Run(ctx context.Context) {
+	s.mutex.Lock()
+	s.root = ctx
+	s.mutex.Unlock()
+
+	for {
+		wg := sync.WaitGroup{}
+
+		s.mutex.Lock()
+		for interval, functions := range s.intervals {
+			if len(functions) == 0 {
+				continue
+			}
+
+			intervalCtx, cancel := context.WithCancel(ctx)
+			s.cancels[intervalProcessKey(interval)] = cancel
+			s.contexts[intervalProcessKey(interval)] = intervalCtx
+
+			wg.Add(1)
+			go func(ctx context.Context, interval time.Duration) {
+				defer wg.Done()
+				s.runInterval(ctx, interval)
+			}(intervalCtx, interval)
+		}
+		for name, c := range s.crons {
+			cronCtx, cancel := context.WithCancel(ctx)
+			s.cancels[cronProcessKey(name)] = cancel
+			s.contexts[cronProcessKey(name)] = cronCtx
+
+			wg.Add(1)
+			go func(ctx context.Context, name string, c *cronFunction) {
+				defer wg.Done()
+				s.runCron(ctx, name, c)
+			}(cronCtx, name, c)
+		}
+		spawned := len(s.cancels)
+		s.mutex.Unlock()
+
+		if spawned == 0 {
+			select {
+			case <-s.wakeup:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		wg.Wait()
+
+		s.mutex.Lock()
+		for key, cancel := range s.cancels {
+			cancel()
+			delete(s.cancels, key)
+			delete(s.contexts, key)
+		}
+		s.mutex.Unlock()
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// register registers f with interval. s.mutex must be held.
+func (s *Scheduler) register(name string, f UpdateMetricsFunction, interval time.Duration) {
+	if _, ok := s.functions[name]; !ok {
+		s.functions[name] = f
+	}
+
+	if s.intervals[interval] == nil {
+		s.intervals[interval] = make(map[string]UpdateMetricsFunction)
+	}
+
+	s.intervals[interval][name] = f
+}
+
+// registerCron registers f with schedule. s.mutex must be held.
+func (s *Scheduler) registerCron(name string, f UpdateMetricsFunction, schedule *cron.Schedule) {
+	if _, ok := s.functions[name]; !ok {
+		s.functions[name] = f
+	}
+
+	s.crons[name] = &cronFunction{schedule: schedule, f: f}
+}
+
+// unregister unregisters the function `name`. s.mutex must be held.
+func (s *Scheduler) unregister(name string) UpdateMetricsFunction {
+	if c, ok := s.crons[name]; ok {
+		delete(s.crons, name)
+		return c.f
+	}
+
+	for interval, functions := range s.intervals {
+		if f, ok := functions[name]; ok {
+			delete(functions, name)
+
+			if len(functions) == 0 {
+				delete(s.intervals, interval)
+			}
+
+			return f
+		}
+	}
+
+	return nil
+}
+
+// interval returns the interval of the function `name`. s.mutex must be
+// held.
+func (s *Scheduler) interval(name string) *time.Duration {
+	for interval, functions := range s.intervals {
+		if _, ok := functions[name]; ok {
+			return &interval
+		}
+	}
+
+	return nil
+}
+
+// restart cancels the interval processes. s.mutex must be held.
+func (s *Scheduler) restart() {
+	for _, cancel := range s.cancels {
+		cancel()
+	}
+
+	s.notify()
+}
+
+// notify wakes up Run() if it is waiting for functions to be registered.
+func (s *Scheduler) notify() {
+	select {
+	case s.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// functionsWithInterval returns a copy of the functions registered with
+// interval.
+func (s *Scheduler) functionsWithInterval(interval time.Duration) map[string]UpdateMetricsFunction {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	functions := make(map[string]UpdateMetricsFunction, len(s.intervals[interval]))
+
+	for name, f := range s.intervals[interval] {
+		functions[name] = f
+	}
+
+	return functions
+}
+
+// runInterval is the process running update metrics functions every
+// interval. It is spawned as goroutines by Run(), one for each interval, and
+// runs each function registered with interval in its own goroutine.
+func (s *Scheduler) runInterval(ctx context.Context, interval time.Duration) {
+	processLogger := log.WithFields(log.Fields{
+		"_id":       "00000000",
+		"_interval": interval,
+	})
+
+	processLogger.Infof("Start interval update metrics process: %s", interval)
+
+	wg := sync.WaitGroup{}
+
+	for name, f := range s.functionsWithInterval(interval) {
+		wg.Add(1)
+		go func(name string, f UpdateMetricsFunction) {
+			defer wg.Done()
+			s.runFunction(ctx, processLogger, interval, name, f)
+		}(name, f)
+	}
+
+	wg.Wait()
+}
+
+// runFunction runs the function `name` every interval until ctx is canceled.
+func (s *Scheduler) runFunction(ctx context.Context, processLogger *log.Entry, interval time.Duration, name string, f UpdateMetricsFunction) {
+	wait := s.firstRunDelay(name, interval)
+	waiter := s.clock.NewTimer(wait)
+	defer waiter.Stop()
+
+	processLogger.Infof("Waiting before starting to update metrics with `%s`: %s", name, wait.Round(time.Second))
+	s.setNextRun(name, s.clock.Now().Add(wait))
+
+	// Wait for time sync or cancellation of context (reload).
+	select {
+	case <-waiter.C():
+	case <-ctx.Done():
+		processLogger.Infof("Interval process context has been canceled during initial time sync")
+		return
+	}
+
+	ticker := s.clock.NewTicker(interval)
+	defer ticker.Stop()
+
+	t := s.clock.Now()
+
+	for {
+		// The function may have been unregistered since the process started.
+		if s.isRegisteredWith(name, interval) {
+			s.metrics.interval.WithLabelValues(name).Set(interval.Seconds())
+
+			s.start(&scheduledRun{
+				ctx:           ctx,
+				processLogger: processLogger,
+				interval:      interval,
+				name:          name,
+				f:             f,
+				t:             t,
+			})
+		}
+
+		s.setNextRun(name, t.Add(interval))
+
+		// wait for ticker or cancellation of context (reload).
+		select {
+		case t = <-ticker.C():
+		case <-ctx.Done():
+			processLogger.Infof("Interval process context has been canceled during waiting")
+			return
+		}
+	}
+}
+
+// firstRunDelay returns the time to wait before the first run of the
+// function `name`. Functions without jitter are aligned on interval, the
+// others start at a random time within their jitter.
+func (s *Scheduler) firstRunDelay(name string, interval time.Duration) time.Duration {
+	jitter := s.FunctionOptions(name).Jitter
+
+	if jitter <= 0 {
+		return alignmentDelay(s.clock.Now(), interval)
+	}
+
+	return time.Duration(s.random(int64(jitter)))
+}
+
+// setNextRun records the time of the next tick of the function process.
+func (s *Scheduler) setNextRun(name string, next time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.functionRuns(name).next = next
+	s.metrics.nextRun.WithLabelValues(name).Set(float64(next.Unix()))
+}
+
+// nextRunAfter returns the first tick from next, every interval, which is
+// not before notBefore.
+func nextRunAfter(next time.Time, interval time.Duration, notBefore time.Time) time.Time {
+	if !next.Before(notBefore) {
+		return next
+	}
+
+	ticks := (notBefore.Sub(next) + interval - 1) / interval
+
+	return next.Add(ticks * interval)
+}
+
+// isRegisteredWith returns true if the function `name` is currently
+// registered with interval.
+func (s *Scheduler) isRegisteredWith(name string, interval time.Duration) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	_, ok := s.intervals[interval][name]
+
+	return ok
+}
+
+// cronFunction is a function registered with a cron schedule.
+type cronFunction struct {
+	schedule *cron.Schedule
+	f        UpdateMetricsFunction
+}
+
+// intervalProcessKey returns the key of the process of interval.
+func intervalProcessKey(interval time.Duration) string {
+	return "interval:" + interval.String()
+}
+
+// cronProcessKey returns the key of the cron process of the function `name`.
+func cronProcessKey(name string) string {
+	return "cron:" + name
+}
+
+// runCron is the process running the function `name` on its cron schedule.
+// It is spawned as a goroutine by Run(), one for each cron function.
+func (s *Scheduler) runCron(ctx context.Context, name string, c *cronFunction) {
+	processLogger := log.WithFields(log.Fields{
+		"_id":   "00000000",
+		"_cron": c.schedule.String(),
+	})
+
+	processLogger.Infof("Start cron update metrics process for `%s`: %s", name, c.schedule)
+
+	next := c.schedule.Next(s.clock.Now())
+
+	for {
+		if next.IsZero() {
+			processLogger.Warnf("Cron schedule of `%s` never matches", name)
+			<-ctx.Done()
+			return
+		}
+
+		s.setNextRun(name, next)
+
+		waiter := s.clock.NewTimer(next.Sub(s.clock.Now()))
+
+		// Wait for the next planned run or cancellation of context (reload).
+		select {
+		case <-waiter.C():
+		case <-ctx.Done():
+			waiter.Stop()
+			processLogger.Infof("Cron process context has been canceled during waiting")
+			return
+		}
+
+		t := next
+		next = c.schedule.Next(t)
+		interval := next.Sub(t)
+
+		// The interval gauge exposes the time until the following run.
+		s.metrics.interval.WithLabelValues(name).Set(interval.Seconds())
+
+		s.start(&scheduledRun{
+			ctx:           ctx,
+			processLogger: processLogger,
+			interval:      interval,
+			name:          name,
+			f:             c.f,
+			t:             t,
+		})
+	}
+}
+
+// functionRuns holds the runs state of a function.
+type functionRuns struct {
+	policy   OverlapPolicy
+	options  FunctionOptions
+	inFlight int
+	queued   *scheduledRun
+	// Number of runs which failed since the last success.
+	failures int
+	// Runs scheduled before this time are skipped because of backoff.
+	notBefore time.Time
+	// Minimum age of the metrics before the function runs again when it
+	// is collected, zero if it is not collected on demand.
+	onDemand time.Duration
+	// End of the last run started by Refresh() and channel closed when the
+	// current one ends.
+	refreshed  time.Time
+	refreshing chan struct{}
+	// Time of the next tick of the function process.
+	next          time.Time
+	lastRun       time.Time
+	lastError     error
+	lastErrorTime time.Time
+}
+
+// scheduledRun is a run of an update metrics function.
+type scheduledRun struct {
+	ctx           context.Context
+	processLogger *log.Entry
+	interval      time.Duration
+	name          string
+	f             UpdateMetricsFunction
+	t             time.Time
+	// Triggered runs are not subject to backoff.
+	triggered bool
+}
+
+// functionRuns returns the runs state of the function `name`. s.mutex must
+// be held.
+func (s *Scheduler) functionRuns(name string) *functionRuns {
+	runs, ok := s.runs[name]
+
+	if !ok {
+		runs = &functionRuns{policy: DefaultOverlapPolicy}
+		s.runs[name] = runs
+	}
+
+	return runs
+}
+
+// start starts the run unless the previous run of the function is still
+// going, in which case the overlap policy of the function applies.
+func (s *Scheduler) start(run *scheduledRun) RunStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	runs := s.functionRuns(run.name)
+
+	if !run.triggered && run.t.Before(runs.notBefore) {
+		run.processLogger.Debugf("Function `%s` backing off until %v", run.name, runs.notBefore)
+		return RunBackingOff
+	}
+
+	switch {
+	case runs.inFlight == 0 || runs.policy == OverlapAllow:
+	case runs.policy == OverlapQueueOne && runs.queued == nil:
+		runs.queued = run
+		return RunQueued
+	default:
+		s.metrics.skipped.WithLabelValues(run.name).Inc()
+		run.processLogger.Warnf("Function `%s` skipped because its previous run is still going", run.name)
+		return RunSkipped
+	}
+
+	runs.lastRun = s.clock.Now()
+	runs.inFlight++
+	s.running++
+	s.metrics.inFlight.WithLabelValues(run.name).Set(float64(runs.inFlight))
+
+	// We detach the update process so that if it takes more than the refresh
+	// time it does not get blocked
+	go s.run(run)
+
+	return RunStarted
+}
+
+// done accounts the end of a run of the function, updates its backoff state
+// according to err and starts the queued run if any.
+func (s *Scheduler) done(run *scheduledRun, err error) {
+	name := run.name
+
+	s.mutex.Lock()
+	runs := s.functionRuns(name)
+	runs.inFlight--
+	s.running--
+
+	if s.running == 0 {
+		for _, c := range s.drained {
+			close(c)
+		}
+
+		s.drained = nil
+	}
+	s.metrics.inFlight.WithLabelValues(name).Set(float64(runs.inFlight))
+
+	switch {
+	case err == nil:
+		runs.failures = 0
+		runs.notBefore = time.Time{}
+		s.metrics.runs.WithLabelValues(name, "success").Inc()
+		s.metrics.lastSuccess.WithLabelValues(name).Set(float64(s.clock.Now().Unix()))
+		s.metrics.failures.WithLabelValues(name).Set(0)
+		s.metrics.up.WithLabelValues(name).Set(1)
+	case run.ctx.Err() != nil:
+		// Runs interrupted by a restart do not count as failures.
+	default:
+		runs.failures++
+		runs.lastError = err
+		runs.lastErrorTime = s.clock.Now()
+		s.metrics.runs.WithLabelValues(name, "failure").Inc()
+		s.metrics.lastError.WithLabelValues(name).Set(float64(s.clock.Now().Unix()))
+		s.metrics.failures.WithLabelValues(name).Set(float64(runs.failures))
+		s.metrics.up.WithLabelValues(name).Set(0)
+		s.metrics.errors.WithLabelValues(name, string(azure.ClassifyError(err))).Inc()
+
+		if runs.options.Backoff > 0 {
+			delay := backoffDelay(run.interval, runs.options.Backoff, runs.failures)
+			runs.notBefore = run.t.Add(delay)
+			run.processLogger.Warnf("Function `%s` failed %d times in a row, next run in %v", name, runs.failures, delay)
+		}
+	}
+
+	if runs.notBefore.IsZero() {
+		s.metrics.backoff.WithLabelValues(name).Set(0)
+	} else {
+		s.metrics.backoff.WithLabelValues(name).Set((runs.notBefore.Sub(run.t) - run.interval).Seconds())
+	}
+
+	queued := runs.queued
+	runs.queued = nil
+	s.mutex.Unlock()
+
+	// Queued runs of restarted interval processes are dropped.
+	if queued != nil && queued.ctx.Err() == nil {
+		s.start(queued)
+	}
+}
+
+// call calls the function of run, turning a panic into an error. Panics in
+// goroutines started by the function are not recovered here, the goroutines
+// must defer recoverPanic().
+func (s *Scheduler) call(ctx context.Context, run *scheduledRun, logger *log.Entry) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.metrics.panics.WithLabelValues(run.name).Inc()
+			logger.Errorf("Function `%s` panicked: %v\n%s", run.name, r, debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return run.f(ctx)
+}
+
+// recoverPanic must be deferred by the goroutines started by the update
+// metrics function `name`. It recovers their panics, counts them along with
+// the ones of the function and calls onPanic with the error they turn into.
+func (s *Scheduler) recoverPanic(name string, logger *log.Entry, onPanic func(error)) {
+	if r := recover(); r != nil {
+		s.metrics.panics.WithLabelValues(name).Inc()
+		logger.Errorf("Goroutine of function `%s` panicked: %v\n%s", name, r, debug.Stack())
+		onPanic(fmt.Errorf("panic: %v", r))
+	}
+}
+
+// run runs an update metrics function and reports its duration.
+func (s *Scheduler) run(run *scheduledRun) {
+	var err error
+	defer func() { s.done(run, err) }()
+
+	id := processHash(run.t, run.name)
+	functionLogger := run.processLogger.WithFields(log.Fields{
+		"_id":       id,
+		"_interval": run.interval,
+		"_func":     run.name,
+	})
+
+	ctx := context.WithValue(run.ctx, "id", id)
+
+	if timeout := s.FunctionOptions(run.name).Timeout; timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	functionLogger.Debugf("Start update metrics function")
+
+	// Run update metrics function
+	t0 := s.clock.Now()
+	err = s.call(ctx, run, functionLogger)
+	t1 := s.clock.Now().Sub(t0)
+
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		functionLogger.Errorf("Function `%s` did not complete within its timeout: %v", run.name, err)
+	}
+
+	// metrics
+	if err == nil {
+		s.metrics.duration.WithLabelValues(run.name).Observe(t1.Seconds())
+		s.metrics.lastDuration.WithLabelValues(run.name).Set(t1.Seconds())
+	}
+
+	functionLogger.Debugf("End update metrics function in %v", t1.Round(time.Millisecond))
+
+	// Warning if update metrics function takes more time than the
+	// interval it is registered with.
+	if t1 > run.interval {
+		s.metrics.exceeding.WithLabelValues(run.name, run.interval.String()).Inc()
+		run.processLogger.Warnf("Function `%s` took %v, you should register this function with a greater interval", run.name, t1.Round(time.Millisecond))
+	}
+}
+
+// alignmentDelay returns the time to wait from now until the next multiple
+// of interval since the Unix epoch so that update processes start at round
+// times.
+func alignmentDelay(now time.Time, interval time.Duration) time.Duration {
+	if interval <= 0 {
+		return 0
+	}
+
+	return interval - time.Duration(now.UnixNano()%int64(interval))
+}
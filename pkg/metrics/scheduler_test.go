@@ -0,0 +1,793 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sylr/prometheus-azure-exporter/pkg/azure"
+	"github.com/sylr/prometheus-azure-exporter/pkg/cron"
+)
+
+// fakeClock is a Clock whose time only moves with Advance().
+type fakeClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// fakeTimer is the Timer of fakeClock, fakeTicker wraps it as a Ticker.
+type fakeTimer struct {
+	clock  *fakeClock
+	c      chan time.Time
+	when   time.Time
+	period time.Duration
+	active bool
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	return c.newTimer(d, 0)
+}
+
+func (c *fakeClock) NewTicker(d time.Duration) Ticker {
+	return fakeTicker{c.newTimer(d, d)}
+}
+
+func (c *fakeClock) newTimer(d time.Duration, period time.Duration) *fakeTimer {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	t := &fakeTimer{
+		clock:  c,
+		c:      make(chan time.Time, 1),
+		when:   c.now.Add(d),
+		period: period,
+		active: true,
+	}
+	c.timers = append(c.timers, t)
+
+	return t
+}
+
+// Advance moves the time forward and fires the timers which expired.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now = c.now.Add(d)
+
+	for _, t := range c.timers {
+		if !t.active || t.when.After(c.now) {
+			continue
+		}
+
+		select {
+		case t.c <- c.now:
+		default:
+		}
+
+		if t.period == 0 {
+			t.active = false
+			continue
+		}
+
+		for !t.when.After(c.now) {
+			t.when = t.when.Add(t.period)
+		}
+	}
+}
+
+// WaitForTimers waits until the active timers are the ones firing after the
+// given delays.
+func (c *fakeClock) WaitForTimers(t *testing.T, delays ...time.Duration) {
+	expected := fmt.Sprint(sortDurations(delays))
+	deadline := time.Now().Add(5 * time.Second)
+	got := ""
+
+	for time.Now().Before(deadline) {
+		active := make([]time.Duration, 0)
+
+		c.mutex.Lock()
+		for _, timer := range c.timers {
+			if timer.active {
+				active = append(active, timer.when.Sub(c.now))
+			}
+		}
+		c.mutex.Unlock()
+
+		if got = fmt.Sprint(sortDurations(active)); got == expected {
+			return
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatalf("Expected %v but got %v", expected, got)
+}
+
+func sortDurations(durations []time.Duration) []time.Duration {
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	return durations
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mutex.Lock()
+	defer t.clock.mutex.Unlock()
+
+	active := t.active
+	t.active = false
+
+	return active
+}
+
+type fakeTicker struct {
+	*fakeTimer
+}
+
+func (t fakeTicker) Stop() {
+	t.fakeTimer.Stop()
+}
+
+// -----------------------------------------------------------------------------
+
+// recordRuns returns an update metrics function sending the ids of its runs
+// to the returned channel.
+func recordRuns() (UpdateMetricsFunction, chan string) {
+	runs := make(chan string, 10)
+
+	return func(ctx context.Context) error {
+		runs <- ctx.Value("id").(string)
+		return nil
+	}, runs
+}
+
+func expectRun(t *testing.T, runs chan string) {
+	select {
+	case <-runs:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the function to run")
+	}
+}
+
+func expectNoRun(t *testing.T, runs chan string) {
+	select {
+	case <-runs:
+		t.Fatalf("Expected the function not to run")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestAlignmentDelay(t *testing.T) {
+	tests := []struct {
+		now      time.Time
+		interval time.Duration
+		expected time.Duration
+	}{
+		{time.Date(2020, 1, 1, 0, 0, 10, 0, time.UTC), 30 * time.Second, 20 * time.Second},
+		{time.Date(2020, 1, 1, 0, 0, 30, 0, time.UTC), 30 * time.Second, 30 * time.Second},
+		{time.Date(2020, 1, 1, 0, 1, 10, 500, time.UTC), time.Minute, 50*time.Second - 500},
+		{time.Date(2020, 1, 1, 0, 59, 0, 0, time.UTC), time.Hour, time.Minute},
+		{time.Date(2020, 1, 1, 0, 0, 0, 300*int(time.Millisecond), time.UTC), time.Second, 700 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		if got := alignmentDelay(test.now, test.interval); got != test.expected {
+			t.Fatalf("Expected %v but got %v", test.expected, got)
+		}
+	}
+}
+
+func TestSchedulerRunsAlignedOnInterval(t *testing.T) {
+	clock := newFakeClock(time.Date(2020, 1, 1, 0, 0, 10, 0, time.UTC))
+	registry := prometheus.NewRegistry()
+	scheduler := NewScheduler(clock, registry)
+	f, runs := recordRuns()
+	scheduler.RegisterWithInterval("test", f, 30*time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go scheduler.Run(ctx)
+
+	clock.WaitForTimers(t, 20*time.Second)
+	clock.Advance(19 * time.Second)
+	expectNoRun(t, runs)
+
+	clock.Advance(time.Second)
+	expectRun(t, runs)
+
+	// The ticker replaces the alignment timer.
+	clock.WaitForTimers(t, 30*time.Second)
+	clock.Advance(29 * time.Second)
+	expectNoRun(t, runs)
+
+	clock.Advance(time.Second)
+	expectRun(t, runs)
+
+	if v := testutil.ToFloat64(scheduler.metrics.interval.WithLabelValues("test")); v != 30 {
+		t.Fatalf("Expected %v but got %v", 30, v)
+	}
+}
+
+func TestSchedulerReschedule(t *testing.T) {
+	clock := newFakeClock(time.Date(2020, 1, 1, 0, 0, 10, 0, time.UTC))
+	scheduler := NewScheduler(clock, nil)
+	f, runs := recordRuns()
+	scheduler.RegisterWithInterval("test", f, 30*time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go scheduler.Run(ctx)
+
+	clock.WaitForTimers(t, 20*time.Second)
+
+	if err := scheduler.Reschedule("test", time.Minute); err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+
+	if interval := scheduler.Interval("test"); interval == nil || *interval != time.Minute {
+		t.Fatalf("Expected %v but got %v", time.Minute, interval)
+	}
+
+	// The 30s process is canceled and a 1m process is waiting for the next
+	// minute.
+	clock.WaitForTimers(t, 50*time.Second)
+
+	clock.Advance(20 * time.Second)
+	expectNoRun(t, runs)
+
+	clock.Advance(30 * time.Second)
+	expectRun(t, runs)
+
+	// A zero interval unregisters the function.
+	if err := scheduler.Reschedule("test", 0); err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+
+	if interval := scheduler.Interval("test"); interval != nil {
+		t.Fatalf("Expected %v but got %v", nil, *interval)
+	}
+
+	clock.WaitForTimers(t)
+	clock.Advance(time.Minute)
+	expectNoRun(t, runs)
+
+	// The function is still known so it can be registered again.
+	if err := scheduler.Reschedule("test", 30*time.Second); err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+
+	clock.WaitForTimers(t, 30*time.Second)
+	clock.Advance(30 * time.Second)
+	expectRun(t, runs)
+
+	if err := scheduler.Reschedule("unknown", time.Minute); err == nil {
+		t.Fatalf("Expected an error for an unknown function")
+	}
+}
+
+func TestSchedulerUnregister(t *testing.T) {
+	scheduler := NewScheduler(newFakeClock(time.Now()), nil)
+	f, _ := recordRuns()
+	scheduler.Register("test", f)
+
+	if interval := scheduler.Interval("test"); interval == nil || *interval != 30*time.Second {
+		t.Fatalf("Expected %v but got %v", 30*time.Second, interval)
+	}
+
+	if scheduler.Unregister("test") == nil {
+		t.Fatalf("Expected the unregistered function to be returned")
+	}
+
+	if scheduler.Interval("test") != nil {
+		t.Fatalf("Expected the function to be unregistered")
+	}
+
+	if scheduler.Function("test") == nil {
+		t.Fatalf("Expected the function to still be known")
+	}
+}
+
+func TestSchedulerCancel(t *testing.T) {
+	clock := newFakeClock(time.Date(2020, 1, 1, 0, 0, 10, 0, time.UTC))
+	scheduler := NewScheduler(clock, nil)
+	canceled := make(chan struct{})
+	started := make(chan struct{})
+
+	scheduler.RegisterWithInterval("test", func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		close(canceled)
+		return ctx.Err()
+	}, 30*time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	go func() {
+		scheduler.Run(ctx)
+		close(done)
+	}()
+
+	clock.WaitForTimers(t, 20*time.Second)
+	clock.Advance(20 * time.Second)
+	<-started
+
+	cancel()
+
+	for _, c := range []chan struct{}{canceled, done} {
+		select {
+		case <-c:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected the scheduler to stop")
+		}
+	}
+
+	clock.WaitForTimers(t)
+}
+
+func TestSchedulerWaitsForRegistrations(t *testing.T) {
+	clock := newFakeClock(time.Date(2020, 1, 1, 0, 0, 10, 0, time.UTC))
+	scheduler := NewScheduler(clock, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go scheduler.Run(ctx)
+
+	f, runs := recordRuns()
+	scheduler.RegisterWithInterval("test", f, 10*time.Second)
+
+	clock.WaitForTimers(t, 10*time.Second)
+	clock.Advance(10 * time.Second)
+	expectRun(t, runs)
+}
+
+// blockingRuns returns an update metrics function which signals its start on
+// the returned channel and blocks until a value is sent on release.
+func blockingRuns() (UpdateMetricsFunction, chan string, chan struct{}) {
+	started := make(chan string, 10)
+	release := make(chan struct{})
+
+	return func(ctx context.Context) error {
+		started <- ctx.Value("id").(string)
+		<-release
+		return nil
+	}, started, release
+}
+
+// eventually waits for cond to be true.
+func eventually(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected condition to be met")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSchedulerOverlapPolicies(t *testing.T) {
+	tests := []struct {
+		policy           OverlapPolicy
+		expectedSkipped  float64
+		expectedInFlight float64
+		expectedStarts   int
+	}{
+		// Second tick skipped, third tick skipped.
+		{OverlapSkip, 2, 1, 1},
+		// Second tick queued, third tick skipped.
+		{OverlapQueueOne, 1, 1, 1},
+		// Every tick starts a run.
+		{OverlapAllow, 0, 3, 3},
+	}
+
+	for _, test := range tests {
+		clock := newFakeClock(time.Date(2020, 1, 1, 0, 0, 10, 0, time.UTC))
+		scheduler := NewScheduler(clock, nil)
+		f, started, release := blockingRuns()
+		scheduler.RegisterWithInterval("test", f, 10*time.Second)
+		scheduler.SetOverlapPolicy("test", test.policy)
+
+		if policy := scheduler.OverlapPolicy("test"); policy != test.policy {
+			t.Fatalf("Expected %v but got %v", test.policy, policy)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go scheduler.Run(ctx)
+
+		clock.WaitForTimers(t, 10*time.Second)
+		clock.Advance(10 * time.Second)
+		<-started
+
+		for i := 0; i < 2; i++ {
+			clock.WaitForTimers(t, 10*time.Second)
+			clock.Advance(10 * time.Second)
+		}
+
+		skipped := scheduler.metrics.skipped.WithLabelValues("test")
+		inFlight := scheduler.metrics.inFlight.WithLabelValues("test")
+
+		eventually(t, func() bool {
+			return testutil.ToFloat64(skipped) == test.expectedSkipped &&
+				testutil.ToFloat64(inFlight) == test.expectedInFlight &&
+				len(started) == test.expectedStarts-1
+		})
+
+		// Releasing the first run starts the queued one, if any.
+		release <- struct{}{}
+
+		if test.policy == OverlapQueueOne {
+			expectRun(t, started)
+			release <- struct{}{}
+		}
+
+		close(release)
+
+		eventually(t, func() bool {
+			return testutil.ToFloat64(inFlight) == 0
+		})
+
+		cancel()
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	tests := []struct {
+		interval time.Duration
+		max      time.Duration
+		failures int
+		expected time.Duration
+	}{
+		{time.Minute, 0, 3, time.Minute},
+		{time.Minute, 10 * time.Minute, 0, time.Minute},
+		{time.Minute, 10 * time.Minute, 1, 2 * time.Minute},
+		{time.Minute, 10 * time.Minute, 3, 8 * time.Minute},
+		{time.Minute, 10 * time.Minute, 4, 10 * time.Minute},
+		{time.Minute, 10 * time.Minute, 100, 10 * time.Minute},
+	}
+
+	for _, test := range tests {
+		if got := backoffDelay(test.interval, test.max, test.failures); got != test.expected {
+			t.Fatalf("Expected %v but got %v", test.expected, got)
+		}
+	}
+}
+
+func TestSchedulerJitter(t *testing.T) {
+	clock := newFakeClock(time.Date(2020, 1, 1, 0, 0, 10, 0, time.UTC))
+	scheduler := NewScheduler(clock, nil)
+	scheduler.random = func(n int64) int64 { return n / 4 }
+	f, runs := recordRuns()
+	scheduler.RegisterWithInterval("test", f, time.Minute)
+	scheduler.SetFunctionOptions("test", FunctionOptions{Jitter: 20 * time.Second})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go scheduler.Run(ctx)
+
+	// The first run is not aligned on the minute.
+	clock.WaitForTimers(t, 5*time.Second)
+	clock.Advance(5 * time.Second)
+	expectRun(t, runs)
+
+	clock.WaitForTimers(t, time.Minute)
+	clock.Advance(time.Minute)
+	expectRun(t, runs)
+}
+
+func TestSchedulerBackoff(t *testing.T) {
+	clock := newFakeClock(time.Date(2020, 1, 1, 0, 0, 10, 0, time.UTC))
+	scheduler := NewScheduler(clock, nil)
+	runs := make(chan string, 10)
+	fail := make(chan bool, 10)
+
+	scheduler.RegisterWithInterval("test", func(ctx context.Context) error {
+		runs <- ctx.Value("id").(string)
+
+		if <-fail {
+			return fmt.Errorf("failure")
+		}
+
+		return nil
+	}, 10*time.Second)
+	scheduler.SetFunctionOptions("test", FunctionOptions{Backoff: 30 * time.Second})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go scheduler.Run(ctx)
+
+	backoff := scheduler.metrics.backoff.WithLabelValues("test")
+	expectBackoff := func(expected float64) {
+		eventually(t, func() bool { return testutil.ToFloat64(backoff) == expected })
+	}
+
+	// First failure: the interval is doubled.
+	fail <- true
+	clock.WaitForTimers(t, 10*time.Second)
+	clock.Advance(10 * time.Second)
+	expectRun(t, runs)
+	expectBackoff(10)
+
+	clock.WaitForTimers(t, 10*time.Second)
+	clock.Advance(10 * time.Second)
+	expectNoRun(t, runs)
+
+	// Second failure: the interval is capped by the backoff.
+	fail <- true
+	clock.Advance(10 * time.Second)
+	expectRun(t, runs)
+	expectBackoff(20)
+
+	for i := 0; i < 2; i++ {
+		clock.Advance(10 * time.Second)
+		expectNoRun(t, runs)
+	}
+
+	// A success restores the interval.
+	fail <- false
+	clock.Advance(10 * time.Second)
+	expectRun(t, runs)
+	expectBackoff(0)
+
+	fail <- false
+	clock.Advance(10 * time.Second)
+	expectRun(t, runs)
+}
+
+func TestSchedulerTimeout(t *testing.T) {
+	clock := newFakeClock(time.Date(2020, 1, 1, 0, 0, 10, 0, time.UTC))
+	scheduler := NewScheduler(clock, nil)
+	errs := make(chan error, 1)
+
+	scheduler.RegisterWithInterval("test", func(ctx context.Context) error {
+		<-ctx.Done()
+		errs <- ctx.Err()
+		return ctx.Err()
+	}, 10*time.Second)
+	scheduler.SetFunctionOptions("test", FunctionOptions{Timeout: 10 * time.Millisecond})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go scheduler.Run(ctx)
+
+	clock.WaitForTimers(t, 10*time.Second)
+	clock.Advance(10 * time.Second)
+
+	select {
+	case err := <-errs:
+		if err != context.DeadlineExceeded {
+			t.Fatalf("Expected %v but got %v", context.DeadlineExceeded, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected the run to time out")
+	}
+}
+
+func TestSchedulerHealthMetrics(t *testing.T) {
+	clock := newFakeClock(time.Date(2020, 1, 1, 0, 0, 10, 0, time.UTC))
+	scheduler := NewScheduler(clock, nil)
+	runs := make(chan string, 10)
+	errs := make(chan error, 10)
+
+	scheduler.RegisterWithInterval("test", func(ctx context.Context) error {
+		runs <- ctx.Value("id").(string)
+		return <-errs
+	}, 10*time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go scheduler.Run(ctx)
+
+	m := scheduler.metrics
+	expectValue := func(c prometheus.Collector, expected float64) {
+		eventually(t, func() bool { return testutil.ToFloat64(c) == expected })
+	}
+
+	for i := 0; i < 2; i++ {
+		errs <- fmt.Errorf("listing: %w", azure.ErrRateLimited)
+		clock.WaitForTimers(t, 10*time.Second)
+		clock.Advance(10 * time.Second)
+		expectRun(t, runs)
+	}
+
+	expectValue(m.runs.WithLabelValues("test", "failure"), 2)
+	expectValue(m.failures.WithLabelValues("test"), 2)
+	expectValue(m.errors.WithLabelValues("test", "throttled"), 2)
+	expectValue(m.up.WithLabelValues("test"), 0)
+	expectValue(m.lastError.WithLabelValues("test"), float64(clock.Now().Unix()))
+
+	errs <- nil
+	clock.Advance(10 * time.Second)
+	expectRun(t, runs)
+
+	expectValue(m.runs.WithLabelValues("test", "success"), 1)
+	expectValue(m.failures.WithLabelValues("test"), 0)
+	expectValue(m.up.WithLabelValues("test"), 1)
+	expectValue(m.lastSuccess.WithLabelValues("test"), float64(clock.Now().Unix()))
+}
+
+func TestSchedulerPanic(t *testing.T) {
+	clock := newFakeClock(time.Date(2020, 1, 1, 0, 0, 10, 0, time.UTC))
+	scheduler := NewScheduler(clock, nil)
+	runs := make(chan string, 10)
+	panics := make(chan bool, 10)
+
+	scheduler.RegisterWithInterval("test", func(ctx context.Context) error {
+		runs <- ctx.Value("id").(string)
+
+		if <-panics {
+			panic("boom")
+		}
+
+		return nil
+	}, 10*time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go scheduler.Run(ctx)
+
+	m := scheduler.metrics
+
+	// The panic is reported as a failure and the function keeps running.
+	panics <- true
+	clock.WaitForTimers(t, 10*time.Second)
+	clock.Advance(10 * time.Second)
+	expectRun(t, runs)
+
+	eventually(t, func() bool { return testutil.ToFloat64(m.panics.WithLabelValues("test")) == 1 })
+	eventually(t, func() bool { return testutil.ToFloat64(m.runs.WithLabelValues("test", "failure")) == 1 })
+
+	panics <- false
+	clock.Advance(10 * time.Second)
+	expectRun(t, runs)
+
+	eventually(t, func() bool { return testutil.ToFloat64(m.runs.WithLabelValues("test", "success")) == 1 })
+}
+
+func TestNextRunAfter(t *testing.T) {
+	next := time.Date(2020, 1, 1, 0, 1, 0, 0, time.UTC)
+
+	tests := []struct {
+		notBefore time.Time
+		expected  time.Time
+	}{
+		{time.Time{}, next},
+		{next, next},
+		{next.Add(30 * time.Second), next.Add(time.Minute)},
+		{next.Add(2 * time.Minute), next.Add(2 * time.Minute)},
+	}
+
+	for _, test := range tests {
+		if got := nextRunAfter(next, time.Minute, test.notBefore); !got.Equal(test.expected) {
+			t.Fatalf("Expected %v but got %v", test.expected, got)
+		}
+	}
+}
+
+func TestSchedulerCron(t *testing.T) {
+	clock := newFakeClock(time.Date(2020, 1, 1, 0, 0, 10, 0, time.UTC))
+	scheduler := NewScheduler(clock, nil)
+	schedule, _ := cron.Parse("*/5 * * * *")
+	f, runs := recordRuns()
+	g, intervalRuns := recordRuns()
+	scheduler.RegisterWithCron("cron", f, schedule)
+	scheduler.RegisterWithInterval("interval", g, time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go scheduler.Run(ctx)
+
+	// Both kinds of functions run side by side.
+	clock.WaitForTimers(t, 50*time.Second, 4*time.Minute+50*time.Second)
+
+	nextRun := scheduler.metrics.nextRun.WithLabelValues("cron")
+	expected := float64(time.Date(2020, 1, 1, 0, 5, 0, 0, time.UTC).Unix())
+
+	if v := testutil.ToFloat64(nextRun); v != expected {
+		t.Fatalf("Expected %v but got %v", expected, v)
+	}
+
+	clock.Advance(50 * time.Second)
+	expectRun(t, intervalRuns)
+	expectNoRun(t, runs)
+
+	clock.WaitForTimers(t, time.Minute, 4*time.Minute)
+	clock.Advance(4 * time.Minute)
+	expectRun(t, runs)
+
+	clock.WaitForTimers(t, time.Minute, 5*time.Minute)
+
+	if v := testutil.ToFloat64(scheduler.metrics.interval.WithLabelValues("cron")); v != 300 {
+		t.Fatalf("Expected %v but got %v", 300, v)
+	}
+
+	// Moving the function to an interval stops the cron process.
+	if err := scheduler.Reschedule("cron", 10*time.Minute); err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+
+	if scheduler.Cron("cron") != nil {
+		t.Fatalf("Expected the cron schedule to be removed")
+	}
+
+	clock.WaitForTimers(t, time.Minute, 5*time.Minute)
+
+	// And back to a cron schedule.
+	schedule, _ = cron.Parse("0 1 * * *")
+
+	if err := scheduler.RescheduleCron("cron", schedule); err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+
+	clock.WaitForTimers(t, time.Minute, 55*time.Minute)
+}
+
+func TestSchedulerWait(t *testing.T) {
+	clock := newFakeClock(time.Date(2020, 1, 1, 0, 0, 10, 0, time.UTC))
+	scheduler := NewScheduler(clock, nil)
+	f, started, release := blockingRuns()
+	scheduler.RegisterWithInterval("test", f, 10*time.Second)
+
+	if err := scheduler.Wait(context.Background()); err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go scheduler.Run(ctx)
+
+	clock.WaitForTimers(t, 10*time.Second)
+	clock.Advance(10 * time.Second)
+	<-started
+
+	if running := scheduler.Running(); running != 1 {
+		t.Fatalf("Expected %v but got %v", 1, running)
+	}
+
+	// The grace period expires.
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer waitCancel()
+
+	if err := scheduler.Wait(waitCtx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected %v but got %v", context.DeadlineExceeded, err)
+	}
+
+	// The run ends within the grace period.
+	done := make(chan error)
+
+	go func() {
+		done <- scheduler.Wait(context.Background())
+	}()
+
+	close(release)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Expected no error but got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Expected Wait() to return")
+	}
+}
@@ -0,0 +1,325 @@
+package metrics
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Snapshot is a prometheus.Collector serving the metrics published by an
+// update metrics function. Each call to Publish() replaces all the metrics
+// at once so that scrapes always see a complete generation, never a mix of
+// two runs.
+type Snapshot struct {
+	clock      Clock
+	descs      []*prometheus.Desc
+	generation *prometheus.Desc
+	age        *prometheus.Desc
+	dataAge    *prometheus.Desc // nil unless metrics are grouped by account
+	current    atomic.Value     // *snapshotGeneration
+	mutex      sync.Mutex       // serializes Publish()
+}
+
+// snapshotGeneration is an immutable set of metrics published at once.
+type snapshotGeneration struct {
+	number    uint64
+	published time.Time
+	metrics   []prometheus.Metric
+	accounts  map[snapshotAccountKey]*snapshotAccount
+}
+
+// snapshotAccountKey identifies an account, account names are not unique across
+// subscriptions and resource groups.
+type snapshotAccountKey struct {
+	subscription  string
+	resourceGroup string
+	account       string
+}
+
+// snapshotAccount holds the metrics of an account.
+type snapshotAccount struct {
+	updated time.Time
+	metrics []prometheus.Metric
+}
+
+// Failures records the accounts and subscriptions which could not be updated
+// during a run of an update metrics function.
+type Failures struct {
+	mutex         sync.Mutex
+	accounts      map[snapshotAccountKey]bool
+	subscriptions map[string]bool
+	listed        map[string]bool
+	unlisted      bool
+}
+
+// NewFailures returns an empty Failures.
+func NewFailures() *Failures {
+	return &Failures{
+		accounts:      make(map[snapshotAccountKey]bool),
+		subscriptions: make(map[string]bool),
+		listed:        make(map[string]bool),
+	}
+}
+
+// Account records that the account `name` of the given subscription and
+// resource group could not be updated.
+func (f *Failures) Account(subscription string, resourceGroup string, name string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.accounts[snapshotAccountKey{subscription, resourceGroup, name}] = true
+}
+
+// Subscription records that the accounts of the subscription `name` could not
+// be listed.
+func (f *Failures) Subscription(name string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.subscriptions[name] = true
+}
+
+// Listed records that the subscription `name` has been listed.
+func (f *Failures) Listed(name string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.listed[name] = true
+}
+
+// Unlisted records that some subscriptions could not be listed. The accounts
+// of the subscriptions which have not been listed are then considered failed.
+func (f *Failures) Unlisted() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.unlisted = true
+}
+
+// hasAccount returns true if the account `name` of the given subscription and
+// resource group has been recorded.
+func (f *Failures) hasAccount(subscription string, resourceGroup string, name string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.accounts[snapshotAccountKey{subscription, resourceGroup, name}]
+}
+
+// failed returns true if the account could not be updated.
+func (f *Failures) failed(key snapshotAccountKey) bool {
+	if f == nil {
+		return false
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.unlisted && !f.listed[key.subscription] {
+		return true
+	}
+
+	return f.accounts[key] || f.subscriptions[key.subscription]
+}
+
+// NewSnapshot returns a Snapshot of the metrics of the update metrics function
+// `name`. The collectors are only used to describe the metrics, they must
+// describe every metric which will be published.
+func NewSnapshot(clock Clock, name string, collectors ...prometheus.Collector) *Snapshot {
+	s := &Snapshot{
+		clock: clock,
+		generation: prometheus.NewDesc(
+			"azure_exporter_snapshot_generation",
+			"Number of times the metrics of the update metrics function have been published",
+			nil, prometheus.Labels{"function": name},
+		),
+		age: prometheus.NewDesc(
+			"azure_exporter_snapshot_age_seconds",
+			"Age of the metrics published by the update metrics function",
+			nil, prometheus.Labels{"function": name},
+		),
+	}
+
+	ch := make(chan *prometheus.Desc)
+
+	go func() {
+		for _, collector := range collectors {
+			collector.Describe(ch)
+		}
+
+		close(ch)
+	}()
+
+	for desc := range ch {
+		s.descs = append(s.descs, desc)
+	}
+
+	s.current.Store(&snapshotGeneration{})
+
+	return s
+}
+
+// NewAccountSnapshot returns a Snapshot whose metrics are grouped by their
+// `subscription`, `resource_group` and `account` labels so that the last metrics of accounts which could not be
+// updated can be retained. The age of the metrics of each account is exposed
+// with the given resource type.
+func NewAccountSnapshot(clock Clock, name string, resourceType string, collectors ...prometheus.Collector) *Snapshot {
+	s := NewSnapshot(clock, name, collectors...)
+	s.dataAge = prometheus.NewDesc(
+		"azure_exporter_resource_data_age_seconds",
+		"Age of the metrics of the resource, greater than the snapshot age when its last update failed",
+		[]string{"subscription", "resource_group", "account"}, prometheus.Labels{"resource_type": resourceType},
+	)
+
+	return s
+}
+
+// Publish replaces the metrics served by the snapshot with the ones
+// collected from collectors. The collectors must not be modified afterwards.
+func (s *Snapshot) Publish(collectors ...prometheus.Collector) {
+	s.PublishRetaining(nil, 0, collectors...)
+}
+
+// PublishRetaining is like Publish() but keeps serving, for up to grace since
+// their last successful update, the previous metrics of the accounts recorded
+// in failures instead of the ones collected from collectors.
+func (s *Snapshot) PublishRetaining(failures *Failures, grace time.Duration, collectors ...prometheus.Collector) {
+	ch := make(chan prometheus.Metric)
+	metrics := make([]prometheus.Metric, 0)
+
+	go func() {
+		for _, collector := range collectors {
+			collector.Collect(ch)
+		}
+
+		close(ch)
+	}()
+
+	for metric := range ch {
+		metrics = append(metrics, metric)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := s.clock.Now()
+	previous := s.load()
+	next := &snapshotGeneration{
+		number:    previous.number + 1,
+		published: now,
+	}
+
+	if s.dataAge == nil {
+		next.metrics = metrics
+		s.current.Store(next)
+		return
+	}
+
+	next.metrics, next.accounts = groupByAccount(metrics, now)
+
+	for key, account := range previous.accounts {
+		if !failures.failed(key) || now.Sub(account.updated) > grace {
+			continue
+		}
+
+		next.accounts[key] = account
+	}
+
+	s.current.Store(next)
+}
+
+// groupByAccount splits metrics between the ones having an `account` label
+// and the others.
+func groupByAccount(metrics []prometheus.Metric, updated time.Time) ([]prometheus.Metric, map[snapshotAccountKey]*snapshotAccount) {
+	others := make([]prometheus.Metric, 0)
+	accounts := make(map[snapshotAccountKey]*snapshotAccount)
+
+	for _, metric := range metrics {
+		m := dto.Metric{}
+
+		if err := metric.Write(&m); err != nil {
+			others = append(others, metric)
+			continue
+		}
+
+		var key snapshotAccountKey
+		var found bool
+
+		for _, label := range m.GetLabel() {
+			switch label.GetName() {
+			case "account":
+				key.account, found = label.GetValue(), true
+			case "resource_group":
+				key.resourceGroup = label.GetValue()
+			case "subscription":
+				key.subscription = label.GetValue()
+			}
+		}
+
+		if !found {
+			others = append(others, metric)
+			continue
+		}
+
+		if accounts[key] == nil {
+			accounts[key] = &snapshotAccount{updated: updated}
+		}
+
+		accounts[key].metrics = append(accounts[key].metrics, metric)
+	}
+
+	return others, accounts
+}
+
+// Generation returns the number of times metrics have been published.
+func (s *Snapshot) Generation() uint64 {
+	return s.load().number
+}
+
+// load returns the current generation.
+func (s *Snapshot) load() *snapshotGeneration {
+	return s.current.Load().(*snapshotGeneration)
+}
+
+// Describe implements prometheus.Collector.
+func (s *Snapshot) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range s.descs {
+		ch <- desc
+	}
+
+	ch <- s.generation
+	ch <- s.age
+
+	if s.dataAge != nil {
+		ch <- s.dataAge
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (s *Snapshot) Collect(ch chan<- prometheus.Metric) {
+	current := s.load()
+
+	for _, metric := range current.metrics {
+		ch <- metric
+	}
+
+	ch <- prometheus.MustNewConstMetric(s.generation, prometheus.GaugeValue, float64(current.number))
+
+	// Nothing has been published yet.
+	if current.number == 0 {
+		return
+	}
+
+	now := s.clock.Now()
+	ch <- prometheus.MustNewConstMetric(s.age, prometheus.GaugeValue, now.Sub(current.published).Seconds())
+
+	for key, account := range current.accounts {
+		for _, metric := range account.metrics {
+			ch <- metric
+		}
+
+		ch <- prometheus.MustNewConstMetric(s.dataAge, prometheus.GaugeValue, now.Sub(account.updated).Seconds(), key.subscription, key.resourceGroup, key.account)
+	}
+}
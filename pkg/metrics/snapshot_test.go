@@ -0,0 +1,241 @@
+package metrics
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newSnapshotTestGauges() (*prometheus.GaugeVec, *prometheus.GaugeVec) {
+	a := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_a"}, []string{"run"})
+	b := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_b"}, []string{"run"})
+
+	return a, b
+}
+
+func TestSnapshot(t *testing.T) {
+	clock := newFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	a, b := newSnapshotTestGauges()
+	snapshot := NewSnapshot(clock, "test", a, b)
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(snapshot)
+
+	if count := testutil.CollectAndCount(snapshot); count != 1 {
+		t.Fatalf("Expected %v but got %v", 1, count)
+	}
+
+	a, b = newSnapshotTestGauges()
+	a.WithLabelValues("1").Set(1)
+	b.WithLabelValues("1").Set(1)
+	snapshot.Publish(a, b)
+
+	// Metrics collected after Publish() do not leak in the snapshot.
+	a.WithLabelValues("2").Set(2)
+	clock.Advance(time.Minute)
+
+	families, err := registry.Gather()
+
+	if err != nil {
+		t.Fatalf("Expected no error but got %v", err)
+	}
+
+	values := make(map[string]float64)
+
+	for _, family := range families {
+		if len(family.GetMetric()) != 1 {
+			t.Fatalf("Expected %v but got %v metrics for %s", 1, len(family.GetMetric()), family.GetName())
+		}
+
+		values[family.GetName()] = family.GetMetric()[0].GetGauge().GetValue()
+	}
+
+	expected := map[string]float64{
+		"test_a":                              1,
+		"test_b":                              1,
+		"azure_exporter_snapshot_generation":  1,
+		"azure_exporter_snapshot_age_seconds": 60,
+	}
+
+	for name, value := range expected {
+		if values[name] != value {
+			t.Fatalf("Expected %v but got %v for %s", value, values[name], name)
+		}
+	}
+}
+
+func TestSnapshotConsistency(t *testing.T) {
+	a, b := newSnapshotTestGauges()
+	snapshot := NewSnapshot(newFakeClock(time.Now()), "test", a, b)
+	wg := sync.WaitGroup{}
+	done := make(chan struct{})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 100; i++ {
+			a, b := newSnapshotTestGauges()
+			a.WithLabelValues("run").Set(float64(i))
+			b.WithLabelValues("run").Set(float64(i))
+			snapshot.Publish(a, b)
+		}
+
+		close(done)
+	}()
+
+	for {
+		select {
+		case <-done:
+			wg.Wait()
+
+			if generation := snapshot.Generation(); generation != 100 {
+				t.Fatalf("Expected %v but got %v", 100, generation)
+			}
+
+			return
+		default:
+		}
+
+		ch := make(chan prometheus.Metric, 10)
+		snapshot.Collect(ch)
+		close(ch)
+
+		values := make([]float64, 0)
+
+		for metric := range ch {
+			if metric.Desc() == snapshot.generation || metric.Desc() == snapshot.age {
+				continue
+			}
+
+			values = append(values, testutil.ToFloat64(metric.(prometheus.Collector)))
+		}
+
+		if len(values) == 2 && values[0] != values[1] {
+			t.Fatalf("Expected a consistent generation but got %v", values)
+		}
+	}
+}
+
+func TestSnapshotRetention(t *testing.T) {
+	clock := newFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	newGauge := func() *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_value"}, []string{"subscription", "account"})
+	}
+	snapshot := NewAccountSnapshot(clock, "test", "test_account", newGauge())
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(snapshot)
+
+	gather := func() map[string]float64 {
+		families, err := registry.Gather()
+
+		if err != nil {
+			t.Fatalf("Expected no error but got %v", err)
+		}
+
+		values := make(map[string]float64)
+
+		for _, family := range families {
+			for _, metric := range family.GetMetric() {
+				key := family.GetName()
+
+				labels := make(map[string]string)
+
+				for _, label := range metric.GetLabel() {
+					labels[label.GetName()] = label.GetValue()
+				}
+
+				if account, ok := labels["account"]; ok {
+					key += "/" + labels["subscription"] + "/" + account
+				}
+
+				values[key] = metric.GetGauge().GetValue()
+			}
+		}
+
+		return values
+	}
+
+	// Both accounts are updated.
+	gauge := newGauge()
+	gauge.WithLabelValues("sub1", "a").Set(1)
+	gauge.WithLabelValues("sub2", "b").Set(1)
+	snapshot.PublishRetaining(NewFailures(), time.Hour, gauge)
+
+	// Account a fails and its previous metrics are retained, account b is
+	// no longer listed and its metrics are dropped.
+	clock.Advance(30 * time.Minute)
+	gauge = newGauge()
+	gauge.WithLabelValues("sub1", "a").Set(2)
+	failures := NewFailures()
+	failures.Account("sub1", "", "a")
+	snapshot.PublishRetaining(failures, time.Hour, gauge)
+	clock.Advance(time.Minute)
+
+	values := gather()
+	expected := map[string]float64{
+		"test_value/sub1/a": 1,
+		"azure_exporter_resource_data_age_seconds/sub1/a": 31 * 60,
+		"azure_exporter_snapshot_age_seconds":             60,
+	}
+
+	for key, value := range expected {
+		if values[key] != value {
+			t.Fatalf("Expected %v but got %v for %s", value, values[key], key)
+		}
+	}
+
+	if _, ok := values["test_value/sub2/b"]; ok {
+		t.Fatalf("Expected the metrics of b to be dropped")
+	}
+
+	// The subscription of a fails past the grace period.
+	clock.Advance(30 * time.Minute)
+	failures = NewFailures()
+	failures.Subscription("sub1")
+	snapshot.PublishRetaining(failures, time.Hour, newGauge())
+
+	if _, ok := gather()["test_value/sub1/a"]; ok {
+		t.Fatalf("Expected the metrics of a to be dropped after the grace period")
+	}
+
+	// The subscription of b cannot be listed, its metrics are retained.
+	gauge = newGauge()
+	gauge.WithLabelValues("sub1", "a").Set(3)
+	gauge.WithLabelValues("sub2", "b").Set(3)
+	snapshot.PublishRetaining(NewFailures(), time.Hour, gauge)
+
+	gauge = newGauge()
+	gauge.WithLabelValues("sub1", "a").Set(4)
+	failures = NewFailures()
+	failures.Listed("sub1")
+	failures.Unlisted()
+	snapshot.PublishRetaining(failures, time.Hour, gauge)
+
+	values = gather()
+
+	if values["test_value/sub1/a"] != 4 || values["test_value/sub2/b"] != 3 {
+		t.Fatalf("Expected %v but got %v", "a=4 b=3", values)
+	}
+
+	// Accounts with the same name in two subscriptions are retained
+	// independently.
+	gauge = newGauge()
+	gauge.WithLabelValues("sub1", "c").Set(5)
+	gauge.WithLabelValues("sub2", "c").Set(5)
+	snapshot.PublishRetaining(NewFailures(), time.Hour, gauge)
+
+	gauge = newGauge()
+	gauge.WithLabelValues("sub2", "c").Set(6)
+	failures = NewFailures()
+	failures.Account("sub1", "", "c")
+	snapshot.PublishRetaining(failures, time.Hour, gauge)
+
+	values = gather()
+
+	if values["test_value/sub1/c"] != 5 || values["test_value/sub2/c"] != 6 {
+		t.Fatalf("Expected %v but got %v", "sub1/c=5 sub2/c=6", values)
+	}
+}
@@ -2,17 +2,16 @@ package metrics
 
 import (
 	"context"
-	"os"
+	"sync"
 	"time"
 
 	"github.com/sylr/prometheus-azure-exporter/pkg/config"
 
-	"github.com/Azure/azure-sdk-for-go/services/preview/subscription/mgmt/2018-03-01-preview/subscription"
 	"github.com/Azure/azure-sdk-for-go/services/storage/mgmt/2019-06-01/storage"
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	"github.com/sylr/prometheus-azure-exporter/pkg/azure"
-	"sylr.dev/libqd/sync"
+	qdsync "sylr.dev/libqd/sync"
 )
 
 const (
@@ -22,7 +21,26 @@ const (
 )
 
 var (
-	storageAccountContainerBlobSizeHistogram = newStorageAccountContainerBlobSizeHistogram()
+	storageSnapshot       *Snapshot
+	storageCircuitBreaker = newCircuitBreaker()
+	storageAccountErrors  = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "azure_exporter",
+			Subsystem: "storage_account",
+			Name:      "errors_total",
+			Help:      "Number of errors while updating the metrics of storage accounts by cause",
+		},
+		[]string{"account", "cause"},
+	)
+	storageAccountCircuitOpen = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "azure_exporter",
+			Subsystem: "storage_account",
+			Name:      "circuit_open",
+			Help:      "Whether the storage account is skipped after failing repeatedly",
+		},
+		[]string{"account"},
+	)
 )
 
 // -----------------------------------------------------------------------------
@@ -46,7 +64,9 @@ func newStorageAccountContainerBlobSizeHistogram() *prometheus.HistogramVec {
 // -----------------------------------------------------------------------------
 
 func init() {
-	prometheus.MustRegister(storageAccountContainerBlobSizeHistogram)
+	storageSnapshot = NewUpdateMetricsFunctionAccountSnapshot("storage", "storage_account", newStorageAccountContainerBlobSizeHistogram())
+	prometheus.MustRegister(storageAccountErrors)
+	prometheus.MustRegister(storageAccountCircuitOpen)
 
 	if GetUpdateMetricsFunctionInterval("storage") == nil {
 		RegisterUpdateMetricsFunctionWithInterval("storage", UpdateStorageMetrics, 2*time.Hour)
@@ -55,96 +75,176 @@ func init() {
 
 // UpdateStorageMetrics updates storage metrics.
 func UpdateStorageMetrics(ctx context.Context) error {
-	var err error
-
 	contextLogger := log.WithFields(log.Fields{
 		"_id":   ctx.Value("id").(string),
 		"_func": "UpdateStorageMetrics",
 	})
 
-	azureClients := azure.NewAzureClients()
-	sub, err := azure.GetSubscription(ctx, azureClients, os.Getenv("AZURE_SUBSCRIPTION_ID"))
+	hist := newStorageAccountContainerBlobSizeHistogram()
+	accountMetrics := azure.StorageAccountMetrics{
+		ContainerBlobSizeHistogram: hist,
+	}
 
-	if err != nil {
-		contextLogger.Errorf("Unable to get subscription: %s", err)
-		return err
+	// Accounts whose previous metrics are retained
+	failures := NewFailures()
+
+	// accountError records that the update of account failed with err.
+	accountError := func(subscription string, resourceGroup string, account string, err error) {
+		storageAccountErrors.WithLabelValues(account, string(azure.ClassifyError(err))).Inc()
+		failures.Account(subscription, resourceGroup, account)
 	}
 
-	storageAccounts, err := azure.ListSubscriptionStorageAccounts(ctx, azureClients, sub)
+	threshold, skip := storageCircuitBreakerOptions()
+
+	azureClients := azure.GetAzureClients()
+	subs, err := listSubscriptions(ctx, azureClients, failures)
 
 	if err != nil {
-		contextLogger.Errorf("Unable to list account azure storage accounts: %s", err)
+		contextLogger.Errorf("Unable to list subscriptions: %s", err)
 		return err
 	}
 
-	hist := newStorageAccountContainerBlobSizeHistogram()
-	accountMetrics := azure.StorageAccountMetrics{
-		ContainerBlobSizeHistogram: hist,
-	}
-
-	// Create a bounded wait group which allows 10 concurrent processes for
+	// Create a bounded wait group, shared by all subscriptions, which allows
+	// the configured number of concurrent processes, 10 by default, for
 	// updating account's containers' metrics.
-	wg := sync.NewCancelableWaitGroup(ctx, 10)
+	wg := newFunctionWaitGroup(ctx, "storage", 10)
 
-	// Loop over storage accounts.
-	for accountKey := range *storageAccounts {
-		accountProperties, _ := azure.ParseResourceID(*(*storageAccounts)[accountKey].ID)
+	// Accounts which have been updated, successfully or not.
+	accounts := make([]snapshotAccountKey, 0)
+	accountsMutex := sync.Mutex{}
 
-		// logger
-		accountLogger := contextLogger.WithFields(log.Fields{
-			"rg":      accountProperties.ResourceGroup,
-			"account": *(*storageAccounts)[accountKey].Name,
+	err = forEachSubscription(ctx, "storage", subs, failures, func(ctx context.Context, sub *azure.Subscription) error {
+		subscriptionLogger := contextLogger.WithFields(log.Fields{
+			"subscription": *sub.DisplayName,
 		})
 
-		// Autodiscovery
-		if !config.MustDiscoverBasedOnTags((*storageAccounts)[accountKey].Tags) {
-			accountLogger.Debugf("Account skipped by autodiscovery")
-			continue
-		}
-
-		accountLogger.Debugf("Start updating storage account")
-		containers, err := azure.ListStorageAccountContainers(ctx, azureClients, sub, &(*storageAccounts)[accountKey])
+		storageAccounts, err := azure.ListSubscriptionStorageAccounts(ctx, azureClients, sub)
 
 		if err != nil {
-			contextLogger.Fatalf("%v", err)
-			accountMetrics.DeleteLabelValues(*(*storageAccounts)[accountKey].Name)
-			continue
+			subscriptionLogger.Errorf("Unable to list account azure storage accounts: %s", err)
+			failures.Subscription(*sub.DisplayName)
+			return err
 		}
 
-		// Loop over storage accounts
-		for containerKey := range *containers {
-			// wg needs to be incremented outside the goroutine otherwise we could
-			// reach wg.Wait() before wg.Add(1) is hit if it is in the goroutine.
-			wg.Add(1)
-
-			go func(wg sync.Waiter, subscription *subscription.Model, account *storage.Account, container *storage.ListContainerItem, walker *azure.StorageAccountMetrics) {
-				accountLogger.Debugf("Start updating container: %s", *container.Name)
-
-				t0 := time.Now()
-				err := azure.WalkStorageAccountContainer(ctx, azureClients, subscription, account, container, walker)
-				t1 := time.Since(t0)
-
-				if err != nil {
-					accountLogger.Error(err)
-				} else {
-					accountLogger.Debugf("Done updating container: %s (%v)", *container.Name, t1)
-				}
-
-				wg.Done()
-			}(wg, sub, &(*storageAccounts)[accountKey], &(*containers)[containerKey], &accountMetrics)
-			// --------^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^--^^^^^^^^^^^^^^^^^^^^^^^^^^^^------------------
-			// https://play.golang.org/p/YRGEg4LS5jd
-			// https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
-			// ---------------------------------------------------------------------------------------
+		// Loop over storage accounts.
+		for accountKey := range *storageAccounts {
+			accountProperties, err := azure.ParseResourceID(stringValue((*storageAccounts)[accountKey].ID))
+
+			if err != nil {
+				subscriptionLogger.WithField("account", stringValue((*storageAccounts)[accountKey].Name)).Errorf("Unable to parse account ID: %s", err)
+				continue
+			}
+
+			// logger
+			accountLogger := subscriptionLogger.WithFields(log.Fields{
+				"rg":      accountProperties.ResourceGroup,
+				"account": *(*storageAccounts)[accountKey].Name,
+			})
+
+			// Autodiscovery
+			account := &(*storageAccounts)[accountKey]
+			discover, err := mustDiscover(ctx, azureClients, sub, account.ID, account.Name, account.Location, account.Type, account.Tags)
+
+			if err != nil {
+				accountLogger.Errorf("Unable to get inherited tags for autodiscovery: %s", err)
+				accountError(*sub.DisplayName, accountProperties.ResourceGroup, *account.Name, err)
+				continue
+			}
+
+			if !discover {
+				accountLogger.Debugf("Account skipped by autodiscovery")
+				continue
+			}
+
+			// Circuit breaker
+			accountName := *(*storageAccounts)[accountKey].Name
+
+			if !storageCircuitBreaker.Allow(accountName) {
+				accountLogger.Warnf("Account skipped after failing during %d consecutive runs", threshold)
+				storageAccountCircuitOpen.WithLabelValues(accountName).Set(1)
+				failures.Account(*sub.DisplayName, accountProperties.ResourceGroup, accountName)
+				continue
+			}
+
+			accountLogger.Debugf("Start updating storage account")
+			containers, err := azure.ListStorageAccountContainers(ctx, azureClients, sub, &(*storageAccounts)[accountKey])
+
+			if err != nil {
+				accountLogger.Errorf("Unable to list storage account containers: %s", err)
+				accountError(*sub.DisplayName, accountProperties.ResourceGroup, accountName, err)
+				accountsMutex.Lock()
+				accounts = append(accounts, snapshotAccountKey{*sub.DisplayName, accountProperties.ResourceGroup, accountName})
+				accountsMutex.Unlock()
+				continue
+			}
+
+			// Loop over storage accounts
+			for containerKey := range *containers {
+				// wg needs to be incremented outside the goroutine otherwise we could
+				// reach wg.Wait() before wg.Add(1) is hit if it is in the goroutine.
+				wg.Add(1)
+
+				go func(wg qdsync.Waiter, subscription *azure.Subscription, account *storage.Account, container *storage.ListContainerItem, walker *azure.StorageAccountMetrics) {
+					defer wg.Done()
+
+					// A panic while walking a container only fails its account.
+					defer defaultScheduler.recoverPanic("storage", accountLogger, func(err error) {
+						accountError(*subscription.DisplayName, accountProperties.ResourceGroup, *account.Name, err)
+					})
+
+					accountLogger.Debugf("Start updating container: %s", *container.Name)
+
+					t0 := time.Now()
+					err := azure.WalkStorageAccountContainer(ctx, azureClients, subscription, account, container, walker)
+					t1 := time.Since(t0)
+
+					if err != nil {
+						accountLogger.Error(err)
+						accountError(*subscription.DisplayName, accountProperties.ResourceGroup, *account.Name, err)
+					} else {
+						accountLogger.Debugf("Done updating container: %s (%v)", *container.Name, t1)
+					}
+				}(wg, sub, &(*storageAccounts)[accountKey], &(*containers)[containerKey], &accountMetrics)
+				// --------^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^^--^^^^^^^^^^^^^^^^^^^^^^^^^^^^------------------
+				// https://play.golang.org/p/YRGEg4LS5jd
+				// https://github.com/golang/go/wiki/CommonMistakes#using-goroutines-on-loop-iterator-variables
+				// ---------------------------------------------------------------------------------------
+			}
+
+			accountsMutex.Lock()
+			accounts = append(accounts, snapshotAccountKey{*sub.DisplayName, accountProperties.ResourceGroup, accountName})
+			accountsMutex.Unlock()
+			accountLogger.Debugf("Done updating storage account")
 		}
 
-		accountLogger.Debugf("Done updating storage account")
-	}
+		return nil
+	})
 
 	wg.Wait()
 
-	// swapping current registered histogram with an updated copy
-	*storageAccountContainerBlobSizeHistogram = *accountMetrics.ContainerBlobSizeHistogram
+	// Circuit breaker
+	for _, key := range accounts {
+		storageCircuitBreaker.Done(key.account, failures.hasAccount(key.subscription, key.resourceGroup, key.account), threshold, skip)
+
+		if storageCircuitBreaker.Open(key.account) {
+			storageAccountCircuitOpen.WithLabelValues(key.account).Set(1)
+		} else {
+			storageAccountCircuitOpen.WithLabelValues(key.account).Set(0)
+		}
+	}
+
+	// publishing updated histogram
+	storageSnapshot.PublishRetaining(failures, staleGracePeriod(), accountMetrics.ContainerBlobSizeHistogram)
 
 	return err
 }
+
+// storageCircuitBreakerOptions returns the number of consecutive failed runs
+// after which a storage account is skipped and for how many runs.
+func storageCircuitBreakerOptions() (int, int) {
+	if config.CurrentConfig == nil {
+		return 0, 0
+	}
+
+	return int(config.CurrentConfig.StorageCircuitBreakerThreshold), int(config.CurrentConfig.StorageCircuitBreakerSkipRuns)
+}
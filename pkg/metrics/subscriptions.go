@@ -0,0 +1,147 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/services/preview/subscription/mgmt/2018-03-01-preview/subscription"
+	log "github.com/sirupsen/logrus"
+	"github.com/sylr/prometheus-azure-exporter/pkg/azure"
+	"github.com/sylr/prometheus-azure-exporter/pkg/config"
+	qdsync "sylr.dev/libqd/sync"
+)
+
+// listSubscriptions returns the subscriptions update metrics functions need
+// to process according to the configured subscriptions mode. Profiles and
+// subscriptions which cannot be listed are logged and recorded in failures,
+// an error is only returned if no subscription could be listed.
+func listSubscriptions(ctx context.Context, clients *azure.AzureClients, failures *Failures) ([]*azure.Subscription, error) {
+	contextLogger := log.WithFields(log.Fields{
+		"_id": ctx.Value("id").(string),
+	})
+
+	conf := config.CurrentConfig
+	if conf == nil {
+		conf = &config.PrometheusAzureExporterConfig{}
+	}
+
+	subs := make([]*azure.Subscription, 0)
+
+	var lastErr error
+
+	if config.SubscriptionsModeAll.MatchString(conf.SubscriptionsMode) {
+		// A subscription visible by several profiles is only processed once
+		// with the first profile which listed it.
+		seen := make(map[string]bool)
+
+		for _, profile := range conf.GetProfileNames() {
+			all, err := azure.ListSubscriptions(ctx, clients, profile)
+
+			if err != nil {
+				contextLogger.WithField("profile", profile).Errorf("Unable to list subscriptions: %s", err)
+				failures.Unlisted()
+				lastErr = err
+				continue
+			}
+
+			for i := range *all {
+				sub := &(*all)[i]
+
+				// Disabled and deleted subscriptions can not be queried.
+				switch sub.State {
+				case subscription.Disabled, subscription.Deleted:
+					contextLogger.WithField("subscription", *sub.DisplayName).Debugf("Subscription skipped because its state is %s", sub.State)
+					continue
+				}
+
+				if seen[*sub.SubscriptionID] {
+					continue
+				}
+
+				seen[*sub.SubscriptionID] = true
+				subs = append(subs, sub)
+				failures.Listed(*sub.DisplayName)
+			}
+		}
+	} else {
+		for _, s := range conf.GetSubscriptions() {
+			sub, err := azure.GetSubscription(ctx, clients, s.Profile, s.ID)
+
+			if err != nil {
+				contextLogger.WithField("subscription", s.ID).Errorf("Unable to get subscription: %s", err)
+				failures.Unlisted()
+				lastErr = err
+				continue
+			}
+
+			subs = append(subs, sub)
+			failures.Listed(*sub.DisplayName)
+		}
+	}
+
+	if len(subs) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+
+	return subs, nil
+}
+
+// forEachSubscription calls f over all given subscriptions. At most
+// `subscriptions_concurrency` subscriptions are processed at the same time.
+// If one or several calls of f return an error, the last one is returned
+// once all calls are done. A panic in a call of f is recovered and counted
+// for the update metrics function `name`, its subscription is recorded in
+// failures and the panic is returned as its error.
+func forEachSubscription(ctx context.Context, name string, subs []*azure.Subscription, failures *Failures, f func(context.Context, *azure.Subscription) error) error {
+	var err error
+
+	contextLogger := log.WithFields(log.Fields{
+		"_id": ctx.Value("id").(string),
+	})
+
+	concurrency := 1
+	if config.CurrentConfig != nil && config.CurrentConfig.SubscriptionsConcurrency > 0 {
+		concurrency = int(config.CurrentConfig.SubscriptionsConcurrency)
+	}
+
+	mu := sync.Mutex{}
+	wg := qdsync.NewCancelableWaitGroup(ctx, concurrency)
+
+	for i := range subs {
+		wg.Add(1)
+
+		go func(sub *azure.Subscription) {
+			defer wg.Done()
+
+			// A panic while processing a subscription only fails it.
+			defer defaultScheduler.recoverPanic(name, contextLogger.WithField("subscription", stringValue(sub.DisplayName)), func(e error) {
+				failures.Subscription(stringValue(sub.DisplayName))
+
+				mu.Lock()
+				err = e
+				mu.Unlock()
+			})
+
+			if e := f(ctx, sub); e != nil {
+				mu.Lock()
+				err = e
+				mu.Unlock()
+			}
+		}(subs[i])
+	}
+
+	wg.Wait()
+
+	return err
+}
+
+// staleGracePeriod returns the time during which the last metrics of the
+// accounts which cannot be updated are still served.
+func staleGracePeriod() time.Duration {
+	if config.CurrentConfig == nil {
+		return 0
+	}
+
+	return config.CurrentConfig.StaleGracePeriod
+}
@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/services/preview/subscription/mgmt/2018-03-01-preview/subscription"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sylr/prometheus-azure-exporter/pkg/azure"
+)
+
+func TestForEachSubscriptionPanic(t *testing.T) {
+	ctx := context.WithValue(context.Background(), "id", "00000000")
+	name := "sub1"
+	subs := []*azure.Subscription{
+		{Model: &subscription.Model{}},
+		{Model: &subscription.Model{DisplayName: &name}},
+	}
+
+	panics := defaultScheduler.metrics.panics.WithLabelValues("test")
+	before := testutil.ToFloat64(panics)
+	failures := NewFailures()
+	processed := make([]string, 0)
+	mu := sync.Mutex{}
+
+	// The subscription without display name panics.
+	err := forEachSubscription(ctx, "test", subs, failures, func(ctx context.Context, sub *azure.Subscription) error {
+		displayName := *sub.DisplayName
+
+		mu.Lock()
+		processed = append(processed, displayName)
+		mu.Unlock()
+
+		return nil
+	})
+
+	if err == nil {
+		t.Fatalf("Expected an error but got %v", err)
+	}
+
+	if len(processed) != 1 || processed[0] != name {
+		t.Fatalf("Expected %v but got %v", []string{name}, processed)
+	}
+
+	if !failures.subscriptions[""] {
+		t.Fatalf("Expected the subscription to be recorded as failed")
+	}
+
+	if v := testutil.ToFloat64(panics) - before; v != 1 {
+		t.Fatalf("Expected %v but got %v", 1, v)
+	}
+}
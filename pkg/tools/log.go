@@ -12,6 +12,7 @@ func SortLogKeys(keys []string) {
 		"_id",
 		"_interval",
 		"_func",
+		"tenant",
 		"subscription",
 		"rg",
 		"resource_group",